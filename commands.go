@@ -0,0 +1,447 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/hatchling/gdrive-dir-push/push"
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+// command describes one of the commands for the help.
+type command struct {
+	name string
+	// args is what follows the name on the command line.
+	args    string
+	summary string
+	// flags are the flags the command takes besides globalFlags.  Push and its variants take every
+	// flag but those of notPushFlags instead.
+	flags []string
+}
+
+// Flags that several commands take.
+var (
+	// globalFlags are taken by every command: where the config, account and sync state are, how
+	// the run logs and how it paces its requests.
+	globalFlags = []string{"config", "profile", "credentials_file", "client_id", "secret", "token_file", "token_keyring", "device_auth", "service_account_file", "impersonate",
+		"state_dir", "state_db", "log_level", "log_format", "verbose", "nice", "max_qps", "bwlimit", "chunk_size", "max_ops_per_day", "quota_wait", "max_gdrive_ops"}
+	// targetFlags name the sync relationship.
+	targetFlags = []string{"gdrive_root_id", "local_dir_to_push"}
+	// listingFlags concern listing GDrive folders.
+	listingFlags = []string{"remote_scope", "listing_ttl"}
+	// localFlags concern scanning the local dir.
+	localFlags = []string{"include", "exclude", "ignore_file"}
+	// oldFilesFlags say where replaced files go.
+	oldFilesFlags = []string{"old_files_dir", "old_files_dir_for"}
+	// uploadFlags concern uploading files.
+	uploadFlags = []string{"policy", "mime_type", "description_template", "label", "partial_name", "multipart_limit", "read_ahead"}
+	// notPushFlags are those only other commands take.
+	notPushFlags = []string{"verify_sample", "verify_seed", "verify_checkpoint", "repair", "trash_min_age", "audit_allowed_domains", "audit_allow_anyone", "rclone_config"}
+)
+
+// flagNames joins the flag name |lists|.
+func flagNames(lists ...[]string) []string {
+	var names []string
+	for _, list := range lists {
+		names = append(names, list...)
+	}
+	return names
+}
+
+// commands lists the commands in the order the help shows them.
+var commands = []command{
+	{"push", "", "Push --local_dir_to_push to --gdrive_root_id, which is also what runs without a command do", nil},
+	{"diff", "", "Show what a push would change without writing to GDrive, like push --dry_run", nil},
+	{"prune", "", "Push, also removing GDrive items that stayed missing locally past the grace, like push --delete_extraneous", nil},
+	{"pull", "", "Download what is missing or differs locally from --gdrive_root_id into --local_dir_to_push",
+		flagNames(targetFlags, listingFlags, []string{"dry_run"})},
+	{"bisync", "", "Sync --local_dir_to_push and --gdrive_root_id both ways",
+		flagNames(targetFlags, localFlags, oldFilesFlags, uploadFlags, []string{"only_manage_own", "dry_run"})},
+	{"ls", "[PATH]", "List the GDrive tree under --gdrive_root_id, or under PATH below it",
+		flagNames(targetFlags, listingFlags, []string{"offline"})},
+	{"verify", "[restart]", "Check that the synced files still match their GDrive copies",
+		flagNames(targetFlags, listingFlags, localFlags, oldFilesFlags, uploadFlags, []string{"verify_sample", "verify_seed", "verify_checkpoint", "repair", "parallel"})},
+	{"auth", "", "Authorize access to Drive if needed and show the account used", nil},
+	{"init", "", "Set up an OAuth client, authorize it and save the answers to the config file",
+		flagNames(targetFlags, []string{"old_files_dir", "rclone_config"})},
+	{"profiles", "list", "Show the account profiles and what each uses", nil},
+	{"history", "[show RUN]", "List past runs, or show everything about one", nil},
+	{"snapshot", "", "Save the whole GDrive tree to the sync state for --offline plans",
+		flagNames(targetFlags, listingFlags)},
+	{"state", "export|import FILE|hashes md5|sha256 FILE", "Move the sync state between machines, or list the hashes of the local files for rclone checksum or sha256sum -c",
+		flagNames(targetFlags, localFlags, []string{"policy"})},
+	{"skip", "list|add PATH [REASON]|remove PATH|clear", "Manage the paths pushes leave out", targetFlags},
+	{"trash", "list|empty", "List or empty what this tool trashed", []string{"gdrive_root_id", "trash_min_age"}},
+	{"repair", "[apply]", "Report, and with apply fix, inconsistencies under --gdrive_root_id",
+		flagNames(targetFlags, listingFlags, localFlags, oldFilesFlags, []string{"only_manage_own"})},
+	{"merge-folders", "[apply]", "Report, and with apply merge, same-named sibling folders",
+		flagNames(targetFlags, listingFlags, oldFilesFlags)},
+	{"audit-perms", "", "List who can see what under --gdrive_root_id",
+		[]string{"gdrive_root_id", "audit_allowed_domains", "audit_allow_anyone"}},
+	{"manifest", "diff A B", "Compare the pushes two --manifest files describe", []string{"pager"}},
+	{"diff-local", "SRC DST", "Show what pushing one local dir over another would do", []string{"match_by", "pager"}},
+	{"help", "[COMMAND]", "Show this help, or that of COMMAND", nil},
+}
+
+// findCommand returns the command called |name|, or nil.
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// flagSet returns a flag set of the flags |c| takes, sharing their values with flag.CommandLine,
+// which still holds every flag for the config file and the environment.  Its usage is the help
+// of |c|.
+func (c *command) flagSet(out io.Writer) *flag.FlagSet {
+	set := flag.NewFlagSet(c.name, flag.ExitOnError)
+	set.SetOutput(out)
+	add := func(name string) {
+		if f := flag.Lookup(name); f != nil && set.Lookup(name) == nil {
+			set.Var(f.Value, f.Name, f.Usage)
+			set.Lookup(f.Name).DefValue = f.DefValue
+		}
+	}
+	for _, name := range globalFlags {
+		add(name)
+	}
+	if isPushCommand(c.name) {
+		notPush := make(map[string]bool)
+		for _, name := range notPushFlags {
+			notPush[name] = true
+		}
+		flag.VisitAll(func(f *flag.Flag) {
+			if !notPush[f.Name] {
+				add(f.Name)
+			}
+		})
+	}
+	for _, name := range c.flags {
+		add(name)
+	}
+	set.Usage = func() {
+		printCommandUsage(out, c)
+	}
+	return set
+}
+
+// printUsage writes the general help to |out|: the commands and all flags.
+func printUsage(out io.Writer) {
+	fmt.Fprintf(out, "Usage: %s [FLAGS] [COMMAND [ARGS]] [FLAGS]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-14s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(out, "\nRun \"%s help COMMAND\" for the flags a command takes.\n\nFlags:\n", os.Args[0])
+	flag.PrintDefaults()
+	printEnvHelp(out)
+}
+
+// printCommandUsage writes the help of |c| to |out|, listing the flags it takes: its own, then
+// the global ones.
+func printCommandUsage(out io.Writer, c *command) {
+	fmt.Fprintf(out, "Usage: %s [FLAGS] %s [FLAGS]\n\n%s.\n", os.Args[0], strings.TrimSpace(c.name+" "+c.args), c.summary)
+	global := make(map[string]bool)
+	for _, name := range globalFlags {
+		global[name] = true
+	}
+	own, shared := flag.NewFlagSet(c.name, flag.ContinueOnError), flag.NewFlagSet(c.name, flag.ContinueOnError)
+	c.flagSet(out).VisitAll(func(f *flag.Flag) {
+		set := own
+		if global[f.Name] {
+			set = shared
+		}
+		set.Var(f.Value, f.Name, f.Usage)
+		set.Lookup(f.Name).DefValue = f.DefValue
+	})
+	for _, section := range []struct {
+		title string
+		set   *flag.FlagSet
+	}{{"Flags", own}, {"Global flags", shared}} {
+		if !hasFlags(section.set) {
+			continue
+		}
+		fmt.Fprintf(out, "\n%s:\n", section.title)
+		section.set.SetOutput(out)
+		section.set.PrintDefaults()
+	}
+}
+
+// hasFlags reports whether |set| defines any flag.
+func hasFlags(set *flag.FlagSet) bool {
+	var any bool
+	set.VisitAll(func(*flag.Flag) { any = true })
+	return any
+}
+
+func init() {
+	flag.Usage = func() {
+		printUsage(flag.CommandLine.Output())
+	}
+}
+
+// parseCommandLine parses the flags, which may come before and after the command and its
+// arguments, and returns the command and arguments.  Flags the command doesn't take are refused,
+// and "-h" after a command shows its help.  Runs without a command are pushes.
+func parseCommandLine() []string {
+	flag.Parse()
+	args := flag.Args()
+	name := "push"
+	if len(args) > 0 {
+		name = args[0]
+	}
+	c := findCommand(name)
+	if c == nil {
+		// runCommand reports it
+		return args
+	}
+	set := c.flagSet(os.Stderr)
+	flag.Visit(func(f *flag.Flag) {
+		if set.Lookup(f.Name) == nil {
+			fmt.Fprintf(os.Stderr, "flag provided but not defined for %s: -%s\n", c.name, f.Name)
+			set.Usage()
+			os.Exit(2)
+		}
+	})
+	if len(args) == 0 {
+		return nil
+	}
+	positional := args[:1]
+	for rest := args[1:]; len(rest) > 0; {
+		// Exits on a bad flag, like flag.Parse
+		set.Parse(rest)
+		if set.NArg() == 0 {
+			break
+		}
+		positional = append(positional, set.Arg(0))
+		rest = set.Args()[1:]
+	}
+	set.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+	return positional
+}
+
+// helpCommand implements "help" and "help COMMAND".
+func helpCommand(args []string) error {
+	flag.CommandLine.SetOutput(os.Stdout)
+	switch len(args) {
+	case 0:
+		printUsage(os.Stdout)
+		return nil
+	case 1:
+		c := findCommand(args[0])
+		if c == nil {
+			return fmt.Errorf("Unknown command %q", args[0])
+		}
+		printCommandUsage(os.Stdout, c)
+		return nil
+	default:
+		return fmt.Errorf("Usage: help [COMMAND]")
+	}
+}
+
+// pushCommand prepares the push for "push" and the commands that are variants of it, given the
+// command line |args|.
+func pushCommand(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Usage: %s", args[0])
+	}
+	switch args[0] {
+	case "diff":
+		*dryRun = true
+	case "prune":
+		*deleteExtraneous = true
+	}
+	return nil
+}
+
+// isPushCommand reports whether |name| is "push" or a variant of it, which main runs.
+func isPushCommand(name string) bool {
+	return name == "push" || name == "diff" || name == "prune"
+}
+
+// runCommand executes a command other than a push, given as positional arguments.  |cancel|
+// aborts the requests under way, for commands that stop on interrupts.
+func runCommand(ctx context.Context, cancel context.CancelFunc, args []string) error {
+	if findCommand(args[0]) == nil {
+		return fmt.Errorf("Unknown command %q, see \"help\"", args[0])
+	}
+	switch args[0] {
+	case "help":
+		return helpCommand(args[1:])
+	case "auth":
+		return authCommand(ctx)
+	case "history":
+		if err := resolveStateDir(); err != nil {
+			return err
+		}
+		return historyCommand(args[1:])
+	case "profiles":
+		return profilesCommand(args[1:])
+	case "diff-local":
+		if len(args) != 3 {
+			return fmt.Errorf("Usage: diff-local SRC DST")
+		}
+		return withPusher(ctx, "", func(ctx context.Context, p *push.Pusher) error {
+			return p.DiffLocal(args[1], args[2])
+		})
+	case "init":
+		return initCommand(ctx)
+	case "manifest":
+		if len(args) != 4 || args[1] != "diff" {
+			return fmt.Errorf("Usage: manifest diff A B")
+		}
+		return withPusher(ctx, "", func(ctx context.Context, p *push.Pusher) error {
+			return p.DiffManifests(ctx, args[2], args[3])
+		})
+	}
+
+	// The remaining commands work on the sync relationship given by the flags
+	statePath, err := syncTarget()
+	if err != nil {
+		return err
+	}
+	if *sourceArchive != "" && (args[0] == "pull" || args[0] == "bisync") {
+		return fmt.Errorf("%s writes into the local dir and can't be used with --source_archive", args[0])
+	}
+	// apply is set by the commands that only report what they would do unless given "apply"
+	apply := len(args) == 2 && args[1] == "apply"
+	switch args[0] {
+	case "state":
+		return stateCommand(ctx, args[1:], statePath)
+	case "skip":
+		return skipCommand(args[1:], statePath)
+	case "trash":
+		return withPusher(ctx, "", func(ctx context.Context, p *push.Pusher) error {
+			return p.Trash(ctx, args[1:])
+		})
+	case "snapshot":
+		return withPusher(ctx, statePath, func(ctx context.Context, p *push.Pusher) error {
+			return p.Snapshot(ctx)
+		})
+	case "verify":
+		restart := len(args) == 2 && args[1] == "restart"
+		if len(args) > 2 || (len(args) == 2 && !restart) {
+			return fmt.Errorf("Usage: verify [restart]")
+		}
+		// Stop cleanly on Ctrl-C so that the progress so far is saved
+		catchInterrupts(cancel)
+		return withPusher(ctx, statePath, func(ctx context.Context, p *push.Pusher) error {
+			return p.Verify(ctx, restart)
+		})
+	case "ls":
+		return withPusher(ctx, statePath, func(ctx context.Context, p *push.Pusher) error {
+			return p.Ls(ctx, args[1:])
+		})
+	case "pull":
+		return withPusher(ctx, statePath, func(ctx context.Context, p *push.Pusher) error {
+			return p.Pull(ctx)
+		})
+	case "bisync":
+		return withPusher(ctx, statePath, func(ctx context.Context, p *push.Pusher) error {
+			return p.Bisync(ctx)
+		})
+	case "repair":
+		if len(args) > 2 || (len(args) == 2 && !apply) {
+			return fmt.Errorf("Usage: repair [apply]")
+		}
+		return withPusher(ctx, statePath, func(ctx context.Context, p *push.Pusher) error {
+			return p.Repair(ctx, apply)
+		})
+	case "merge-folders":
+		if len(args) > 2 || (len(args) == 2 && !apply) {
+			return fmt.Errorf("Usage: merge-folders [apply]")
+		}
+		return withPusher(ctx, statePath, func(ctx context.Context, p *push.Pusher) error {
+			return p.MergeFolders(ctx, apply)
+		})
+	case "audit-perms":
+		return withPusher(ctx, "", func(ctx context.Context, p *push.Pusher) error {
+			return p.AuditPerms(ctx)
+		})
+	default:
+		return fmt.Errorf("Unknown command %q, see \"help\"", args[0])
+	}
+}
+
+// stateCommand implements "state export FILE" and "state import FILE", which move the sync state
+// between machines, and "state hashes md5|sha256 FILE", which writes the hashes of the local files
+// for other tools to check against.  FILE may be "-" for stdout/stdin.
+func stateCommand(ctx context.Context, args []string, statePath string) error {
+	if len(args) == 3 && args[0] == "hashes" {
+		var w io.Writer = os.Stdout
+		if args[2] != "-" {
+			f, err := os.Create(args[2])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return withPusher(ctx, statePath, func(ctx context.Context, p *push.Pusher) error {
+			n, err := p.WriteHashList(w, args[1])
+			if err != nil {
+				return err
+			}
+			// Hashes worked out along the way save the next push from doing it again
+			if err := p.SaveState(); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Listed the %s of %d file(s)\n", args[1], n)
+			return nil
+		})
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("Usage: state export|import FILE, or state hashes md5|sha256 FILE")
+	}
+	switch args[0] {
+	case "export":
+		st, err := state.Load(statePath, *gDriveRootID)
+		if err != nil {
+			return err
+		}
+		var w io.Writer = os.Stdout
+		if args[1] != "-" {
+			f, err := os.Create(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return st.Export(w)
+	case "import":
+		var r io.Reader = os.Stdin
+		if args[1] != "-" {
+			f, err := os.Open(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		st, err := state.Import(r, statePath)
+		if err != nil {
+			return fmt.Errorf("Problem reading export: %v", err)
+		}
+		if st.RootID != *gDriveRootID {
+			return fmt.Errorf("Export is for GDrive folder %q, not %q", st.RootID, *gDriveRootID)
+		}
+		if err := st.Save(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Imported %d hashes, %d snapshot entries and %d cached listings\n",
+			len(st.Hashes), len(st.Snapshot), len(st.Remote))
+		return nil
+	default:
+		return fmt.Errorf("Unknown state command %q", args[0])
+	}
+}
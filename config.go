@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configFileName is the file, in the default state dir, that holds flag defaults written by init
+// or by hand.
+const configFileName = "config.yaml"
+
+// commandLineFlags records which flags were given on the command line, as opposed to taken from
+// the config file.
+var commandLineFlags = make(map[string]bool)
+
+// configPath returns where the config file lives: --config if given, otherwise the one of the
+// --profile.  The default profile's file can also be kept in the XDG config dir,
+// ~/.config/gdrive-dir-push, which is used when the state dir holds none.
+func configPath() (string, error) {
+	if *configFile != "" {
+		return *configFile, nil
+	}
+	dir, err := profileDir(*profile)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, configFileName)
+	if *profile != "" {
+		return path, nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if xdg, err := os.UserConfigDir(); err == nil {
+			if alt := filepath.Join(xdg, "gdrive-dir-push", configFileName); fileExists(alt) {
+				return alt, nil
+			}
+		}
+	}
+	return path, nil
+}
+
+// fileExists reports whether there is a file at |path|.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// loadConfig applies the environment variables of flags, and then the flag values saved in the
+// config file, to every flag that wasn't given on the command line.  A missing file is not an
+// error, unless it was named by --config.
+func loadConfig() error {
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+	if err := loadEnv(); err != nil {
+		return err
+	}
+	if err := checkProfileName(*profile); err != nil {
+		return err
+	}
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if *configFile != "" && !fileExists(path) {
+		return fmt.Errorf("--config %q doesn't exist", path)
+	}
+	values, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		if commandLineFlags[v.name] || envFlags[v.name] {
+			continue
+		}
+		if err := flag.Set(v.name, v.value); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, v.name, err)
+		}
+	}
+	return nil
+}
+
+// configScalar parses a YAML scalar: a double quoted string, a single quoted one or a plain value,
+// which may be followed by a comment.
+func configScalar(text string) (string, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		return strconv.Unquote(text)
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return "", fmt.Errorf("unterminated quote")
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	}
+	if i := strings.Index(text, " #"); i >= 0 {
+		text = text[:i]
+	}
+	return strings.TrimSpace(text), nil
+}
+
+// configList splits the YAML flow sequence |text|, such as ["*.jpg", "*.png"], into its items.
+func configList(text string) ([]string, error) {
+	inner := strings.TrimSpace(text[1:])
+	if !strings.HasSuffix(inner, "]") {
+		return nil, fmt.Errorf("unterminated list")
+	}
+	inner = strings.TrimSpace(inner[:len(inner)-1])
+	if inner == "" {
+		return nil, nil
+	}
+	var items []string
+	var quote rune
+	start := 0
+	for i, c := range inner + "," {
+		switch {
+		case quote != 0:
+			if c == quote && (quote == '\'' || i == 0 || inner[i-1] != '\\') {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			item, err := configScalar(strings.TrimSpace(inner[start:i]))
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			start = i + 1
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	return items, nil
+}
+
+// readConfig returns the flag values saved in the config file |path|, a YAML file of
+// "flag_name: value" pairs.  Repeatable flags such as --include can be given a list, either as
+// ["a", "b"] or as "- a" lines below the flag name.  A missing file holds none.
+func readConfig(path string) ([]configValue, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var values []configValue
+	// list is the flag whose "- item" lines come next, if any
+	list := ""
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "- ") || text == "-" {
+			if list == "" {
+				return nil, fmt.Errorf("%s:%d: list item without a flag name", path, line)
+			}
+			value, err := configScalar(strings.TrimSpace(strings.TrimPrefix(text, "-")))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: bad value: %v", path, line, err)
+			}
+			values = append(values, configValue{list, value})
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected \"flag_name: value\"", path, line)
+		}
+		name, value := strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:])
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown flag %q", path, line, name)
+		}
+		list = ""
+		switch {
+		case value == "" || strings.HasPrefix(value, "#"):
+			list = name
+		case strings.HasPrefix(value, "["):
+			items, err := configList(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: bad list: %v", path, line, err)
+			}
+			for _, item := range items {
+				values = append(values, configValue{name, item})
+			}
+		default:
+			if value, err = configScalar(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: bad value: %v", path, line, err)
+			}
+			values = append(values, configValue{name, value})
+		}
+	}
+	return values, scanner.Err()
+}
+
+// configValue is one flag setting to be saved in the config file.
+type configValue struct {
+	name, value string
+}
+
+// saveConfig writes |values| to the config file, replacing whatever was there.
+func saveConfig(values []configValue) (string, error) {
+	path, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(f, "# Written by gdrive-dir-push init.  Flags given on the command line take precedence.\n")
+	for _, v := range values {
+		fmt.Fprintf(f, "%s: %s\n", v.name, strconv.Quote(v.value))
+	}
+	return path, f.Close()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/hatchling/gdrive-dir-push/oauth"
+	"github.com/hatchling/gdrive-dir-push/push"
+)
+
+// Environment variables that supply OAuth client credentials when the corresponding flags aren't
+// given, like flagEnv does for every flag.
+const (
+	clientIDEnv        = "GDRIVE_PUSH_CLIENT_ID"
+	clientSecretEnv    = "GDRIVE_PUSH_CLIENT_SECRET"
+	credentialsFileEnv = "GDRIVE_PUSH_CREDENTIALS_FILE"
+	serviceAccountEnv  = "GDRIVE_PUSH_SERVICE_ACCOUNT_FILE"
+)
+
+// driveScope is the OAuth scope needed to read and write the user's Drive.
+const driveScope = "https://www.googleapis.com/auth/drive"
+
+// driveFileScope only reaches the files and folders this tool created, it is the broadest Drive
+// scope Google allows for the device flow of --device_auth.
+const driveFileScope = "https://www.googleapis.com/auth/drive.file"
+
+// userScope returns the scope to ask the user to authorize.
+func userScope() string {
+	if *deviceAuth {
+		return driveFileScope
+	}
+	return driveScope
+}
+
+// authClient returns the HTTP client for Drive requests.  It is authenticated as the
+// --service_account_file service account, for unattended runs, when one is given and as the user
+// who authorized the OAuth client otherwise.
+func authClient(ctx context.Context) (*http.Client, error) {
+	if *serviceAccountFile != "" {
+		return oauth.ServiceAccountClient(ctx, *serviceAccountFile, *impersonate, driveScope)
+	}
+	if *impersonate != "" {
+		return nil, fmt.Errorf("--impersonate needs --service_account_file")
+	}
+	config, err := oauthConfig()
+	if err != nil {
+		return nil, err
+	}
+	return oauth.GetClient(ctx, config), nil
+}
+
+// oauthConfig returns the OAuth client configuration, taken from --credentials_file when one is
+// given and from --client_id and --secret otherwise.
+func oauthConfig() (*oauth2.Config, error) {
+	if *credentialsFile != "" {
+		return oauth.ConfigFromFile(*credentialsFile, userScope())
+	}
+	id, secret := *clientID, *clientSecret
+	if id == "" || secret == "" {
+		return nil, fmt.Errorf("No OAuth client configured: run \"gdrive-dir-push init\", or give --credentials_file or --client_id and --secret")
+	}
+	return &oauth2.Config{
+		ClientID:     id,
+		ClientSecret: secret,
+		Endpoint:     google.Endpoint,
+		Scopes:       []string{userScope()},
+	}, nil
+}
+
+// authCommand implements "auth", which authorizes access to Drive if there is no usable token yet,
+// through the browser or --device_auth, and shows which account requests are made as.
+func authCommand(ctx context.Context) error {
+	p := push.New(nil, nil, push.Options{Connect: driveClient, Output: statusWriter{}})
+	user, err := p.User(ctx)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		fmt.Printf("Authorized\n")
+		return nil
+	}
+	fmt.Printf("Authorized as %s (%s)\n", user.DisplayName, user.EmailAddress)
+	return nil
+}
@@ -1,72 +1,265 @@
-// This is borrowed heavily from github.com/marcinwyszynski/directory_tree
-//
-// Some minor edits were needed to add the Gdrive ID field for our specialized use-case.
-package directory_tree
-
-import (
-	"os"
-	"path/filepath"
-	"time"
-)
-
-// FileInfo is a struct created from os.FileInfo interface for serialization.
-type FileInfo struct {
-	Name    string      `json:"name"`
-	Size    int64       `json:"size"`
-	Mode    os.FileMode `json:"mode"`
-	ModTime time.Time   `json:"mod_time"`
-	IsDir   bool        `json:"is_dir"`
-}
-
-// Helper function to create a local FileInfo struct from os.FileInfo interface.
-func fileInfoFromInterface(v os.FileInfo) *FileInfo {
-	return &FileInfo{
-		Name:    v.Name(),
-		Size:    v.Size(),
-		Mode:    v.Mode(),
-		ModTime: v.ModTime(),
-		IsDir:   v.IsDir()}
-}
-
-// Node represents a node in a directory tree.
-type Node struct {
-	FullPath string    `json:"path"`
-	Info     *FileInfo `json:"info"`
-	Children []*Node   `json:"children"`
-	Parent   *Node     `json:"-"`
-	DriveID  string
-}
-
-// Create directory hierarchy.
-func NewTree(root string) (result *Node, err error) {
-	absRoot, err := filepath.Abs(root)
-	if err != nil {
-		return
-	}
-	parents := make(map[string]*Node)
-	walkFunc := func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		parents[path] = &Node{
-			FullPath: path,
-			Info:     fileInfoFromInterface(info),
-			Children: make([]*Node, 0),
-		}
-		return nil
-	}
-	if err = filepath.Walk(absRoot, walkFunc); err != nil {
-		return
-	}
-	for path, node := range parents {
-		parentPath := filepath.Dir(path)
-		parent, exists := parents[parentPath]
-		if !exists { // If a parent does not exist, this is the root.
-			result = node
-		} else {
-			node.Parent = parent
-			parent.Children = append(parent.Children, node)
-		}
-	}
-	return
-}
+// This is borrowed heavily from github.com/marcinwyszynski/directory_tree
+//
+// Some minor edits were needed to add the Gdrive ID field for our specialized use-case.
+package directory_tree
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileInfo is a struct created from os.FileInfo interface for serialization.
+type FileInfo struct {
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	IsDir   bool        `json:"is_dir"`
+}
+
+// Helper function to create a local FileInfo struct from os.FileInfo interface.
+func fileInfoFromInterface(v os.FileInfo) *FileInfo {
+	return &FileInfo{
+		Name:    v.Name(),
+		Size:    v.Size(),
+		Mode:    v.Mode(),
+		ModTime: v.ModTime(),
+		IsDir:   v.IsDir()}
+}
+
+// Node represents a node in a directory tree.
+type Node struct {
+	FullPath string    `json:"path"`
+	Info     *FileInfo `json:"info"`
+	Children []*Node   `json:"children"`
+	Parent   *Node     `json:"-"`
+	DriveID  string
+	// Title, if set, is the name to give the node in Gdrive instead of Info.Name.
+	Title string
+	// Filtered holds the names of the entries of a directory that the filter left out, other than
+	// those Filter.Only did.
+	Filtered []string
+
+	// fsys and name locate the node's contents; nodes built by hand are read from FullPath.
+	fsys fs.FS
+	name string
+}
+
+// Open opens the file the node was created from for reading.
+func (n *Node) Open() (fs.File, error) {
+	if n.fsys == nil {
+		return os.Open(n.FullPath)
+	}
+	return n.fsys.Open(n.name)
+}
+
+// Stat returns the current FileInfo of the file the node was created from.
+func (n *Node) Stat() (fs.FileInfo, error) {
+	if n.fsys == nil {
+		return os.Stat(n.FullPath)
+	}
+	return fs.Stat(n.fsys, n.name)
+}
+
+// Create directory hierarchy.
+func NewTree(root string) (*Node, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(absRoot)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return NewTreeFS(os.DirFS(absRoot), ".", absRoot, nil)
+	}
+	dir := filepath.Dir(absRoot)
+	return NewTreeFS(os.DirFS(dir), filepath.Base(absRoot), dir, nil)
+}
+
+// Filter selects what a tree is built from.  Patterns are path.Match globs: one without a slash
+// matches names at any depth, one with a slash matches paths from the root of the tree, and a
+// trailing slash restricts a pattern to directories.
+type Filter struct {
+	// Include, if not empty, limits the tree to the files matching a pattern and the directories
+	// leading to them.  Everything below a matching directory is included.
+	Include []string
+	// Exclude leaves out matching files and directories.  Excluded directories aren't walked.
+	Exclude []string
+	// IgnoreFile, if set, names gitignore-style files that leave out what they match in their
+	// directory and below.
+	IgnoreFile string
+	// Only, if not empty, limits the tree to these paths from the root, everything below them and
+	// the directories leading to them.  Nothing else is walked, only the directories on the way are
+	// listed.
+	Only []string
+}
+
+// onPath reports whether the item |rel|, a path from the root, is one of |only|, below one of
+// them, or a directory leading to one.
+func onPath(only []string, rel string) bool {
+	for _, p := range only {
+		if rel == p || strings.HasPrefix(rel, p+"/") || strings.HasPrefix(p, rel+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether any of |patterns| matches the item at |rel|, a path from the root.
+func matches(patterns []string, rel string, isDir bool) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/") {
+			if !isDir {
+				continue
+			}
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(rel)
+		}
+		if ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// prune removes the directories below |node| that hold nothing and weren't included themselves.
+func prune(node *Node, included map[*Node]bool) {
+	children := node.Children[:0]
+	for _, child := range node.Children {
+		if child.Info.IsDir {
+			prune(child, included)
+			if len(child.Children) == 0 && !included[child] {
+				node.Filtered = append(node.Filtered, child.Info.Name)
+				continue
+			}
+		}
+		children = append(children, child)
+	}
+	node.Children = children
+}
+
+// NewTreeFS creates the directory hierarchy below |root| in |fsys|, which may be a local directory,
+// an archive or an in-memory file system, leaving out what |filter| doesn't select if it isn't nil.
+// The FullPath of each node is its path in |fsys| joined onto |base|, so that nodes read the same
+// whatever they were loaded from.
+func NewTreeFS(fsys fs.FS, root, base string, filter *Filter) (result *Node, err error) {
+	parents := make(map[string]*Node)
+	// included holds the directories whose whole contents --include selected
+	included := make(map[string]bool)
+	// ignores holds the ignore file rules that apply in each directory
+	ignores := make(map[string][]ignoreRule)
+	// filtered holds the names the filter left out of each directory
+	filtered := make(map[string][]string)
+	leaveOut := func(name string, d fs.DirEntry) error {
+		filtered[path.Dir(name)] = append(filtered[path.Dir(name)], d.Name())
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	}
+	walkFunc := func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filter != nil && len(filter.Only) > 0 && name != root {
+			rel := name
+			if root != "." {
+				rel = strings.TrimPrefix(name, root+"/")
+			}
+			if !onPath(filter.Only, rel) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+		}
+		if filter != nil && filter.IgnoreFile != "" {
+			var rules []ignoreRule
+			if name != root {
+				rules = ignores[path.Dir(name)]
+				if ignored(rules, name, d.IsDir()) {
+					return leaveOut(name, d)
+				}
+			}
+			if d.IsDir() {
+				own, err := readIgnoreFile(fsys, path.Join(name, filter.IgnoreFile))
+				if err != nil {
+					return err
+				}
+				if len(own) > 0 {
+					rules = append(append([]ignoreRule{}, rules...), own...)
+				}
+				ignores[name] = rules
+			}
+		}
+		if filter != nil && name != root {
+			rel := name
+			if root != "." {
+				rel = strings.TrimPrefix(name, root+"/")
+			}
+			if matches(filter.Exclude, rel, d.IsDir()) {
+				return leaveOut(name, d)
+			}
+			if len(filter.Include) > 0 {
+				if included[path.Dir(name)] || matches(filter.Include, rel, d.IsDir()) {
+					if d.IsDir() {
+						included[name] = true
+					}
+				} else if !d.IsDir() {
+					return leaveOut(name, d)
+				}
+			}
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fi := fileInfoFromInterface(info)
+		if name == "." { // Name the root of |fsys| after |base|, as a local directory would be.
+			fi.Name = filepath.Base(base)
+		}
+		parents[name] = &Node{
+			FullPath: filepath.Join(base, filepath.FromSlash(name)),
+			Info:     fi,
+			Children: make([]*Node, 0),
+			fsys:     fsys,
+			name:     name,
+		}
+		return nil
+	}
+	if err = fs.WalkDir(fsys, root, walkFunc); err != nil {
+		return
+	}
+	for name, node := range parents {
+		if name == root { // The walk starts at the root, which has no parent.
+			result = node
+			continue
+		}
+		parent := parents[path.Dir(name)]
+		node.Parent = parent
+		parent.Children = append(parent.Children, node)
+	}
+	for name, names := range filtered {
+		if node, ok := parents[name]; ok {
+			node.Filtered = names
+		}
+	}
+	if filter != nil && len(filter.Include) > 0 && result != nil {
+		// Directories were walked in case they held included files, drop those that didn't
+		includedNodes := make(map[*Node]bool, len(included))
+		for name := range included {
+			includedNodes[parents[name]] = true
+		}
+		prune(result, includedNodes)
+	}
+	return
+}
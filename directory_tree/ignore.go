@@ -0,0 +1,116 @@
+package directory_tree
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ignoreRule is one pattern of a gitignore-style file.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	// dir is where the file holding the rule is, as a path in the tree's file system.
+	dir string
+}
+
+// globToRegexp translates the gitignore glob |glob| into a regular expression.  "**" matches across
+// directories while "*" and "?" stay within one.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			if end := strings.IndexByte(glob[i:], ']'); end > 1 {
+				class := glob[i+1 : i+end]
+				if class[0] == '!' {
+					class = "^" + class[1:]
+				}
+				b.WriteString("[" + class + "]")
+				i += end
+				continue
+			}
+			b.WriteString(regexp.QuoteMeta("["))
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// readIgnoreFile parses the ignore file |name| in |fsys|, if there is one, into rules that apply
+// below its directory.
+func readIgnoreFile(fsys fs.FS, name string) ([]ignoreRule, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{dir: path.Dir(name)}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		// Patterns with a slash are relative to the file's directory, others match at any depth
+		expr := globToRegexp(strings.TrimPrefix(line, "/"))
+		if !strings.Contains(line, "/") {
+			expr = "(.*/)?" + expr
+		}
+		if rule.re, err = regexp.Compile("^" + expr + "$"); err != nil {
+			continue // Like git, skip what can't be parsed
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// ignored reports whether |rules| leave out the item |name|, a path in the tree's file system.
+// The last rule that matches decides, so "!" rules can bring back what earlier ones left out.
+func ignored(rules []ignoreRule, name string, isDir bool) bool {
+	var ignore bool
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rel := name
+		if rule.dir != "." {
+			rel = strings.TrimPrefix(name, rule.dir+"/")
+		}
+		if rule.re.MatchString(rel) {
+			ignore = !rule.negate
+		}
+	}
+	return ignore
+}
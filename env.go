@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/hatchling/gdrive-dir-push/push"
+)
+
+// envPrefix starts the names of the environment variables that set flags, which keeps settings,
+// and secrets in particular, off the command line in containers, systemd units and CI.
+const envPrefix = "GDRIVE_PUSH_"
+
+// envAliases are the environment variables of flags whose names would make for clumsy ones.
+var envAliases = map[string]string{
+	"gdrive_root_id":    envPrefix + "ROOT_ID",
+	"local_dir_to_push": push.SnapshotLocalDirEnv,
+	"secret":            clientSecretEnv,
+}
+
+// envFlags records which flags were taken from the environment.
+var envFlags = make(map[string]bool)
+
+// flagEnv returns the environment variable that sets the flag |name|, e.g. GDRIVE_PUSH_DRY_RUN
+// for --dry_run.
+func flagEnv(name string) string {
+	if env, ok := envAliases[name]; ok {
+		return env
+	}
+	return envPrefix + strings.ToUpper(name)
+}
+
+// loadEnv applies the environment variables that are set to every flag that wasn't given on the
+// command line.  Empty variables are ignored.
+func loadEnv() error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value := os.Getenv(flagEnv(f.Name))
+		if err != nil || commandLineFlags[f.Name] || value == "" {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("$%s: %v", flagEnv(f.Name), setErr)
+			return
+		}
+		envFlags[f.Name] = true
+	})
+	return err
+}
+
+// printEnvHelp explains to |out| how flags are set from the environment.
+func printEnvHelp(out io.Writer) {
+	fmt.Fprintf(out, "\nEvery flag can also be set with an environment variable named after it, like $%s for --dry_run, "+
+		"except for --gdrive_root_id ($%s), --local_dir_to_push ($%s) and --secret ($%s).  "+
+		"The command line takes precedence over the environment, which takes precedence over the config file.\n",
+		flagEnv("dry_run"), flagEnv("gdrive_root_id"), flagEnv("local_dir_to_push"), flagEnv("secret"))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+	"github.com/hatchling/gdrive-dir-push/push"
+)
+
+const (
+	outputText   = "text"
+	outputNDJSON = "ndjson"
+)
+
+var output = flag.String("output", outputText, "How a push reports what it does: \"text\" for status lines, or \"ndjson\" for one JSON object per event (scan, create_folder, upload_start, upload_done, relocate, error and summary) on stdout, with the status lines moved to stderr")
+
+// event is one line of --output=ndjson.  Fields that don't apply are left out, as are sizes of 0.
+type event struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// Path is that of the item from --local_dir_to_push, with forward slashes and bytes that
+	// aren't valid UTF-8 escaped as %XX.
+	Path     string `json:"path,omitempty"`
+	ID       string `json:"id,omitempty"`
+	ParentID string `json:"parent_id,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	// Duration is in seconds.
+	Duration  float64 `json:"duration,omitempty"`
+	Replace   bool    `json:"replace,omitempty"`
+	Files     int     `json:"files,omitempty"`
+	Folders   int     `json:"folders,omitempty"`
+	Replaced  int     `json:"replaced,omitempty"`
+	Unchanged int     `json:"unchanged,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	DryRun    bool    `json:"dry_run,omitempty"`
+}
+
+// eventStream writes the events of --output=ndjson, it is a push.Listener.
+type eventStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	// started is when work on the operations in progress began, by path.
+	started map[string]time.Time
+}
+
+// events is the stream of --output=ndjson, nil for --output=text.
+var events *eventStream
+
+func newEventStream(w io.Writer) *eventStream {
+	return &eventStream{enc: json.NewEncoder(w), started: make(map[string]time.Time)}
+}
+
+// setupOutput checks --output and, for ndjson, gives stdout over to the events: everything else
+// printed there goes to stderr instead.
+func setupOutput() error {
+	switch *output {
+	case outputText:
+	case outputNDJSON:
+		events = newEventStream(os.Stdout)
+		os.Stdout = os.Stderr
+	default:
+		return fmt.Errorf("--output must be %q or %q", outputText, outputNDJSON)
+	}
+	return nil
+}
+
+// emit writes |e|, it does nothing on a nil stream.
+func (s *eventStream) emit(e *event) {
+	if s == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	e.DryRun = *dryRun
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(e); err != nil {
+		log.Printf("Problem writing --output event: %v", err)
+	}
+}
+
+// since returns the seconds since work on |op| started, forgetting about it.
+func (s *eventStream) since(op push.Op) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start, ok := s.started[op.Path]
+	if !ok {
+		return 0
+	}
+	delete(s.started, op.Path)
+	return time.Since(start).Seconds()
+}
+
+func (s *eventStream) OnFileQueued(push.Op)          {}
+func (s *eventStream) OnFileProgress(push.Op, int64) {}
+
+func (s *eventStream) OnFileStart(op push.Op) {
+	s.mu.Lock()
+	s.started[op.Path] = time.Now()
+	s.mu.Unlock()
+	if op.Kind != push.CreateFolder {
+		s.emit(&event{Event: "upload_start", Path: op.Path, Size: op.Size, Replace: op.Kind == push.Replace})
+	}
+}
+
+func (s *eventStream) OnFileDone(op push.Op) {
+	if op.Kind == push.Relocate {
+		s.emit(&event{Event: "relocate", Path: op.Path, ID: op.ID, ParentID: op.Parent, Size: op.Size})
+		return
+	}
+	e := &event{Event: "upload_done", Path: op.Path, ID: op.ID, Size: op.Size, Duration: s.since(op), Replace: op.Kind == push.Replace}
+	if op.Kind == push.CreateFolder {
+		e.Event, e.Replace = "create_folder", false
+	}
+	s.emit(e)
+}
+
+func (s *eventStream) OnError(op push.Op, err error) {
+	s.emit(&event{Event: "error", Path: op.Path, Size: op.Size, Duration: s.since(op), Error: err.Error()})
+}
+
+func (s *eventStream) OnSummary(sum push.Summary) {
+	e := &event{
+		Event:     "summary",
+		Files:     sum.FilesUploaded,
+		Folders:   sum.FoldersCreated,
+		Replaced:  sum.FilesReplaced,
+		Unchanged: sum.FilesUnchanged,
+		Size:      sum.BytesUploaded,
+		Duration:  sum.Duration.Seconds(),
+	}
+	if sum.Err != nil {
+		e.Error = sum.Err.Error()
+	}
+	s.emit(e)
+}
+
+func (s *eventStream) OnScan(tree *directory_tree.Node, took time.Duration) {
+	e := &event{Event: "scan", Path: *localDirToPush, Duration: took.Seconds()}
+	var count func(node *directory_tree.Node)
+	count = func(node *directory_tree.Node) {
+		for _, child := range node.Children {
+			if child.Info.IsDir {
+				e.Folders++
+				count(child)
+			} else {
+				e.Files++
+				e.Size += child.Info.Size
+			}
+		}
+	}
+	count(tree)
+	s.emit(e)
+}
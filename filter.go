@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// globList collects a repeatable flag of glob patterns.
+type globList []string
+
+var (
+	includes globList
+	excludes globList
+)
+
+func init() {
+	flag.Var(&includes, "include", "Only push files matching this glob, e.g. \"*.jpg\", and the folders leading to them (repeatable)")
+	flag.Var(&excludes, "exclude", "Leave out files and folders matching this glob, e.g. \"node_modules/\" (repeatable)")
+}
+
+func (g *globList) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *globList) Set(value string) error {
+	if _, err := path.Match(strings.Trim(value, "/"), ""); err != nil {
+		return fmt.Errorf("Invalid glob %q: %v", value, err)
+	}
+	*g = append(*g, value)
+	return nil
+}
+
+// treeFilter returns the filter --include, --exclude and --ignore_file describe, nil when none is
+// given.  Patterns without a slash match names at any depth, "dir/" only matches directories and
+// "a/b/*.txt" matches paths from --local_dir_to_push.
+func treeFilter() *directory_tree.Filter {
+	if len(includes) == 0 && len(excludes) == 0 && *ignoreFile == "" {
+		return nil
+	}
+	return &directory_tree.Filter{Include: includes, Exclude: excludes, IgnoreFile: *ignoreFile}
+}
@@ -1,339 +1,524 @@
-package main
-
-import (
-	"flag"
-	"fmt"
-	"log"
-	"mime"
-	"os"
-	"path/filepath"
-	"time"
-
-	humanize "github.com/dustin/go-humanize"
-	"golang.org/x/net/context"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	drive "google.golang.org/api/drive/v2"
-
-	"github.com/hatchling/gdrive-dir-push/directory_tree"
-	"github.com/hatchling/gdrive-dir-push/oauth"
-	"github.com/hatchling/try"
-)
-
-func init() {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
-	log.SetOutput(os.Stdout)
-	try.MaxRetries = 3
-}
-
-const (
-	defaultClientId string = "902751591868-ghc6jn2vquj6s8n5v5np2i66h3dh5pqq.apps.googleusercontent.com"
-	defaultSecret   string = "LLsUuv2NoLglNKx14t5dA9SC"
-)
-
-var (
-	gDriveRootID   = flag.String("gdrive_root_id", "", "The ID of the Gdrive root folder to push to")
-	localDirToPush = flag.String("local_dir_to_push", "", "Path to the local dir to push")
-	oldFilesDir    = flag.String("old_files_dir", "", "The directory to move files that would otherwise be overwritten")
-	maxOps         = flag.Int("max_gdrive_ops", 20, "Paranoia failsafe: the max number of Gdrive write ops this program will execute per run")
-	verbose        = flag.Bool("verbose", false, "Whether to log verbosely to stdout")
-
-	clientID     = flag.String("client_id", defaultClientId, "OAuth Client ID")
-	clientSecret = flag.String("secret", defaultSecret, "OAuth Client Secret")
-)
-
-const folderMimeType = "application/vnd.google-apps.folder"
-
-var opsExecuted int
-
-// tallyOp keeps track of how many Gdrive write ops have been executed so far and kills the process
-// if that number goes over the --max_gdrive_ops threshold.
-func tallyOp() {
-	opsExecuted++
-	if opsExecuted > *maxOps {
-		log.Fatalf("Oops, --max_gdrive_ops reached (%d) exiting", opsExecuted)
-	}
-}
-
-type pusher struct {
-	drv *drive.Service
-}
-
-// listFolder returns all files and folders directly under the GDrive parent folder |parentID|.  An
-// error is returned if the operation fails.
-func (p *pusher) listFolder(parentID string) ([]*drive.File, error) {
-	if *verbose {
-		fmt.Printf("listFolder(%s)\n", parentID)
-	}
-	query := fmt.Sprintf("'%s' in parents and trashed=false", parentID)
-	call := p.drv.Files.List().Q(query)
-	files := []*drive.File{}
-	pageToken := ""
-	for {
-		if pageToken != "" {
-			call.PageToken(pageToken)
-		}
-
-		// Wrap in a simple retry loop since Drive can be unreliable.
-		var r *drive.FileList
-		if err := try.Do(func(attempt int) (bool, error) {
-			var err error
-			r, err = call.Do()
-			if err != nil {
-				log.Print(err)
-				time.Sleep(time.Second)
-			}
-			return attempt < try.MaxRetries, err
-		}); err != nil {
-			return nil, fmt.Errorf("Unable to list files: %v", err)
-		}
-
-		files = append(files, r.Items...)
-		pageToken = r.NextPageToken
-		if pageToken == "" {
-			break
-		}
-	}
-	return files, nil
-}
-
-// createFolder creates a new GDrive folder with |title| under the GDrive parent folder
-// |parentID|.  It returns the ID of the created folder or an error if the operation fails.
-func (p *pusher) createFolder(title, parentID string) (string, error) {
-	tallyOp()
-	if *verbose {
-		fmt.Printf("createFolder(%s, %s)\n", title, parentID)
-	}
-	newFolder := &drive.File{
-		Title:    title,
-		MimeType: folderMimeType,
-		Parents: []*drive.ParentReference{
-			&drive.ParentReference{Id: parentID},
-		},
-	}
-
-	// Wrap in a simple retry loop since Drive can be unreliable.
-	var r *drive.File
-	if err := try.Do(func(attempt int) (bool, error) {
-		var err error
-		r, err = p.drv.Files.Insert(newFolder).Do()
-		if err != nil {
-			log.Print(err)
-			time.Sleep(time.Second)
-		}
-		return attempt < try.MaxRetries, err
-	}); err != nil {
-		return "", fmt.Errorf("Problem creating new GDrive folder: %v", err)
-	}
-	return r.Id, nil
-}
-
-// relocateFile moves |fileID| from the |oldParentID| folder to the --old_files_dir folder.  It
-// returns an error if the operation fails.
-func (p *pusher) relocateFile(fileID, oldParentID string) error {
-	tallyOp()
-	if *verbose {
-		fmt.Printf("relocateFile(%s, %s)\n", fileID, oldParentID)
-	}
-	parentRef := &drive.ParentReference{Id: *oldFilesDir}
-
-	// Wrap in a simple retry loop since Drive can be unreliable.
-	if err := try.Do(func(attempt int) (bool, error) {
-		_, err := p.drv.Parents.Insert(fileID, parentRef).Do()
-		if err != nil {
-			log.Print(err)
-			time.Sleep(time.Second)
-		}
-		return attempt < try.MaxRetries, err
-	}); err != nil {
-		return fmt.Errorf("An Insert() error occurred: %v", err)
-	}
-
-	// Wrap in a simple retry loop since Drive can be unreliable.
-	if err := try.Do(func(attempt int) (bool, error) {
-		err := p.drv.Parents.Delete(fileID, oldParentID).Do()
-		if err != nil {
-			log.Print(err)
-			time.Sleep(time.Second)
-		}
-		return attempt < try.MaxRetries, err
-	}); err != nil {
-		return fmt.Errorf("A Delete() error occurred: %v", err)
-	}
-
-	return nil
-}
-
-// createFile uploads |localfile| to the GDrive folder |parentID|.  It retries until |ctx| is
-// cancelled.  It returns the ID of the created file or an error if the operation fails.
-func (p *pusher) createFile(ctx context.Context, localFile *directory_tree.Node, parentID string) (string, error) {
-	tallyOp()
-	if *verbose {
-		fmt.Printf("createFile(%v, %s)", localFile, parentID)
-	}
-	title := filepath.Base(localFile.FullPath)
-	mimeType := mime.TypeByExtension(filepath.Ext(title))
-
-	// File instance
-	f := &drive.File{
-		Title:    title,
-		MimeType: mimeType,
-		Parents: []*drive.ParentReference{
-			&drive.ParentReference{Id: parentID},
-		},
-	}
-
-	// TODO print info about the transfer
-
-	// Wrap in a simple retry loop since Drive can be unreliable.
-	var r *drive.File
-	if err := try.Do(func(attempt int) (bool, error) {
-		var err error
-
-		file, err := os.Open(localFile.FullPath)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer file.Close()
-
-		r, err = p.drv.Files.Insert(f).Media(file).Do()
-		if err != nil {
-			log.Print(err)
-			time.Sleep(time.Second)
-		}
-		return attempt < try.MaxRetries, err
-	}); err != nil {
-		return "", fmt.Errorf("An error occurred uploading the file: %v\n", err)
-	}
-	return r.Id, nil
-}
-
-// processNode recursively makes write operations to sync the local file structure described by
-// |node| with GDrive.  It will retry until |ctx| is cancelled. It returns an error is any operation
-// fails.
-func (p *pusher) processNode(ctx context.Context, node *directory_tree.Node) error {
-	if *verbose {
-		fmt.Printf("processNode(ctx, %v)", node)
-	}
-	remoteItems, err := p.listFolder(node.DriveID)
-	if err != nil {
-		return fmt.Errorf("Problem listing GDrive folder: %v", err)
-	}
-	// TODO: Handle case where remote type != local type
-	for _, localItem := range node.Children {
-		var found bool
-		relName, err := filepath.Rel(*localDirToPush, localItem.FullPath)
-		if err != nil {
-			log.Fatalf("Could not determine relative path: %v", err)
-		}
-		for _, remoteItem := range remoteItems {
-			if remoteItem.Title == localItem.Info.Name {
-				localItem.DriveID = remoteItem.Id
-				found = true
-				break
-			}
-		}
-		statusPrefix := " "
-		if localItem.Info.IsDir {
-			// Handle folders
-			if !found {
-				statusPrefix = "+"
-				// No GDrive folder exists, create it under the current parent
-				newID, err := p.createFolder(localItem.Info.Name, node.DriveID)
-				if err != nil {
-					return fmt.Errorf("Problem creating GDrive folder %q: %v", relName, err)
-				}
-				localItem.DriveID = newID
-			}
-			fmt.Printf("%s /%s/\n", statusPrefix, relName)
-		} else {
-			// Handle files
-			statusPrefix = "+"
-			if found {
-				statusPrefix = "M"
-				if err := p.relocateFile(localItem.DriveID, node.DriveID); err != nil {
-					return fmt.Errorf("Problem relocating GDrive file %q: %v", relName, err)
-				}
-			}
-			newID, err := p.createFile(ctx, localItem, node.DriveID)
-			if err != nil {
-				return fmt.Errorf("Problem creating Gdrive file %q: %v", relName, err)
-			}
-			localItem.DriveID = newID
-			fmt.Printf("%s /%s (%s)\n", statusPrefix, relName, humanize.Bytes(uint64(localItem.Info.Size)))
-		}
-		if localItem.Info.IsDir {
-			// Recursively handle directories (but print status first)
-			if err := p.processNode(ctx, localItem); err != nil {
-				return err
-			}
-		}
-	}
-	return nil
-}
-
-// driveClient prepares a Drive client to use for GDrive operations.
-func driveClient(ctx context.Context) (*drive.Service, error) {
-	config := &oauth2.Config{
-		ClientID:     *clientID,
-		ClientSecret: *clientSecret,
-		Endpoint:     google.Endpoint,
-		RedirectURL:  "urn:ietf:wg:oauth:2.0:oob",
-		Scopes:       []string{"https://www.googleapis.com/auth/drive"},
-	}
-	client := oauth.GetClient(ctx, config)
-
-	drv, err := drive.New(client)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to retrieve drive Client %v", err)
-	}
-	return drv, nil
-}
-
-func main() {
-	flag.Parse()
-
-	if *gDriveRootID == "" {
-		log.Fatalf("--gdrive_root_id must be provided")
-	}
-	if *localDirToPush == "" {
-		log.Fatalf("--local_dir_to_push must be provided")
-	}
-	if *oldFilesDir == "" {
-		log.Fatalf("--old_files_dir must be provided")
-	}
-
-	absPath, err := filepath.Abs(*localDirToPush)
-	if err != nil {
-		log.Fatalf("Could not determine absolute path: %v", err)
-	}
-	*localDirToPush = absPath
-
-	start := time.Now()
-	fmt.Printf("Pushing contents of %q to GDrive folder %q\n\n", *localDirToPush, *gDriveRootID)
-	fmt.Printf("%v\n", start)
-
-	ctx := context.Background()
-
-	drv, err := driveClient(ctx)
-	if err != nil {
-		log.Fatalf("Problem creating Drive client: %v", err)
-	}
-
-	pusher := pusher{
-		drv: drv,
-	}
-
-	tree, err := directory_tree.NewTree(*localDirToPush)
-	if err != nil {
-		log.Fatalf("Problem creating directory_tree: %v", err)
-	}
-
-	// Fill in the root node with the provided ID
-	tree.DriveID = *gDriveRootID
-	if err := pusher.processNode(ctx, tree); err != nil {
-		log.Fatalf("Problem syncing dir: %v", err)
-	}
-
-	fmt.Printf("Took %v\n", time.Since(start))
-}
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+	"google.golang.org/api/googleapi"
+
+	"github.com/hatchling/gdrive-dir-push/oauth"
+	"github.com/hatchling/gdrive-dir-push/push"
+	"github.com/hatchling/gdrive-dir-push/state"
+	"github.com/hatchling/try"
+)
+
+func init() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+	log.SetOutput(os.Stdout)
+	try.MaxRetries = 3
+}
+
+var (
+	gDriveRootID   = flag.String("gdrive_root_id", "", "The ID of the Gdrive root folder to push to, or \"root\" for the top level of My Drive")
+	localDirToPush = flag.String("local_dir_to_push", "", "Path to the local dir to push")
+	sourceArchive  = flag.String("source_archive", "", "Push the contents of this .zip, .tar or .tar.gz file, as laid out inside it, instead of --local_dir_to_push")
+	oldFilesDir    = flag.String("old_files_dir", "", "The directory to move files that would otherwise be overwritten")
+	maxOps         = flag.Int("max_gdrive_ops", 20, "Paranoia failsafe: the max number of Gdrive write ops this program will execute per run")
+	verbose        = flag.Bool("verbose", false, "Log every Drive call, same as --log_level=debug")
+	stateDB        = flag.Bool("state_db", false, "Keep the sync snapshot and hash cache in a database next to the state file, which loads faster and saves only what changed, for trees of very many files")
+	stateDir       = flag.String("state_dir", "", "Where to keep sync state between runs (default ~/.gdrive-dir-push)")
+	chunkSize      = flag.String("chunk_size", "16MiB", "Size of the chunks larger files are sent in, a multiple of 256KiB: smaller chunks lose less to a dropped connection, larger ones are faster on a good link")
+	multipartLimit = flag.Int64("multipart_limit", 5<<20, "Files up to this many bytes are uploaded in a single multipart request instead of a resumable session")
+	matchBy        = flag.String("match_by", "name", "How local items are matched to GDrive items: \"name\" or \"origin\" (the local path they were pushed from, falling back to name)")
+	folderColor    = flag.String("folder_color", "", "If set, the #rrggbb color given to GDrive folders this tool creates")
+	starRoot       = flag.Bool("star_root", false, "Star the --gdrive_root_id folder after a successful push")
+	readAhead      = flag.Int("read_ahead", 4, "How many 1MB buffers to read ahead of each resumable upload")
+	sidecar        = flag.Bool("sidecar", false, "Upload a NAME"+push.SidecarSuffix+" file with the full local metadata next to each pushed file")
+	dryRun         = flag.Bool("dry_run", false, "Only report what would be pushed, without writing to GDrive")
+	offline        = flag.Bool("offline", false, "Plan against the GDrive listings saved by the snapshot command instead of going online, implies --dry_run")
+	apiUsageFile   = flag.String("api_usage_file", "", "If set, write a JSON breakdown of the Drive API calls made to this file")
+	trashMinAge    = flag.Duration("trash_min_age", 0, "Only list or empty items this tool trashed at least this long ago")
+	immutable      = flag.Bool("immutable", false, "Treat local changes to files that already exist in GDrive as errors instead of pushing them")
+
+	listingTTL            = flag.Duration("listing_ttl", 0, "Reuse the GDrive folder listings saved by earlier runs that are younger than this instead of listing those folders again; folders this tool wrote to since are always listed again, but changes made by others within the TTL go unseen")
+	skipUnchangedListings = flag.Bool("skip_unchanged_listings", false, "Reuse GDrive IDs from the last sync instead of listing directories whose local mtime hasn't changed")
+	staged                = flag.Bool("staged", false, "Upload everything into a staging folder and only swap it into --gdrive_root_id as --staged_name once complete")
+	stagedName            = flag.String("staged_name", "", "Name of the folder --staged publishes (default: base name of --local_dir_to_push)")
+	partialName           = flag.String("partial_name", "", "If set, upload files under this name (%s is the real one, e.g. \".%s.partial\") and rename them once complete")
+	manifestFile          = flag.String("manifest", "", "If set, write a bill of materials (SPDX style JSON with SHA-256 and GDrive links) of the pushed files to this file")
+	uploadManifest        = flag.Bool("upload_manifest", false, "Also upload the --manifest file to --gdrive_root_id")
+	snapshotCmd           = flag.String("snapshot_cmd", "", "Shell command that snapshots --local_dir_to_push (given as $"+push.SnapshotLocalDirEnv+") and prints the snapshot's mount point to push from")
+	snapshotReleaseCmd    = flag.String("snapshot_release_cmd", "", "Shell command that releases the --snapshot_cmd snapshot (given as $"+push.SnapshotPathEnv+") after the push")
+	annotate              = flag.String("annotate", "", "After each run, summarize it on --gdrive_root_id as a \"comment\" or in a STATUS.md file (\"status_file\")")
+	sign                  = flag.String("sign", "", "Sign the --manifest with \"gpg\" or \"minisign\", writing a detached signature next to it")
+	signKey               = flag.String("sign_key", "", "Key to --sign with: the gpg key ID (default: gpg's default key) or the minisign secret key file")
+	ignoreFile            = flag.String("ignore_file", ".gdriveignore", "Name of the gitignore-style files, at the root of --local_dir_to_push and in any folder below, listing what not to push (empty to disable)")
+	longPaths             = flag.String("long_paths", push.LongPathsFail, "What to do about items beyond --max_depth, --max_name_length or --max_path_length: \""+push.LongPathsFail+"\" before anything is written, or \""+push.LongPathsRemap+"\" (shorten titles with a hash, keeping the name in properties, and flatten files below the deepest folders allowed into them)")
+	maxDepth              = flag.Int("max_depth", 100, "How deep folders may be nested below --gdrive_root_id, GDrive allows 100 levels in all (0 for no limit)")
+	maxNameLength         = flag.Int("max_name_length", 255, "Longest GDrive title in characters, which is what Drive for desktop copes with (0 for no limit)")
+	maxPathLength         = flag.Int("max_path_length", 0, "Longest path below --gdrive_root_id in characters, e.g. 200 for the clients syncing it to Windows (0 for no limit)")
+	nameCollisions        = flag.String("name_collisions", push.CollisionFail, "What to do when local items of a folder would get the same GDrive title once escaped and normalized: \""+push.CollisionFail+"\" or \""+push.CollisionSuffix+"\" (push all but one as \"name (2).ext\")")
+	onlyManageOwn         = flag.Bool("only_manage_own", false, "Only relocate, replace or delete GDrive items this tool pushed, for destinations shared with people adding files of their own; other items are reported and left alone")
+	remoteScope           = flag.String("remote_scope", "", "Drive query terms, e.g. \"starred=false\" or \"'me' in owners\", that GDrive items under --gdrive_root_id must match to be compared with local ones; the rest, folders included, are left alone as if they weren't there")
+	descriptionTemplate   = flag.String("description_template", "", "Go template for the GDrive description of uploaded files with .Host, .Path, .Name and .Time, e.g. \"Pushed from {{.Host}}:{{.Path}} at {{.Time}}\" (none by default)")
+
+	verifySamplePercent = flag.Float64("verify_sample", 100, "Percentage of synced files the verify command checks per run, least recently verified first")
+	verifySeed          = flag.Int64("verify_seed", 0, "Seed for picking the verify sample (default: time based)")
+	verifyRepair        = flag.Bool("repair", false, "Have verify upload the files that fail verification again, moving the bad GDrive copies to --old_files_dir")
+	verifyCheckpoint    = flag.Duration("verify_checkpoint", time.Minute, "How often verify reports its progress and saves it, so that an interrupted run resumes from there")
+	auditAllowedDomains = flag.String("audit_allowed_domains", "", "Comma separated domains audit-perms accepts sharing with, flagging users, groups and domains elsewhere (default: any user or group, but no whole domain)")
+	auditAllowAnyone    = flag.Bool("audit_allow_anyone", false, "Don't flag items audit-perms finds shared with anyone (with the link)")
+
+	quarantineFailures = flag.Bool("quarantine_failures", false, "Add files that fail to upload to the skip list and carry on instead of failing the run")
+	precreateFolders   = flag.Int("precreate_folders", 0, "If set, create all missing folders up front with this many concurrent workers before uploading files")
+	filesOnly          = flag.String("files_only", "", "Never create folders, for structures another system manages: \""+push.FilesOnlyFail+"\" when a needed GDrive folder is missing, or \""+push.FilesOnlySkip+"\" what would go in it")
+	dirsOnly           = flag.Bool("dirs_only", false, "Only create the folder structure in GDrive, leaving out every file")
+	parallel           = flag.Int("parallel", 1, "How many files to upload or verify, and folders to process, at once")
+
+	maxOpsPerDay = flag.Int("max_ops_per_day", 0, "If set, the max number of Drive API requests made in any 24 hours, counted across runs in --state_dir")
+	quotaWait    = flag.Bool("quota_wait", false, "Wait for the --max_ops_per_day budget to free up instead of exiting")
+	watch        = flag.Bool("watch", false, "After the push, keep watching --local_dir_to_push and push changes as they happen")
+	watchDelay   = flag.Duration("watch_delay", 2*time.Second, "How long --watch waits for changes to settle before pushing them")
+	journal      = flag.String("journal", "", "Instead of walking --local_dir_to_push, push only the paths this change journal (\"-\" for stdin) shows written since the last replay, one \"TIME EVENTS PATH\" line each as inotifywait writes them")
+	nice         = flag.Bool("nice", false, "Make fewer and slower requests while Drive is slow or rate limiting, leaving room for other clients on the account")
+
+	estimateBandwidth = flag.String("estimate_bandwidth", "1MB", "Upload bandwidth per second assumed by the --dry_run duration estimate")
+	estimateOpLatency = flag.Duration("estimate_op_latency", 500*time.Millisecond, "Time per Drive API call assumed by the --dry_run duration estimate")
+
+	configFile      = flag.String("config", "", "YAML file of \"flag_name: value\" lines giving defaults for any flag, which the command line overrides (default: config.yaml in the --profile's dir, or ~/.config/gdrive-dir-push/config.yaml)")
+	profile         = flag.String("profile", "", "Named account profile, e.g. \"work\", with its own config, credentials and token as set up by \"init\" (default: the default profile)")
+	clientID        = flag.String("client_id", "", "OAuth Client ID (or $"+clientIDEnv+")")
+	clientSecret    = flag.String("secret", "", "OAuth Client Secret (or $"+clientSecretEnv+")")
+	credentialsFile = flag.String("credentials_file", "", "client_secret.json downloaded from the Google Cloud Console, used instead of --client_id and --secret (or $"+credentialsFileEnv+")")
+	tokenFileFlag   = flag.String("token_file", "", "Where to cache the OAuth token (default ~/.gdrive-dir-push/credentials.json)")
+	deviceAuth      = flag.Bool("device_auth", false, "Authorize with a code entered on another device, for machines without a browser; needs a \"TVs and Limited Input devices\" OAuth client, and Google then only grants access to what this tool created")
+	tokenKeyring    = flag.Bool("token_keyring", false, "Keep the OAuth token in the OS keyring instead of --token_file, which is only used where there is no keyring")
+
+	serviceAccountFile = flag.String("service_account_file", "", "JSON key of a service account to authenticate as instead of the OAuth client, for unattended runs (or $"+serviceAccountEnv+")")
+	impersonate        = flag.String("impersonate", "", "Email of the user the --service_account_file acts as, which needs domain-wide delegation (default: the service account itself)")
+)
+
+var (
+	dedupDirs     = flag.Bool("dedup_dirs", false, "Push only the first of new sibling directories with identical contents, such as copied release folders, and create the others as GDrive copies of it once it is pushed")
+	remoteChanges = flag.Bool("remote_changes", false, "Keep the GDrive folder listings of earlier runs up to date from GDrive's change feed and use them instead of listing those folders again, which saves most listing calls on trees that change little")
+	resume        = flag.Bool("resume", false, "Continue a push that was interrupted or failed from its resume log, trusting what the log says was done instead of listing the folders it created")
+	warmStart     = flag.Bool("warm_start", false, "When the sync state has no snapshot of the last push, e.g. on a new machine, seed it from the last --manifest (the local file, or the copy --upload_manifest put in --gdrive_root_id) so that only directories changed locally since are listed; implies --skip_unchanged_listings")
+	sentinelFile  = flag.String("sentinel_file", "", "File, relative to --local_dir_to_push, that must exist for anything to be written, e.g. \".mounted\" on a volume that may not be mounted")
+	allowEmpty    = flag.Bool("allow_empty", false, "Run even though --local_dir_to_push holds no files, which usually means a volume that isn't mounted")
+
+	drift       = flag.String("drift", push.DriftReport, "What to do about changes made under --gdrive_root_id by anything but gdrive-dir-push since its last run: \"report\" them and push, \"fail\" unless --accept_drift is given, or \"off\" to not look for them")
+	acceptDrift = flag.Bool("accept_drift", false, "Push even though --drift=fail found changes made in GDrive by something else")
+
+	deleteExtraneous  = flag.Bool("delete_extraneous", false, "Mirror local deletions: GDrive items under --gdrive_root_id with nothing local to match are marked missing, and removed once they stay missing past --delete_grace_runs or --delete_grace_period")
+	deleteAction      = flag.String("delete_action", push.DeleteRelocate, "How --delete_extraneous removes items: \"relocate\" them to --old_files_dir or \"trash\" them")
+	deleteGraceRuns   = flag.Int("delete_grace_runs", 2, "Runs an item missing locally is kept for before --delete_extraneous removes it, 0 to not count runs")
+	deleteGracePeriod = flag.Duration("delete_grace_period", 0, "How long an item missing locally is kept for before --delete_extraneous removes it, whichever of this and --delete_grace_runs comes first, 0 to not count time")
+
+	largeFileSize  = flag.String("large_file_size", "64MiB", "With --parallel, files at least this big are large: their uploads only get --large_file_slots of the upload workers and small files the rest, so that neither holds up the other")
+	largeFileSlots = flag.Int("large_file_slots", 0, "With --parallel, how many of the --parallel upload workers are kept for large files, the others being kept for small ones; 0 for half")
+	maxQPS         = flag.Float64("max_qps", 0, "Most Drive API requests to make per second, averaged over a second, to stay under the per-user quota; 0 for no limit")
+	bwLimit        = flag.String("bwlimit", "", "Most bytes per second to upload, e.g. \"5M\", shared by all uploads at once, so pushes leave room on the link (default: no limit)")
+)
+
+// The repeatable flags.
+var (
+	labels        push.LabelList
+	mimeTypes     push.MimeOverrides
+	oldFilesRules push.OldFilesTable
+	policies      push.PolicyTable
+)
+
+func init() {
+	flag.Var(&labels, "label", "Drive label to apply to uploaded files: LABEL_ID, LABEL_ID.FIELD_ID=TEXT or LABEL_ID.FIELD_ID=choice:CHOICE_ID (repeatable)")
+	flag.Var(&mimeTypes, "mime_type", "MIME type for files whose name matches a glob as GLOB=TYPE, e.g. \"Makefile=text/x-makefile\", instead of the one guessed from the extension or contents (repeatable)")
+	flag.Var(&oldFilesRules, "old_files_dir_for", "Move the files under a local subtree that would otherwise be overwritten to a folder of their own, as PREFIX=FOLDER_ID, e.g. \"teams/a=1AbC\"; the longest matching PREFIX wins and files under none go to --old_files_dir (repeatable)")
+	flag.Var(&policies, "policy", "Per-extension handling as GLOB=ACTION, e.g. \"*.raw=skip\", where ACTION is "+
+		push.PolicySkip+", "+push.PolicySizeOnly+", "+push.PolicyConvert+" (to Google Docs) or "+push.PolicyCompress+" (gzip) (repeatable)")
+}
+
+// source is the --source_archive that syncTarget opened, nil to push --local_dir_to_push.
+var source fs.FS
+
+// driveClient prepares a Drive client to use for GDrive operations.
+func driveClient(ctx context.Context) (*drive.Service, error) {
+	client, err := authClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if *nice {
+		limit := *parallel
+		if *precreateFolders > limit {
+			limit = *precreateFolders
+		}
+		client.Transport = push.NewNiceTransport(client.Transport, limit)
+	}
+	if *maxQPS < 0 {
+		return nil, fmt.Errorf("--max_qps can't be negative")
+	}
+	if *maxQPS > 0 {
+		client.Transport = push.NewQPSTransport(client.Transport, *maxQPS)
+	}
+
+	drv, err := drive.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve drive Client %v", err)
+	}
+	if *maxOpsPerDay > 0 {
+		if err := resolveStateDir(); err != nil {
+			return nil, err
+		}
+		if err := push.LimitDailyOps(*stateDir, *maxOpsPerDay, *quotaWait); err != nil {
+			return nil, err
+		}
+	}
+	return drv, nil
+}
+
+// resolveStateDir fills in the default --state_dir if none was given.
+func resolveStateDir() error {
+	if *stateDir != "" {
+		return nil
+	}
+	dir, err := state.DefaultDir()
+	if err != nil {
+		return fmt.Errorf("Could not determine state dir: %v", err)
+	}
+	*stateDir = dir
+	return nil
+}
+
+// syncTarget validates --gdrive_root_id and --local_dir_to_push, normalizing both, and returns the
+// path of the sync state kept for them.  With --source_archive the archive takes the place of the
+// local dir and is opened as the source.
+func syncTarget() (string, error) {
+	if *gDriveRootID == "" {
+		return "", fmt.Errorf("--gdrive_root_id must be provided")
+	}
+	if strings.EqualFold(*gDriveRootID, push.MyDriveAlias) {
+		*gDriveRootID = push.MyDriveAlias
+	}
+	if *sourceArchive != "" {
+		if *localDirToPush != "" {
+			return "", fmt.Errorf("--source_archive replaces --local_dir_to_push, give only one")
+		}
+		*localDirToPush = *sourceArchive
+	}
+	if *localDirToPush == "" {
+		return "", fmt.Errorf("--local_dir_to_push must be provided")
+	}
+
+	absPath, err := filepath.Abs(*localDirToPush)
+	if err != nil {
+		return "", fmt.Errorf("Could not determine absolute path: %v", err)
+	}
+	*localDirToPush = absPath
+	if *sourceArchive != "" {
+		if source, err = push.OpenArchive(absPath); err != nil {
+			return "", err
+		}
+	}
+
+	if err := resolveStateDir(); err != nil {
+		return "", err
+	}
+	return state.Path(*stateDir, *gDriveRootID, *localDirToPush), nil
+}
+
+// parseBytes parses the size given to |name|, such as "16MiB", empty meaning 0.
+func parseBytes(name, value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	size, err := humanize.ParseBytes(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid --%s: %v", name, err)
+	}
+	return size, nil
+}
+
+// pushOptions returns the push.Options the flags describe.
+func pushOptions() (push.Options, error) {
+	opts := push.Options{
+		RootID:         *gDriveRootID,
+		LocalDir:       *localDirToPush,
+		Source:         source,
+		StateDir:       *stateDir,
+		OldFilesDir:    *oldFilesDir,
+		OldFilesDirFor: oldFilesRules,
+		Filter:         treeFilter(),
+		Scope:          *remoteScope,
+
+		Connect: driveClient,
+		Output:  statusWriter{},
+		Stop:    interruptedC,
+
+		DryRun:  *dryRun,
+		Offline: *offline,
+		MaxOps:  *maxOps,
+
+		MultipartLimit: *multipartLimit,
+		ReadAhead:      *readAhead,
+		Parallel:       *parallel,
+		LargeFileSlots: *largeFileSlots,
+		Labels:         labels,
+		MimeTypes:      mimeTypes,
+		Policies:       policies,
+		PartialName:    *partialName,
+		Sidecar:        *sidecar,
+		FolderColor:    *folderColor,
+
+		MatchBy:               *matchBy,
+		Immutable:             *immutable,
+		OnlyManageOwn:         *onlyManageOwn,
+		ListingTTL:            *listingTTL,
+		SkipUnchangedListings: *skipUnchangedListings,
+		RemoteChanges:         *remoteChanges,
+		WarmStart:             *warmStart,
+		Drift:                 *drift,
+		AcceptDrift:           *acceptDrift,
+		DedupDirs:             *dedupDirs,
+
+		Journal:            *journal,
+		DirsOnly:           *dirsOnly,
+		FilesOnly:          *filesOnly,
+		Staged:             *staged,
+		StagedName:         *stagedName,
+		PrecreateFolders:   *precreateFolders,
+		Resume:             *resume,
+		QuarantineFailures: *quarantineFailures,
+		SentinelFile:       *sentinelFile,
+		AllowEmpty:         *allowEmpty,
+		SnapshotCmd:        *snapshotCmd,
+		SnapshotReleaseCmd: *snapshotReleaseCmd,
+		LongPaths:          *longPaths,
+		MaxDepth:           *maxDepth,
+		MaxNameLength:      *maxNameLength,
+		MaxPathLength:      *maxPathLength,
+		NameCollisions:     *nameCollisions,
+
+		DeleteExtraneous:  *deleteExtraneous,
+		DeleteAction:      *deleteAction,
+		DeleteGraceRuns:   *deleteGraceRuns,
+		DeleteGracePeriod: *deleteGracePeriod,
+
+		StarRoot:       *starRoot,
+		Manifest:       *manifestFile,
+		UploadManifest: *uploadManifest,
+		Sign:           *sign,
+		SignKey:        *signKey,
+		Annotate:       *annotate,
+		Report:         *reportFile,
+		WatchDelay:     *watchDelay,
+
+		EstimateOpLatency: *estimateOpLatency,
+		MaxQPS:            *maxQPS,
+
+		VerifySample:        *verifySamplePercent,
+		VerifySeed:          *verifySeed,
+		VerifyRepair:        *verifyRepair,
+		VerifyCheckpoint:    *verifyCheckpoint,
+		AuditAllowedDomains: *auditAllowedDomains,
+		AuditAllowAnyone:    *auditAllowAnyone,
+		TrashMinAge:         *trashMinAge,
+	}
+	chunk, err := parseBytes("chunk_size", *chunkSize)
+	if err != nil {
+		return opts, err
+	}
+	if chunk == 0 || chunk%googleapi.MinUploadChunkSize != 0 || chunk > 1<<30 {
+		return opts, fmt.Errorf("--chunk_size must be a multiple of 256KiB, up to 1GiB")
+	}
+	opts.ChunkSize = int(chunk)
+	if opts.BWLimit, err = parseBytes("bwlimit", *bwLimit); err != nil {
+		return opts, err
+	}
+	if opts.LargeFileSize, err = parseBytes("large_file_size", *largeFileSize); err != nil {
+		return opts, err
+	}
+	if opts.EstimateBandwidth, err = parseBytes("estimate_bandwidth", *estimateBandwidth); err != nil {
+		return opts, err
+	}
+	if *descriptionTemplate != "" {
+		if opts.Description, err = template.New("description").Parse(*descriptionTemplate); err != nil {
+			return opts, fmt.Errorf("Invalid --description_template: %v", err)
+		}
+	}
+	return opts, nil
+}
+
+// withPusher runs |fn| with a Pusher for the sync relationship the flags describe, keeping its
+// sync state at |statePath|, or none if it is empty, and a context derived from |ctx| that is
+// cancelled once the Pusher runs out of requests.
+func withPusher(ctx context.Context, statePath string, fn func(ctx context.Context, p *push.Pusher) error) error {
+	opts, err := pushOptions()
+	if err != nil {
+		return err
+	}
+	var st *state.State
+	if statePath != "" {
+		if st, err = state.Load(statePath, *gDriveRootID); err != nil {
+			return err
+		}
+	}
+	p := push.New(nil, st, opts)
+	ctx, cancel := p.Context(ctx)
+	defer cancel()
+	return fn(ctx, p)
+}
+
+func main() {
+	args := parseCommandLine()
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Problem reading config: %v", err)
+	}
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
+	state.UseDB = *stateDB
+	oauth.Profile = *profile
+	oauth.TokenFile = *tokenFileFlag
+	oauth.Keyring = *tokenKeyring
+	oauth.DeviceFlow = *deviceAuth
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if len(args) > 0 && !isPushCommand(args[0]) {
+		err := runCommand(ctx, cancel, args)
+		paged.show()
+		push.SaveOpsLog()
+		if qerr := push.DailyOpsExhausted(); qerr != nil {
+			err = qerr
+		}
+		if err != nil {
+			fatalf("%s: %v", args[0], err)
+		}
+		return
+	}
+	if len(args) > 0 {
+		if err := pushCommand(args); err != nil {
+			fatalf("%s: %v", args[0], err)
+		}
+	}
+	catchInterrupts(cancel)
+
+	statePath, err := syncTarget()
+	if err != nil {
+		fatal(err)
+	}
+	if err := setupOutput(); err != nil {
+		fatal(err)
+	}
+	if *parallel < 1 {
+		fatalf("--parallel must be at least 1")
+	}
+	if *deleteExtraneous && *watch {
+		fatalf("--delete_extraneous needs to see the whole local dir once per run and can't be combined with --watch")
+	}
+	if *watch && *pager {
+		fatalf("--pager can't be combined with --watch, which never finishes")
+	}
+	if *watch && (*sourceArchive != "" || *snapshotCmd != "" || *staged || *dryRun || *offline) {
+		fatalf("--watch needs a local dir to watch and can't be combined with --source_archive, --snapshot_cmd, --staged or --dry_run")
+	}
+	if *journal != "" && *watch {
+		fatalf("--journal replays changes to the local dir and can't be combined with --watch")
+	}
+	opts, err := pushOptions()
+	if err != nil {
+		fatal(err)
+	}
+	if err := opts.Check(); err != nil {
+		fatal(err)
+	}
+
+	st, err := state.Load(statePath, *gDriveRootID)
+	if err != nil {
+		fatalf("Problem loading sync state: %v", err)
+	}
+	var listeners listenerList
+	if *progress {
+		listeners = append(listeners, newTextProgress())
+	}
+	if events != nil {
+		listeners = append(listeners, events)
+	}
+	opts.Listener = listeners.listener()
+	p := push.New(nil, st, opts)
+	// Save what has been learned so far in case re-authorizing doesn't work out.  This runs on
+	// whichever goroutine's request found the token rejected, while workers go on updating the
+	// state.
+	oauth.BeforeReauth = func() {
+		if err := p.SaveState(); err != nil {
+			log.Printf("Problem saving sync state: %v", err)
+		}
+	}
+
+	syncErr := p.Apply(ctx)
+	paged.show()
+	// Hashes and listings are worth keeping even when the sync failed part way
+	if err := st.Save(); err != nil {
+		log.Printf("Problem saving sync state: %v", err)
+	}
+	push.SaveOpsLog()
+	run := p.RecordRun()
+	if run == nil {
+		// Nothing was pushed
+		if syncErr != nil {
+			fatal(syncErr)
+		}
+		return
+	}
+	summary := p.Summary()
+	report := newReport(run, summary)
+	if err := report.save(); err != nil {
+		log.Printf("Problem writing --report: %v", err)
+	}
+	if !oauth.AuthFailed() {
+		if err := p.Annotate(ctx, run); err != nil {
+			log.Printf("Problem with --annotate: %v", err)
+		}
+	}
+	if syncErr != nil {
+		if errors.Is(syncErr, push.ErrInterrupted) {
+			p.PrintInterrupted()
+			os.Exit(130) // As shells report processes killed by SIGINT
+		}
+		if oauth.AuthFailed() {
+			fatalf("Authorization failed, sync state was saved; re-run from a terminal to re-authorize: %v", syncErr)
+		}
+		fatalf("Problem syncing dir: %v", syncErr)
+	}
+
+	report.print()
+	p.PrintTotals()
+	if *apiUsageFile != "" {
+		if err := push.SaveUsage(*apiUsageFile); err != nil {
+			log.Printf("Problem writing --api_usage_file: %v", err)
+		}
+	}
+
+	if len(summary.Violations) > 0 {
+		fmt.Printf("\nFiles changed locally but left untouched due to --immutable:\n")
+		for _, path := range summary.Violations {
+			fmt.Printf("  /%s\n", path)
+		}
+		fatalf("%d existing file(s) differ from GDrive while --immutable is set", len(summary.Violations))
+	}
+	if *watch {
+		if err := p.Watch(ctx); err != nil && !errors.Is(err, push.ErrInterrupted) {
+			fatalf("Problem with --watch: %v", err)
+		}
+	}
+}
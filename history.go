@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+// historyCommand implements "history", which lists past runs, and "history show RUN", which
+// prints everything recorded about one of them, followed by its --report and resume log if they
+// are still around.
+func historyCommand(args []string) error {
+	runs, err := state.History(*stateDir)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(args) == 0:
+		for _, r := range runs {
+			mode := ""
+			if r.DryRun {
+				mode = " (dry run)"
+			}
+			if r.Kind == "verify" {
+				fmt.Printf("%s  %-10v  verified %d, %d mismatched, coverage %.1f%%  %s\n", r.ID,
+					r.End.Sub(r.Start).Round(time.Second), r.FilesVerified, r.VerifyMismatches,
+					r.VerifyCoverage*100, r.Result)
+				continue
+			}
+			fmt.Printf("%s  %-10v  +%d dirs  +%d files  M%d  %8s  %8s stored  %s%s\n", r.ID,
+				r.End.Sub(r.Start).Round(time.Second), r.FoldersCreated, r.FilesUploaded, r.FilesReplaced,
+				humanize.Bytes(uint64(r.BytesUploaded)), humanize.Bytes(uint64(r.StorageAdded)), r.Result, mode)
+		}
+		return nil
+	case len(args) == 2 && args[0] == "show":
+		for _, r := range runs {
+			if r.ID != args[1] {
+				continue
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+			showRunFile("Report", r.Report)
+			// Later runs replace the log, or remove it once one completes
+			showRunFile("Resume log", r.ResumeLog)
+			return nil
+		}
+		return fmt.Errorf("No run %q in the history", args[1])
+	default:
+		return fmt.Errorf("Usage: history [show RUN]")
+	}
+}
+
+// showRunFile prints the file at |path| that a run left behind, under |what|, or why it can't.
+func showRunFile(what, path string) {
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("\n%s: %v\n", what, err)
+		return
+	}
+	fmt.Printf("\n%s %s:\n%s", what, path, data)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/hatchling/gdrive-dir-push/oauth"
+	"github.com/hatchling/gdrive-dir-push/push"
+)
+
+// prompt asks |question| on stdout and returns the trimmed answer, or |def| if the answer is empty.
+func prompt(in *bufio.Reader, question, def string) (string, error) {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, err := in.ReadString('\n')
+	if err != nil && answer == "" {
+		return "", err
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// initCommand implements "init", which walks the user through configuring their own OAuth client,
+// authorizing it, and checking that the destination folder can be reached.  The client and token
+// of an rclone Drive remote can be imported instead of setting them up again.  The answers are
+// saved to the config file so that later runs need no credential flags.
+func initCommand(ctx context.Context) error {
+	in := bufio.NewReader(os.Stdin)
+	var values []configValue
+	set := func(name, value string) error {
+		if err := flag.Set(name, value); err != nil {
+			return err
+		}
+		commandLineFlags[name] = true
+		values = append(values, configValue{name, value})
+		return nil
+	}
+
+	remote, err := offerRcloneImport(in)
+	if err != nil {
+		return err
+	}
+	if remote != nil {
+		if err := set("client_id", remote.clientID); err != nil {
+			return err
+		}
+		if err := set("secret", remote.clientSecret); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("gdrive-dir-push needs an OAuth client of your own.  Create one of type \"Desktop app\" at")
+		fmt.Println("https://console.cloud.google.com/apis/credentials in a project with the Drive API enabled.")
+		fmt.Println()
+
+		path, err := prompt(in, "Path to its client_secret.json (empty to enter the client ID and secret instead)", "")
+		if err != nil {
+			return err
+		}
+		if path != "" {
+			if path, err = filepath.Abs(path); err != nil {
+				return err
+			}
+			if _, err := oauth.ConfigFromFile(path, driveScope); err != nil {
+				return err
+			}
+			if err := set("credentials_file", path); err != nil {
+				return err
+			}
+		} else {
+			id, err := prompt(in, "Client ID", "")
+			if err != nil {
+				return err
+			}
+			secret, err := prompt(in, "Client secret", "")
+			if err != nil {
+				return err
+			}
+			if id == "" || secret == "" {
+				return fmt.Errorf("Both a client ID and secret are needed")
+			}
+			if err := set("client_id", id); err != nil {
+				return err
+			}
+			if err := set("secret", secret); err != nil {
+				return err
+			}
+		}
+	}
+
+	tokenFile, err := oauth.DefaultTokenFile()
+	if err != nil {
+		return err
+	}
+	if *tokenFileFlag != "" {
+		tokenFile = *tokenFileFlag
+	}
+	if tokenFile, err = prompt(in, "File to keep the authorization token in", tokenFile); err != nil {
+		return err
+	}
+	if tokenFile, err = filepath.Abs(tokenFile); err != nil {
+		return err
+	}
+	if err := set("token_file", tokenFile); err != nil {
+		return err
+	}
+	oauth.TokenFile = tokenFile
+	if remote != nil {
+		if err := oauth.ImportToken(remote.token); err != nil {
+			return fmt.Errorf("Problem saving the rclone token: %v", err)
+		}
+	}
+
+	root := *gDriveRootID
+	if root == "" && remote != nil && remote.rootFolderID != "" {
+		root = remote.rootFolderID
+	} else if root == "" {
+		root = push.MyDriveAlias
+	}
+	if root, err = prompt(in, "GDrive folder ID to push to (\"root\" for the top level of My Drive)", root); err != nil {
+		return err
+	}
+	*gDriveRootID = root
+
+	p := push.New(nil, nil, push.Options{RootID: root, Connect: driveClient, Output: statusWriter{}})
+	title, err := p.RootTitle(ctx)
+	if err != nil {
+		return fmt.Errorf("Can't push to %q: %v", root, err)
+	}
+	fmt.Printf("Access to GDrive folder %q works\n", title)
+	if err := set("gdrive_root_id", root); err != nil {
+		return err
+	}
+
+	local, err := prompt(in, "Local dir to push (empty to always pass --local_dir_to_push)", *localDirToPush)
+	if err != nil {
+		return err
+	}
+	if local != "" {
+		if local, err = filepath.Abs(local); err != nil {
+			return err
+		}
+		if err := set("local_dir_to_push", local); err != nil {
+			return err
+		}
+	}
+	old, err := prompt(in, "Directory for files that would be overwritten (empty to always pass --old_files_dir)", *oldFilesDir)
+	if err != nil {
+		return err
+	}
+	if old != "" {
+		if err := set("old_files_dir", old); err != nil {
+			return err
+		}
+	}
+
+	configFile, err := saveConfig(values)
+	if err != nil {
+		return fmt.Errorf("Problem saving config: %v", err)
+	}
+	fmt.Printf("Saved to %s\n", configFile)
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/net/context"
+)
+
+// interruptedC is closed on the first SIGINT or SIGTERM.
+var interruptedC = make(chan struct{})
+
+// catchInterrupts makes the first SIGINT or SIGTERM stop the push gracefully: no new uploads or
+// folders are started, while those under way finish.  A second one aborts them through |cancel|.
+func catchInterrupts(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		fmt.Fprintf(os.Stderr, "\nInterrupted, letting the uploads under way finish (interrupt again to abort them)\n")
+		close(interruptedC)
+		<-sigs
+		fmt.Fprintf(os.Stderr, "\nAborting the uploads under way\n")
+		cancel()
+	}()
+}
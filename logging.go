@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+var (
+	logLevel  = flag.String("log_level", "info", "The least severe log messages to show on stderr: \"debug\" (which includes every Drive call), \"info\", \"warn\" or \"error\"")
+	logFormat = flag.String("log_format", "text", "How log messages are written to stderr: \"text\" or \"json\", one object per line")
+)
+
+// setupLogging sends the log messages of the run to stderr as --log_level and --log_format say,
+// apart from the status output on stdout.  What goes through the log package, mostly problems
+// that are retried or worked around, is logged as warnings.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("--log_level must be \"debug\", \"info\", \"warn\" or \"error\"")
+	}
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch *logFormat {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("--log_format must be \"text\" or \"json\"")
+	}
+	slog.SetDefault(slog.New(handler))
+	slog.SetLogLoggerLevel(slog.LevelWarn)
+	return nil
+}
+
+// fatalf logs the message |format| makes of |a| as an error and exits, like log.Fatalf.
+func fatalf(format string, a ...interface{}) {
+	fatal(fmt.Sprintf(format, a...))
+}
+
+// fatal logs |a|, formatted as by fmt.Sprint, as an error and exits.
+func fatal(a ...interface{}) {
+	slog.Error(fmt.Sprint(a...))
+	os.Exit(1)
+}
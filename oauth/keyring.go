@@ -0,0 +1,74 @@
+package oauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/oauth2"
+)
+
+// Keyring, if set, keeps the token in the OS keyring (macOS Keychain, Windows Credential Manager
+// or the Secret Service on Linux) instead of the token file.  Where there is no keyring to use the
+// token file is used as before.
+var Keyring bool
+
+// keyringService names the keyring entries, which are keyed by the token file they replace so that
+// separate token files keep separate tokens.
+const keyringService = "gdrive-dir-push"
+
+// loadToken returns the token cached for |cacheFile|, from the keyring if Keyring is set and it
+// holds one.
+func loadToken(cacheFile string) (*oauth2.Token, error) {
+	if Keyring {
+		secret, err := keyring.Get(keyringService, cacheFile)
+		if err == nil {
+			t := &oauth2.Token{}
+			if err := json.Unmarshal([]byte(secret), t); err != nil {
+				return nil, fmt.Errorf("Corrupt token in the OS keyring: %v", err)
+			}
+			return t, nil
+		}
+		if err != keyring.ErrNotFound {
+			fmt.Printf("The OS keyring can't be read (%v), using the credential file\n", err)
+		}
+	}
+	tok, err := tokenFromFile(cacheFile)
+	if err == nil && Keyring {
+		// Move a token cached before Keyring was set into the keyring
+		storeToken(cacheFile, tok)
+	}
+	return tok, err
+}
+
+// ImportToken caches |token|, which the user authorized for the same client with another tool, as
+// if they had just authorized it here.
+func ImportToken(token *oauth2.Token) error {
+	file, err := tokenCacheFile()
+	if err != nil {
+		return err
+	}
+	storeToken(file, token)
+	return nil
+}
+
+// storeToken caches |token| for |cacheFile|, in the keyring if Keyring is set and one can be
+// written.  A token file left from before is then removed so that no plaintext copy lingers.
+func storeToken(cacheFile string, token *oauth2.Token) {
+	if Keyring {
+		data, err := json.Marshal(token)
+		if err == nil {
+			err = keyring.Set(keyringService, cacheFile, string(data))
+		}
+		if err == nil {
+			fmt.Printf("Saving credential to the OS keyring\n")
+			if err := os.Remove(cacheFile); err != nil && !os.IsNotExist(err) {
+				fmt.Printf("Problem removing the old credential file %s: %v\n", cacheFile, err)
+			}
+			return
+		}
+		fmt.Printf("The OS keyring can't be written (%v), falling back to the credential file\n", err)
+	}
+	saveToken(cacheFile, token)
+}
@@ -1,87 +1,329 @@
-package oauth
-
-import (
-	"encoding/json"
-	"fmt"
-	"log"
-	"net/http"
-	"net/url"
-	"os"
-	"os/user"
-	"path/filepath"
-
-	"golang.org/x/net/context"
-	"golang.org/x/oauth2"
-)
-
-// GetClient uses a Context and Config to retrieve a Token
-// then generate a Client. It returns the generated Client.
-func GetClient(ctx context.Context, config *oauth2.Config) *http.Client {
-	cacheFile, err := tokenCacheFile()
-	if err != nil {
-		log.Fatalf("Unable to get path to cached credential file. %v", err)
-	}
-	tok, err := tokenFromFile(cacheFile)
-	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(cacheFile, tok)
-	}
-	return config.Client(ctx, tok)
-}
-
-// tokenCacheFile generates credential file path/filename.
-// It returns the generated credential path/filename.
-func tokenCacheFile() (string, error) {
-	usr, err := user.Current()
-	if err != nil {
-		return "", err
-	}
-	tokenCacheDir := filepath.Join(usr.HomeDir, ".gdrive-dir-push")
-	os.MkdirAll(tokenCacheDir, 0700)
-	return filepath.Join(tokenCacheDir,
-		url.QueryEscape("credentials.json")), err
-}
-
-// tokenFromFile retrieves a Token from a given file path.
-// It returns the retrieved Token and any read error encountered.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
-	}
-	t := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(t)
-	defer f.Close()
-	return t, err
-}
-
-// getTokenFromWeb uses Config to request a Token.
-// It returns the retrieved Token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
-
-	var code string
-	if _, err := fmt.Scan(&code); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)
-	}
-
-	tok, err := config.Exchange(oauth2.NoContext, code)
-	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
-	}
-	return tok
-}
-
-// saveToken uses a file path to create a file and store the
-// token in it.
-func saveToken(file string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", file)
-	f, err := os.Create(file)
-	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
-	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
-}
+package oauth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// BeforeReauth, if set, is called before the user is asked to re-authorize in the middle of a run
+// so that progress can be checkpointed in case the run doesn't survive.
+var BeforeReauth func()
+
+// DeviceFlow, if set, has the user authorize on another device with a short code instead of in a
+// browser on this machine.
+var DeviceFlow bool
+
+// Profile names the account profile in use, which keeps its own token.  Empty is the default
+// profile.
+var Profile string
+
+// TokenFile, if set, is where the token is cached instead of DefaultTokenFile.
+var TokenFile string
+
+var (
+	authFailedMu sync.Mutex
+	authFailed   bool
+)
+
+// AuthFailed reports whether a token refresh was rejected and could not be recovered, which means
+// the run failed for lack of authorization rather than a network or Drive problem.
+func AuthFailed() bool {
+	authFailedMu.Lock()
+	defer authFailedMu.Unlock()
+	return authFailed
+}
+
+// ConfigFromFile reads the client_secret.json that the Google Cloud Console offers for download
+// and returns a Config requesting |scopes|.
+func ConfigFromFile(path string, scopes ...string) (*oauth2.Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := google.ConfigFromJSON(data, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse client credentials %q: %v", path, err)
+	}
+	return config, nil
+}
+
+// ServiceAccountClient returns a Client authenticated as the service account whose JSON key is at
+// |path|, which never needs anyone to authorize it.  If |subject| is set the service account acts
+// as that user, which takes domain-wide delegation granted by the domain's admin.
+func ServiceAccountClient(ctx context.Context, path, subject string, scopes ...string) (*http.Client, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := google.JWTConfigFromJSON(data, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse service account key %q: %v", path, err)
+	}
+	config.Subject = subject
+	return config.Client(ctx), nil
+}
+
+// GetClient uses a Context and Config to retrieve a Token
+// then generate a Client. It returns the generated Client.
+func GetClient(ctx context.Context, config *oauth2.Config) *http.Client {
+	cacheFile, err := tokenCacheFile()
+	if err != nil {
+		fatalf("Unable to get path to cached credential file. %v", err)
+	}
+	tok, err := loadToken(cacheFile)
+	if err != nil {
+		tok = authorize(config)
+		storeToken(cacheFile, tok)
+	}
+	src := &reauthTokenSource{
+		ctx:       ctx,
+		config:    config,
+		cacheFile: cacheFile,
+		src:       config.TokenSource(ctx, tok),
+	}
+	return oauth2.NewClient(ctx, src)
+}
+
+// reauthTokenSource refreshes tokens like the standard TokenSource, but when the refresh token has
+// been revoked or has expired it asks the user to re-authorize (if there is a terminal to ask on)
+// instead of failing the rest of the run.
+type reauthTokenSource struct {
+	ctx       context.Context
+	config    *oauth2.Config
+	cacheFile string
+
+	mu  sync.Mutex
+	src oauth2.TokenSource
+}
+
+// Token implements oauth2.TokenSource.
+func (s *reauthTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tok, err := s.src.Token()
+	if err == nil {
+		return tok, nil
+	}
+	if _, ok := err.(*oauth2.RetrieveError); !ok {
+		// Not a rejection by the auth server, most likely the network
+		return nil, err
+	}
+	if !interactive() {
+		authFailedMu.Lock()
+		authFailed = true
+		authFailedMu.Unlock()
+		return nil, fmt.Errorf("Authorization was rejected and there is no terminal to re-authorize on: %v", err)
+	}
+
+	if BeforeReauth != nil {
+		BeforeReauth()
+	}
+	fmt.Printf("\nAuthorization was rejected (%v), re-authorize to continue the run.\n", err)
+	tok = authorize(s.config)
+	storeToken(s.cacheFile, tok)
+	s.src = s.config.TokenSource(s.ctx, tok)
+	return s.src.Token()
+}
+
+// interactive reports whether stdin is a terminal the user can answer prompts on.
+func interactive() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// DefaultTokenFile returns where the token is cached when TokenFile isn't set.
+func DefaultTokenFile() (string, error) {
+	return ProfileTokenFile(Profile)
+}
+
+// ProfileTokenFile returns where the token of |profile| is cached by default, which keeps the
+// tokens of different profiles apart.
+func ProfileTokenFile(profile string) (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(usr.HomeDir, ".gdrive-dir-push")
+	if profile != "" {
+		dir = filepath.Join(dir, "profiles", profile)
+	}
+	return filepath.Join(dir, url.QueryEscape("credentials.json")), nil
+}
+
+// tokenCacheFile generates credential file path/filename.
+// It returns the generated credential path/filename.
+func tokenCacheFile() (string, error) {
+	if TokenFile != "" {
+		os.MkdirAll(filepath.Dir(TokenFile), 0700)
+		return TokenFile, nil
+	}
+	file, err := DefaultTokenFile()
+	if err != nil {
+		return "", err
+	}
+	os.MkdirAll(filepath.Dir(file), 0700)
+	return file, nil
+}
+
+// tokenFromFile retrieves a Token from a given file path.
+// It returns the retrieved Token and any read error encountered.
+func tokenFromFile(file string) (*oauth2.Token, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	t := &oauth2.Token{}
+	err = json.NewDecoder(f).Decode(t)
+	defer f.Close()
+	return t, err
+}
+
+// authorize has the user authorize |config| and returns the Token, in a browser on this machine
+// or, with DeviceFlow, on any other device.
+func authorize(config *oauth2.Config) *oauth2.Token {
+	if DeviceFlow {
+		return getTokenFromDevice(config)
+	}
+	return getTokenFromWeb(config)
+}
+
+// getTokenFromDevice has the user authorize |config| with a short code entered on another device,
+// such as a phone, for machines without a browser.  It polls until that is done and returns the
+// Token.  The OAuth client must be of the "TVs and Limited Input devices" type.
+func getTokenFromDevice(config *oauth2.Config) *oauth2.Token {
+	device := *config
+	if device.Endpoint.DeviceAuthURL == "" {
+		device.Endpoint.DeviceAuthURL = google.Endpoint.DeviceAuthURL
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+	da, err := device.DeviceAuth(ctx)
+	if err != nil {
+		fatalf("Unable to start device authorization %v", err)
+	}
+	fmt.Printf("On any device, go to %s and enter the code %s\n", da.VerificationURI, da.UserCode)
+	tok, err := device.DeviceAccessToken(ctx, da)
+	if err != nil {
+		fatalf("Unable to retrieve token from device authorization %v", err)
+	}
+	return tok
+}
+
+// authTimeout is how long the user has to authorize in the browser.
+const authTimeout = 5 * time.Minute
+
+// getTokenFromWeb has the user authorize |config| in their browser and returns the Token.  The
+// browser is sent back to a listener on the loopback interface, which picks up the authorization
+// code so that nothing has to be copied by hand.
+func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fatalf("Unable to listen for the authorization redirect %v", err)
+	}
+	redirect := *config
+	redirect.RedirectURL = "http://" + listener.Addr().String()
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		fatalf("Unable to generate the authorization state %v", err)
+	}
+	state := hex.EncodeToString(nonce)
+
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("state") != state {
+			// Not the redirect, such as the browser asking for a favicon
+			http.NotFound(w, r)
+			return
+		}
+		if e := q.Get("error"); e != "" {
+			fmt.Fprintf(w, "Authorization failed (%s), you can close this window.\n", e)
+			select {
+			case errs <- fmt.Errorf("authorization failed: %s", e):
+			default:
+			}
+			return
+		}
+		fmt.Fprintf(w, "gdrive-dir-push is authorized, you can close this window.\n")
+		select {
+		case codes <- q.Get("code"):
+		default:
+		}
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	authURL := redirect.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	fmt.Printf("Authorize access in the browser window that opens, or if none does, go to the "+
+		"following link in a browser on this machine: \n%v\n", authURL)
+	openBrowser(authURL)
+
+	var code string
+	select {
+	case code = <-codes:
+	case err := <-errs:
+		fatalf("Unable to retrieve token from web %v", err)
+	case <-time.After(authTimeout):
+		fatalf("No authorization within %v", authTimeout)
+	}
+
+	tok, err := redirect.Exchange(oauth2.NoContext, code)
+	if err != nil {
+		fatalf("Unable to retrieve token from web %v", err)
+	}
+	return tok
+}
+
+// openBrowser tries to show |url| in the user's browser.  It is fine for it to fail, the URL is
+// printed as well.
+func openBrowser(url string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err == nil {
+		go cmd.Wait()
+	}
+}
+
+// saveToken uses a file path to create a file and store the
+// token in it.
+func saveToken(file string, token *oauth2.Token) {
+	fmt.Printf("Saving credential file to: %s\n", file)
+	f, err := os.Create(file)
+	if err != nil {
+		fatalf("Unable to cache oauth token: %v", err)
+	}
+	defer f.Close()
+	json.NewEncoder(f).Encode(token)
+}
+
+// fatalf logs the message |format| makes of |a| as an error and exits, like log.Fatalf.
+func fatalf(format string, a ...interface{}) {
+	slog.Error(fmt.Sprintf(format, a...))
+	os.Exit(1)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+var pager = flag.Bool("pager", false, "Hold back the status lines of a push, or the output of diff-local and manifest diff, and show them once done through $PAGER (less if unset), sorted by path in the collation order of the locale; lines of the same path keep their order")
+
+// pagedLines collects the status lines held back for --pager.
+type pagedLines struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+var paged = &pagedLines{}
+
+// add holds back |text|, one or more status lines.
+func (p *pagedLines) add(text string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lines = append(p.lines, strings.Split(strings.TrimSuffix(text, "\n"), "\n")...)
+}
+
+// show sorts the lines held back so far and pages them, or prints them if stdout isn't a
+// terminal.  It does nothing without --pager.
+func (p *pagedLines) show() {
+	p.mu.Lock()
+	lines := p.lines
+	p.lines = nil
+	p.mu.Unlock()
+	if !*pager || len(lines) == 0 {
+		return
+	}
+	sortLines(lines, localeCollator())
+	text := strings.Join(lines, "\n") + "\n"
+
+	fi, err := os.Stdout.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		io.WriteString(os.Stdout, text)
+		return
+	}
+	command := strings.Fields(os.Getenv("PAGER"))
+	if len(command) == 0 {
+		command = []string{"less"}
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("Problem running $PAGER, printing instead: %v", err)
+		io.WriteString(os.Stdout, text)
+	}
+}
+
+// linePath returns the path a status line such as "M /a/b (1 kB)" is about: what follows the
+// status up to the details in parentheses.  Lines of another form are sorted as a whole.
+func linePath(line string) string {
+	sp := strings.Index(line, " ")
+	if sp < 0 {
+		return line
+	}
+	name := strings.TrimLeft(line[sp:], " ")
+	if paren := strings.Index(name, " ("); paren >= 0 {
+		name = name[:paren]
+	}
+	return name
+}
+
+// sortLines sorts status |lines| by path with |c|, or byte by byte if it is nil.  The sort is
+// stable, so that what happened to one path reads in order.
+func sortLines(lines []string, c *collate.Collator) {
+	// Sort keys are worked out once per line, comparing them is then cheap
+	var buf collate.Buffer
+	keys := make(map[string][]byte, len(lines))
+	for _, line := range lines {
+		if c == nil {
+			keys[line] = []byte(linePath(line))
+		} else {
+			keys[line] = c.KeyFromString(&buf, linePath(line))
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return bytes.Compare(keys[lines[i]], keys[lines[j]]) < 0 })
+}
+
+// localeCollator returns the collator of the locale the environment sets for collation, as
+// LC_ALL, LC_COLLATE or LANG, or nil for the C locale and those it doesn't know.
+func localeCollator() *collate.Collator {
+	var locale string
+	for _, name := range []string{"LC_ALL", "LC_COLLATE", "LANG"} {
+		if locale = os.Getenv(name); locale != "" {
+			break
+		}
+	}
+	// e.g. "de_DE.UTF-8" or "sr_RS@latin"
+	if i := strings.IndexAny(locale, ".@"); i >= 0 {
+		locale = locale[:i]
+	}
+	if locale == "" || locale == "C" || locale == "POSIX" {
+		return nil
+	}
+	tag, err := language.Parse(strings.Replace(locale, "_", "-", -1))
+	if err != nil {
+		return nil
+	}
+	return collate.New(tag)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/hatchling/gdrive-dir-push/oauth"
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+// profileNameRE limits --profile names to what is safe as a directory name everywhere.
+var profileNameRE = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// checkProfileName returns an error if |name| can't name a profile.  Empty is the default profile.
+func checkProfileName(name string) error {
+	if name != "" && !profileNameRE.MatchString(name) {
+		return fmt.Errorf("--profile must only hold letters, digits, \"-\" and \"_\", not %q", name)
+	}
+	return nil
+}
+
+// profileDir returns the directory that holds the config, and by default the token, of the
+// profile |name|.  The default profile keeps them right in the default state dir, where they were
+// before there were profiles.
+func profileDir(name string) (string, error) {
+	dir, err := state.DefaultDir()
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return dir, nil
+	}
+	return filepath.Join(dir, "profiles", name), nil
+}
+
+// describeProfile prints what the profile |name| is set up with.
+func describeProfile(name string) error {
+	dir, err := profileDir(name)
+	if err != nil {
+		return err
+	}
+	values, err := readConfig(filepath.Join(dir, configFileName))
+	if err != nil {
+		return err
+	}
+	settings := make(map[string]string, len(values))
+	for _, v := range values {
+		settings[v.name] = v.value
+	}
+
+	label := name
+	if label == "" {
+		label = "(default)"
+	}
+	client := "none"
+	switch {
+	case settings["service_account_file"] != "":
+		client = "service account " + settings["service_account_file"]
+	case settings["credentials_file"] != "":
+		client = settings["credentials_file"]
+	case settings["client_id"] != "":
+		client = "client ID " + settings["client_id"]
+	}
+	token := settings["token_file"]
+	if token == "" {
+		if token, err = oauth.ProfileTokenFile(name); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(token); err == nil {
+		token += " (cached)"
+	} else {
+		token += " (missing: not authorized yet, or kept in the OS keyring)"
+	}
+	root := settings["gdrive_root_id"]
+	if root == "" {
+		root = "none"
+	}
+	fmt.Printf("%s\n  client: %s\n  token:  %s\n  root:   %s\n", label, client, token, root)
+	if local := settings["local_dir_to_push"]; local != "" {
+		fmt.Printf("  local:  %s\n", local)
+	}
+	return nil
+}
+
+// profilesCommand implements "profiles list", which shows the account profiles that init has set
+// up and what each of them uses.
+func profilesCommand(args []string) error {
+	if len(args) != 1 || args[0] != "list" {
+		return fmt.Errorf("Usage: profiles list")
+	}
+	dir, err := profileDir("")
+	if err != nil {
+		return err
+	}
+	names := []string{""}
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "profiles"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() && checkProfileName(e.Name()) == nil {
+			names = append(names, e.Name())
+		}
+	}
+	for _, name := range names {
+		if err := describeProfile(name); err != nil {
+			return fmt.Errorf("Problem reading profile %q: %v", name, err)
+		}
+	}
+	fmt.Printf("\nPick one with --profile=NAME, set up a new one with \"gdrive-dir-push --profile=NAME init\"\n")
+	return nil
+}
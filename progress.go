@@ -0,0 +1,366 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+	"github.com/hatchling/gdrive-dir-push/push"
+)
+
+var progress = flag.Bool("progress", false, "Show the uploads under way: on a terminal a progress bar per upload and a totals line with the speed and time left kept up to date below the status lines, else a batch of lines on stderr every few seconds")
+
+// How often --progress redraws on a terminal, and prints a batch of lines otherwise.  Batches
+// only show uploads that have been going for a whole interval, so that quick ones stay quiet.
+const (
+	progressRedraw   = 200 * time.Millisecond
+	progressInterval = 5 * time.Second
+)
+
+// progressPathWidth is how much of the path of an upload --progress shows, lines that wrap would
+// throw off redrawing in place.  progressBarWidth is the width of its bar.
+const (
+	progressPathWidth = 40
+	progressBarWidth  = 20
+)
+
+// progressSpeedWindow is how far back --progress looks to tell the current speed.
+const progressSpeedWindow = 10 * time.Second
+
+// sample is how many bytes were sent by a point in time.
+type sample struct {
+	at   time.Time
+	sent int64
+}
+
+// transfer is an upload under way.
+type transfer struct {
+	op    push.Op
+	sent  int64
+	start time.Time
+}
+
+// textProgress is the push.Listener of --progress.  The status lines of the push report what was
+// done, it fills in what is being done.  With |live| set the display is kept below the status
+// lines on stdout, which statusLine prints through printStatus to make room.
+type textProgress struct {
+	push.NopListener
+	live bool
+
+	mu       sync.Mutex
+	active   []*transfer
+	done     int
+	sent     int64 // bytes of the uploads that completed
+	expected int64 // bytes of the uploads queued, under way or completed, for the time left
+	samples  []sample
+	start    time.Time
+	drawn    int           // lines of the live display on screen
+	stop     chan struct{} // closes to stop the ticker, nil while it isn't running
+}
+
+// display is the live --progress display, if any.
+var display *textProgress
+
+func newTextProgress() *textProgress {
+	fi, err := os.Stdout.Stat()
+	t := &textProgress{live: err == nil && fi.Mode()&os.ModeCharDevice != 0}
+	if t.live {
+		display = t
+	}
+	return t
+}
+
+// OnFileQueued counts the upload of |op|, just queued, in the time left.
+func (t *textProgress) OnFileQueued(op push.Op) {
+	t.mu.Lock()
+	t.expected += op.Size
+	t.mu.Unlock()
+}
+
+func (t *textProgress) OnFileStart(op push.Op) {
+	if op.Kind == push.CreateFolder {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.start.IsZero() {
+		t.start = now
+	}
+	t.active = append(t.active, &transfer{op: op, start: now})
+	if t.stop == nil {
+		// Tick only while there are uploads to show
+		t.stop = make(chan struct{})
+		go t.tick(t.stop)
+	}
+}
+
+func (t *textProgress) OnFileProgress(op push.Op, sent int64) {
+	t.mu.Lock()
+	if tr := t.find(op.Path); tr != nil {
+		tr.sent = sent
+	}
+	t.mu.Unlock()
+}
+
+func (t *textProgress) OnFileDone(op push.Op) {
+	if op.Kind != push.Relocate {
+		t.finish(op, true)
+	}
+}
+
+func (t *textProgress) OnError(op push.Op, err error) {
+	t.finish(op, false)
+}
+
+// find returns the upload of |path| under way, or nil.
+func (t *textProgress) find(path string) *transfer {
+	for _, tr := range t.active {
+		if tr.op.Path == path {
+			return tr
+		}
+	}
+	return nil
+}
+
+// finish removes the upload of |op| from the display, counting it in the totals if |ok|.
+func (t *textProgress) finish(op push.Op, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, tr := range t.active {
+		if tr.op.Path == op.Path {
+			t.active = append(t.active[:i], t.active[i+1:]...)
+			break
+		}
+	}
+	if ok && op.Kind != push.CreateFolder {
+		t.done++
+		t.sent += op.Size
+	} else if !ok {
+		t.expected -= op.Size
+	}
+	if len(t.active) == 0 && t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+		t.clear()
+	}
+}
+
+// tick redraws the display, or prints a batch of lines, until |stop| closes.
+func (t *textProgress) tick(stop chan struct{}) {
+	interval := progressInterval
+	if t.live {
+		interval = progressRedraw
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			t.mu.Lock()
+			t.sample()
+			if t.live {
+				t.clear()
+				t.draw()
+			} else {
+				t.batch()
+			}
+			t.mu.Unlock()
+		}
+	}
+}
+
+// total returns the bytes sent so far, by the uploads that completed and those under way.
+func (t *textProgress) total() int64 {
+	sent := t.sent
+	for _, tr := range t.active {
+		sent += tr.sent
+	}
+	return sent
+}
+
+// sample notes how much was sent by now, forgetting what is past progressSpeedWindow.
+func (t *textProgress) sample() {
+	now := time.Now()
+	t.samples = append(t.samples, sample{at: now, sent: t.total()})
+	for len(t.samples) > 2 && now.Sub(t.samples[0].at) > progressSpeedWindow {
+		t.samples = t.samples[1:]
+	}
+}
+
+// speed returns the bytes sent per second over the last progressSpeedWindow, or since the start
+// until there is enough to tell.
+func (t *textProgress) speed(now time.Time) float64 {
+	if len(t.samples) >= 2 {
+		first, last := t.samples[0], t.samples[len(t.samples)-1]
+		if d := last.at.Sub(first.at).Seconds(); d > 0 {
+			return float64(last.sent-first.sent) / d
+		}
+	}
+	return float64(t.total()) / now.Sub(t.start).Seconds()
+}
+
+// bar returns a progress bar for |pct| percent.
+func bar(pct int64) string {
+	full := int(pct) * progressBarWidth / 100
+	if full > progressBarWidth {
+		full = progressBarWidth
+	}
+	b := strings.Repeat("=", full)
+	if full < progressBarWidth {
+		b += ">" + strings.Repeat(" ", progressBarWidth-full-1)
+	}
+	return "[" + b + "]"
+}
+
+// lines returns the display: a line per upload under way that has been going for at least
+// |minAge|, then the totals.
+func (t *textProgress) lines(minAge time.Duration) []string {
+	var lines []string
+	now := time.Now()
+	for _, tr := range t.active {
+		if now.Sub(tr.start) < minAge {
+			continue
+		}
+		path := "/" + tr.op.Path
+		if len(path) > progressPathWidth {
+			path = "..." + path[len(path)-progressPathWidth+3:]
+		}
+		pct := int64(100)
+		if tr.op.Size > 0 {
+			pct = tr.sent * 100 / tr.op.Size
+		}
+		rate := float64(tr.sent) / now.Sub(tr.start).Seconds()
+		lines = append(lines, fmt.Sprintf("  %-*s %s %3d%% %s of %s, %s/s", progressPathWidth, path, bar(pct), pct,
+			humanize.Bytes(uint64(tr.sent)), humanize.Bytes(uint64(tr.op.Size)), humanize.Bytes(uint64(rate))))
+	}
+	sent := t.total()
+	rate := t.speed(now)
+	totals := fmt.Sprintf("  %d uploading, %d done, %s of %s queued sent, %s/s", len(t.active), t.done,
+		humanize.Bytes(uint64(sent)), humanize.Bytes(uint64(t.expected)), humanize.Bytes(uint64(rate)))
+	if left := t.expected - sent; left > 0 && rate > 0 {
+		eta := time.Duration(float64(left) / rate * float64(time.Second))
+		totals += fmt.Sprintf(", %v left", eta.Round(time.Second))
+	}
+	return append(lines, totals)
+}
+
+// draw shows the live display below the status lines.
+func (t *textProgress) draw() {
+	lines := t.lines(0)
+	for _, line := range lines {
+		fmt.Printf("%s\n", line)
+	}
+	t.drawn = len(lines)
+}
+
+// clear removes the live display from the terminal, leaving the cursor where it began.
+func (t *textProgress) clear() {
+	if t.drawn > 0 {
+		fmt.Printf("\033[%dA\033[J", t.drawn)
+		t.drawn = 0
+	}
+}
+
+// batch prints the uploads that have been going for a while and the totals to stderr.
+func (t *textProgress) batch() {
+	lines := t.lines(progressInterval)
+	if len(lines) > 1 {
+		for _, line := range lines {
+			fmt.Fprintf(os.Stderr, "%s\n", line)
+		}
+	}
+}
+
+// printStatus prints |text|, a status line, above the live --progress display if there is one.
+func printStatus(text string) {
+	if *pager {
+		paged.add(text)
+		return
+	}
+	if display == nil {
+		fmt.Print(text)
+		return
+	}
+	display.mu.Lock()
+	defer display.mu.Unlock()
+	redraw := display.drawn > 0
+	display.clear()
+	fmt.Print(text)
+	if redraw {
+		display.draw()
+	}
+}
+
+// listenerList passes everything on to each of its listeners, for when --progress and
+// --output=ndjson both want to hear how a push goes.
+type listenerList []push.Listener
+
+// listener returns the push.Listener of the list, nil if it's empty.
+func (l listenerList) listener() push.Listener {
+	switch len(l) {
+	case 0:
+		return nil
+	case 1:
+		return l[0]
+	}
+	return l
+}
+
+func (l listenerList) OnScan(tree *directory_tree.Node, took time.Duration) {
+	for _, each := range l {
+		each.OnScan(tree, took)
+	}
+}
+
+func (l listenerList) OnFileQueued(op push.Op) {
+	for _, each := range l {
+		each.OnFileQueued(op)
+	}
+}
+
+func (l listenerList) OnFileStart(op push.Op) {
+	for _, each := range l {
+		each.OnFileStart(op)
+	}
+}
+
+func (l listenerList) OnFileProgress(op push.Op, sent int64) {
+	for _, each := range l {
+		each.OnFileProgress(op, sent)
+	}
+}
+
+func (l listenerList) OnFileDone(op push.Op) {
+	for _, each := range l {
+		each.OnFileDone(op)
+	}
+}
+
+func (l listenerList) OnError(op push.Op, err error) {
+	for _, each := range l {
+		each.OnError(op, err)
+	}
+}
+
+func (l listenerList) OnSummary(s push.Summary) {
+	for _, each := range l {
+		each.OnSummary(s)
+	}
+}
+
+// statusWriter is the Output of the Pushers, it prints what they write through printStatus.
+type statusWriter struct{}
+
+func (statusWriter) Write(b []byte) (int, error) {
+	printStatus(string(b))
+	return len(b), nil
+}
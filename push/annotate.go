@@ -0,0 +1,93 @@
+package push
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/state"
+	"github.com/hatchling/try"
+)
+
+// statusFileTitle is the file --annotate=status_file keeps up to date in the root folder.
+const statusFileTitle = "STATUS.md"
+
+// runSummary renders |r| for people looking at the root folder in GDrive.
+func runSummary(r *state.Run) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("Last push by gdrive-dir-push: %s\n\n"+
+		"- Finished: %s (took %v)\n"+
+		"- Source: %s:%s\n"+
+		"- %d folders created, %d files uploaded, %d replaced, %s uploaded\n",
+		r.Result, r.End.Format(time.RFC1123), r.End.Sub(r.Start).Round(time.Second), host, r.LocalDir,
+		r.FoldersCreated, r.FilesUploaded, r.FilesReplaced, humanize.Bytes(uint64(r.BytesUploaded)))
+}
+
+// annotateRoot tells collaborators looking at the GDrive folder |rootID| how the push |r| went,
+// so they can see how fresh the folder is without access to the logs: either as a comment on the
+// folder or by rewriting a STATUS.md file in it.
+func (p *Pusher) annotateRoot(ctx context.Context, r *state.Run, rootID string) error {
+	summary := runSummary(r)
+	if err := p.ops.take(callUpdate); err != nil {
+		return err
+	}
+	slog.Debug("annotateRoot", "root", rootID, "template", p.opts.Annotate)
+
+	if p.opts.Annotate == "comment" {
+		// Wrap in a simple retry loop since Drive can be unreliable.
+		if err := try.Do(func(attempt int) (bool, error) {
+			p.countCall(ctx, callComment)
+			_, err := p.drv.Comments.Insert(rootID, &drive.Comment{Content: summary}).Context(ctx).Do()
+			if err != nil {
+				log.Print(err)
+			}
+			return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+		}); err != nil {
+			return fmt.Errorf("A comments Insert() error occurred: %v", err)
+		}
+		return nil
+	}
+
+	remote, err := p.indexFolder(ctx, rootID)
+	if err != nil {
+		return fmt.Errorf("Problem listing GDrive folder: %v", err)
+	}
+	existing := remote.named(statusFileTitle)
+	p.forgetListings(rootID)
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	if err := try.Do(func(attempt int) (bool, error) {
+		var err error
+		media := strings.NewReader(summary)
+		if existing != nil {
+			p.countCall(ctx, callUpdate)
+			_, err = p.drv.Files.Update(existing.Id, &drive.File{}).Media(media).Context(ctx).Do()
+		} else {
+			p.countCall(ctx, callMultipart)
+			_, err = p.drv.Files.Insert(&drive.File{
+				Title:    statusFileTitle,
+				MimeType: "text/markdown",
+				Parents: []*drive.ParentReference{
+					&drive.ParentReference{Id: rootID},
+				},
+			}).Media(media).Context(ctx).Do()
+		}
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return fmt.Errorf("A status file upload error occurred: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package push
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+	"github.com/hatchling/gdrive-dir-push/state"
+	"github.com/hatchling/try"
+)
+
+// Context returns a context derived from |ctx| that is cancelled once the Pusher used up
+// Options.MaxOps or --max_ops_per_day, so that the commands run with it stop promptly.
+func (p *Pusher) Context(ctx context.Context) (context.Context, context.CancelFunc) {
+	return p.ops.watch(ctx)
+}
+
+// Apply pushes Options.LocalDir to Options.RootID, or only plans to with Options.DryRun.  What it
+// learns is kept in the sync state even when it fails, which it does with ErrInterrupted once
+// Options.Stop is closed.  Local files that changed while Options.Immutable is set are left
+// untouched and listed in the Summary without failing the push.
+func (p *Pusher) Apply(ctx context.Context) error {
+	if err := p.opts.Check(); err != nil {
+		return err
+	}
+	ctx, cancel := p.Context(ctx)
+	defer cancel()
+	p.reset()
+	p.start = time.Now()
+	p.result = nil
+	st := p.st
+
+	var journaled []string
+	var journalEnd time.Time
+	if p.opts.Journal != "" {
+		var err error
+		if journaled, journalEnd, err = p.journalPaths(st.JournalSynced); err != nil {
+			return fmt.Errorf("Problem reading --journal: %v", err)
+		}
+		if len(journaled) == 0 {
+			p.printf("Nothing was written since the last --journal replay\n")
+			if !p.opts.DryRun {
+				st.JournalSynced = journalEnd
+			}
+			return nil
+		}
+	}
+
+	p.printf("Pushing contents of %q to GDrive folder %q\n\n", p.opts.LocalDir, p.opts.RootID)
+	p.printf("%v\n", p.start)
+	if p.opts.Journal != "" || p.opts.DirsOnly {
+		// Only part of the tree is pushed, what the rest synced to still holds
+		for relName, e := range st.Snapshot {
+			p.snapshot[relName] = e
+		}
+	}
+
+	// Find the real ID of the provided folder
+	if p.opts.Offline {
+		p.rootID = p.offlineRootID()
+	} else {
+		if err := p.connect(ctx); err != nil {
+			return fmt.Errorf("Problem creating Drive client: %v", err)
+		}
+		rootID, err := p.resolveRoot(ctx)
+		if err != nil {
+			return fmt.Errorf("Problem with --gdrive_root_id: %v", err)
+		}
+		st.ResolvedRootID = rootID
+		p.rootID = rootID
+	}
+	release, err := p.takeFsSnapshot()
+	if err != nil {
+		return fmt.Errorf("Problem with --snapshot_cmd: %v", err)
+	}
+	defer release()
+
+	tree, err := p.scan(ctx, journaled)
+	if err != nil {
+		return err
+	}
+	syncErr := p.walk(ctx, tree)
+	if syncErr == nil && p.stopping() {
+		syncErr = ErrInterrupted
+	}
+	if err := DailyOpsExhausted(); err != nil {
+		// What failed was cancelled because of it
+		syncErr = err
+	}
+	p.resumeLog.finish(syncErr == nil)
+	p.resumeLog = nil
+	if syncErr == nil && !p.opts.DryRun {
+		p.recordSynced(tree, ".", tree.DriveID)
+		st.Snapshot = p.snapshot
+		if p.opts.Journal != "" {
+			st.JournalSynced = journalEnd
+		}
+	}
+	p.markDrift(ctx)
+	s := p.summary(syncErr)
+	p.result = &s
+	p.opts.Listener.OnSummary(s)
+	if syncErr != nil {
+		return syncErr
+	}
+	p.tree = tree
+
+	if p.opts.StarRoot {
+		if err := p.starFolder(ctx, p.rootID); err != nil {
+			p.printf("Problem starring --gdrive_root_id: %v\n", err)
+		}
+	}
+	if p.opts.Manifest != "" && !p.opts.DryRun {
+		link, err := p.writeManifest(ctx, p.start, tree.DriveID)
+		if err != nil {
+			return fmt.Errorf("Problem writing --manifest: %v", err)
+		}
+		if link != "" {
+			p.printf("Manifest: %s\n", link)
+		}
+	}
+	return nil
+}
+
+// scan reads the local tree to push, limited to the |journaled| paths if any, checks it against
+// the limits of GDrive and gets everything the walk needs ready.
+func (p *Pusher) scan(ctx context.Context, journaled []string) (*directory_tree.Node, error) {
+	filter := p.journalFilter(journaled)
+	scanStart := time.Now()
+	tree, err := directory_tree.NewTreeFS(p.sourceFS(), ".", p.opts.LocalDir, filter)
+	if err != nil {
+		return nil, fmt.Errorf("Problem creating directory_tree: %v", err)
+	}
+	p.opts.Listener.OnScan(tree, time.Since(scanStart))
+	tree.DriveID = p.rootID
+	if err := p.checkSource(tree, filter != nil && len(filter.Only) > 0); err != nil {
+		return nil, err
+	}
+	// Find clashing titles before anything is written
+	p.applyPolicies(tree)
+	if err := p.checkPathLimits(tree); err != nil {
+		return nil, err
+	}
+	if err := p.checkNameCollisions(tree); err != nil {
+		return nil, err
+	}
+	if !p.opts.Offline {
+		if err := p.checkDrift(ctx, tree, p.rootID); err != nil {
+			return nil, fmt.Errorf("Problem with --drift: %v", err)
+		}
+		if p.opts.RemoteChanges {
+			if err := p.followChanges(ctx); err != nil {
+				return nil, fmt.Errorf("Problem with --remote_changes: %v", err)
+			}
+		}
+	}
+	if p.opts.WarmStart {
+		if err := p.seedSnapshot(ctx, tree, p.rootID); err != nil {
+			return nil, fmt.Errorf("Problem with --warm_start: %v", err)
+		}
+	}
+	if p.opts.PartialName != "" && !p.opts.DryRun {
+		if err := p.cleanPartials(ctx); err != nil {
+			return nil, fmt.Errorf("Problem cleaning up partial uploads: %v", err)
+		}
+	}
+	logPath := resumeLogPath(p.st.Path())
+	if p.opts.Resume {
+		entries, err := readResumeLog(logPath)
+		if err != nil {
+			return nil, fmt.Errorf("Problem reading resume log: %v", err)
+		}
+		if len(entries) == 0 {
+			p.printf("No interrupted push to resume, pushing from scratch\n\n")
+		} else {
+			p.seedResume(entries)
+		}
+	}
+	if !p.opts.DryRun {
+		if p.resumeLog, err = openResumeLog(logPath, p.opts.Resume); err != nil {
+			return nil, fmt.Errorf("Problem opening resume log: %v", err)
+		}
+	}
+	return tree, nil
+}
+
+// walk compares |tree| with GDrive and applies the differences, the way Options ask for.
+func (p *Pusher) walk(ctx context.Context, tree *directory_tree.Node) error {
+	switch {
+	case p.opts.Staged:
+		return p.pushStaged(ctx, tree, tree.DriveID)
+	case p.opts.PrecreateFolders > 0 && !p.opts.DryRun:
+		if err := p.precreateFolders(ctx, tree); err != nil {
+			return err
+		}
+	}
+	return p.processNode(ctx, tree)
+}
+
+// summary returns the totals of the push, which ended with |err|.
+func (p *Pusher) summary(err error) Summary {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := Summary{
+		FoldersCreated: p.stats.foldersCreated,
+		FilesUploaded:  p.stats.filesUploaded,
+		FilesReplaced:  p.stats.filesReplaced,
+		FilesCopied:    p.stats.filesCopied,
+		FilesRelocated: p.stats.filesRelocated,
+		FilesUnchanged: p.stats.filesUnchanged,
+		BytesUploaded:  p.stats.bytesUploaded,
+		Duration:       time.Since(p.start),
+		Failures:       append([]Failure(nil), p.failures...),
+		Err:            err,
+	}
+	for _, relName := range p.violations {
+		s.Violations = append(s.Violations, filepath.ToSlash(EscapeName(relName)))
+	}
+	return s
+}
+
+// Plan works out what Apply would do, without writing anything to GDrive.
+func (p *Pusher) Plan(ctx context.Context) (*Plan, error) {
+	dryRun := p.opts.DryRun
+	p.opts.DryRun = true
+	defer func() { p.opts.DryRun = dryRun }()
+	if err := p.Apply(ctx); err != nil {
+		return nil, err
+	}
+	p.plan.Unchanged = p.Summary().FilesUnchanged
+	return p.plan, nil
+}
+
+// Summary returns the totals of the last push, which are zero if it failed or had nothing to do
+// before walking the local tree.
+func (p *Pusher) Summary() Summary {
+	if p.result == nil {
+		return Summary{}
+	}
+	return *p.result
+}
+
+// SaveState saves the sync state, which is safe to do while the push goes on, e.g. before
+// re-authorizing.
+func (p *Pusher) SaveState() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.st.Save()
+}
+
+// Annotate tells collaborators looking at the GDrive folder pushed to how the push recorded as
+// |r| went, with Options.Annotate.
+func (p *Pusher) Annotate(ctx context.Context, r *state.Run) error {
+	if p.opts.Annotate == "" || p.opts.DryRun || p.rootID == "" {
+		return nil
+	}
+	return p.annotateRoot(ctx, r, p.rootID)
+}
+
+// PrintTotals writes the API usage, the file types and the storage the last push added to
+// Options.Output, and for a dry run the plan and how long pushing would take.
+func (p *Pusher) PrintTotals() {
+	usage.print(p.opts.Output)
+	p.uploadTypes.print(p.opts.Output)
+	if !p.opts.DryRun {
+		p.storage.print(p.opts.Output, p.history(), p.quota)
+	}
+	p.ops.print(p.opts.Output)
+	if p.opts.DryRun {
+		p.printf("\nDry run, nothing was written to GDrive\n")
+		p.plan.print(p.opts.Output)
+		p.printEstimate()
+	}
+}
+
+// PrintInterrupted reports what the last push got done before it was interrupted, and how to
+// pick up from there.
+func (p *Pusher) PrintInterrupted() {
+	s := p.Summary()
+	p.printf("\nInterrupted after %v: %d folder(s) created, %d file(s) uploaded (%d replaced, %s), %d unchanged\n",
+		s.Duration.Round(time.Second), s.FoldersCreated, s.FilesUploaded, s.FilesReplaced,
+		humanize.Bytes(uint64(s.BytesUploaded)), s.FilesUnchanged)
+	p.uploadTypes.print(p.opts.Output)
+	p.storage.print(p.opts.Output, p.history(), p.quota)
+	p.printf("Run the same command again with --resume to pick up where this one stopped\n")
+}
+
+// User returns the account Drive requests are made as, nil if Drive doesn't say.
+func (p *Pusher) User(ctx context.Context) (*drive.User, error) {
+	if err := p.connect(ctx); err != nil {
+		return nil, err
+	}
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	var about *drive.About
+	if err := try.Do(func(attempt int) (bool, error) {
+		var err error
+		p.countCall(ctx, callAbout)
+		about, err = p.drv.About.Get().Fields("user").Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return nil, fmt.Errorf("An About.Get() error occurred: %v", err)
+	}
+	return about.User, nil
+}
+
+// RootTitle checks that Options.RootID is a folder that can be pushed to and returns its title.
+func (p *Pusher) RootTitle(ctx context.Context) (string, error) {
+	if err := p.connect(ctx); err != nil {
+		return "", err
+	}
+	rootID, err := p.resolveRoot(ctx)
+	if err != nil {
+		return "", err
+	}
+	f, err := p.getFile(ctx, rootID)
+	if err != nil {
+		return "", err
+	}
+	return f.Title, nil
+}
@@ -0,0 +1,229 @@
+package push
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// OpenArchive returns the contents of the .zip, .tar, .tar.gz or .tgz file at |name| as a file
+// system, so that they can be pushed as they are laid out in the archive without extracting it.
+func OpenArchive(name string) (fs.FS, error) {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return zip.OpenReader(name)
+	case strings.HasSuffix(lower, ".tar"):
+		return openTar(name, false)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return openTar(name, true)
+	}
+	return nil, fmt.Errorf("Unsupported archive %q, expected .zip, .tar, .tar.gz or .tgz", name)
+}
+
+// tarFS serves the regular files and directories of a tar archive.  The archive is indexed once;
+// file contents are then streamed from it on demand.  Plain tars are read from the offset of each
+// entry, while compressed ones have to be decompressed from the start up to the entry opened.
+type tarFS struct {
+	f          *os.File
+	compressed bool
+	entries    map[string]*tarEntry
+}
+
+// tarEntry is a file or directory in a tarFS.
+type tarEntry struct {
+	info     fs.FileInfo
+	index    int   // of the header in the archive
+	offset   int64 // of the contents in a plain tar
+	children []fs.DirEntry
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// tarName turns the name of a tar entry into a path in the file system, "" if it has none.
+func tarName(name string) string {
+	name = path.Clean("/" + strings.TrimPrefix(name, "./"))[1:]
+	if !fs.ValidPath(name) {
+		return ""
+	}
+	return name
+}
+
+// tarReader returns a reader of the tar file |f|, through gzip if |compressed|.
+func tarReader(f io.Reader, compressed bool) (*tar.Reader, error) {
+	if !compressed {
+		return tar.NewReader(f), nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return tar.NewReader(zr), nil
+}
+
+// openTar indexes the tar file |name|, which is gzip compressed if |compressed|.
+func openTar(name string, compressed bool) (*tarFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	t := &tarFS{f: f, compressed: compressed, entries: make(map[string]*tarEntry)}
+	cr := &countingReader{r: f}
+	tr, err := tarReader(cr, compressed)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Problem reading %q: %v", name, err)
+	}
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Problem reading %q: %v", name, err)
+		}
+		entryName := tarName(hdr.Name)
+		if entryName == "" {
+			continue
+		}
+		// Links, devices and the like have no content to push.  Like extracting would, later
+		// entries replace earlier ones of the same name.
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeRegA:
+			t.entries[entryName] = &tarEntry{info: hdr.FileInfo(), index: index, offset: cr.n}
+		}
+	}
+
+	// Directories without an entry of their own get the archive's time
+	var dir func(name string) *tarEntry
+	dir = func(name string) *tarEntry {
+		e, ok := t.entries[name]
+		if !ok {
+			e = &tarEntry{info: (&tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755, ModTime: fi.ModTime()}).FileInfo()}
+			t.entries[name] = e
+			if name != "." {
+				parent := dir(path.Dir(name))
+				parent.children = append(parent.children, fs.FileInfoToDirEntry(e.info))
+			}
+		}
+		return e
+	}
+	dir(".")
+	names := make([]string, 0, len(t.entries))
+	for entryName := range t.entries {
+		names = append(names, entryName)
+	}
+	sort.Strings(names)
+	for _, entryName := range names {
+		if entryName != "." {
+			parent := dir(path.Dir(entryName))
+			parent.children = append(parent.children, fs.FileInfoToDirEntry(t.entries[entryName].info))
+		}
+	}
+	return t, nil
+}
+
+// Open implements fs.FS.
+func (t *tarFS) Open(name string) (fs.File, error) {
+	e, ok := t.entries[name]
+	if !fs.ValidPath(name) || !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if e.info.IsDir() {
+		return &tarDir{info: e.info, children: e.children}, nil
+	}
+	if !t.compressed {
+		return &tarFile{info: e.info, r: io.NewSectionReader(t.f, e.offset, e.info.Size())}, nil
+	}
+
+	f, err := os.Open(t.f.Name())
+	if err != nil {
+		return nil, err
+	}
+	tr, err := tarReader(f, true)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	for index := 0; index <= e.index; index++ {
+		if _, err := tr.Next(); err != nil {
+			f.Close()
+			if err == io.EOF {
+				err = fs.ErrNotExist
+			}
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	return &tarFile{info: e.info, r: tr, closer: f}, nil
+}
+
+// tarFile is a file opened from a tarFS.
+type tarFile struct {
+	info   fs.FileInfo
+	r      io.Reader
+	closer io.Closer
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *tarFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+
+func (f *tarFile) Close() error {
+	if f.closer == nil {
+		return nil
+	}
+	return f.closer.Close()
+}
+
+// tarDir is a directory opened from a tarFS.
+type tarDir struct {
+	info     fs.FileInfo
+	children []fs.DirEntry
+	read     int
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *tarDir) Close() error               { return nil }
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: fs.ErrInvalid}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.children[d.read:]
+	if n <= 0 {
+		d.read = len(d.children)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.read += n
+	return rest[:n], nil
+}
@@ -0,0 +1,162 @@
+package push
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"path"
+	"strings"
+
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/try"
+)
+
+// listPermissions returns who has access to the GDrive item |fileID|.
+func (p *Pusher) listPermissions(ctx context.Context, fileID string) ([]*drive.Permission, error) {
+	slog.Debug("listPermissions", "id", fileID)
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	var r *drive.PermissionList
+	if err := try.Do(func(attempt int) (bool, error) {
+		var err error
+		p.countCall(ctx, callPermissions)
+		r, err = p.drv.Permissions.List(fileID).Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return nil, fmt.Errorf("A Permissions.List() error occurred: %v", err)
+	}
+	return r.Items, nil
+}
+
+// grantee describes who |perm| gives access to.
+func grantee(perm *drive.Permission) string {
+	switch perm.Type {
+	case "anyone":
+		if perm.WithLink {
+			return "anyone with the link"
+		}
+		return "anyone"
+	case "domain":
+		return "everyone at " + perm.Domain
+	}
+	if perm.EmailAddress != "" {
+		return perm.Type + " " + perm.EmailAddress
+	}
+	return perm.Type + " " + perm.Name
+}
+
+// tooBroad reports whether |perm| shares more broadly than --audit_allow_anyone and
+// --audit_allowed_domains allow.  Owners are never flagged.
+func (p *Pusher) tooBroad(perm *drive.Permission) bool {
+	if perm.Role == "owner" {
+		return false
+	}
+	var allowed []string
+	for _, domain := range strings.Split(p.opts.AuditAllowedDomains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			allowed = append(allowed, strings.ToLower(domain))
+		}
+	}
+	inAllowed := func(domain string) bool {
+		for _, a := range allowed {
+			if strings.ToLower(domain) == a {
+				return true
+			}
+		}
+		return false
+	}
+	switch perm.Type {
+	case "anyone":
+		return !p.opts.AuditAllowAnyone
+	case "domain":
+		return !inAllowed(perm.Domain)
+	}
+	if len(allowed) == 0 {
+		return false
+	}
+	at := strings.LastIndex(perm.EmailAddress, "@")
+	return at < 0 || !inAllowed(perm.EmailAddress[at+1:])
+}
+
+// AuditPerms implements "audit-perms", which lists who can see what under Options.RootID without
+// changing anything.  Items only show the permissions that weren't already on their folder, which
+// is what was shared on them rather than inherited.  Permissions broader than the policy are
+// marked "!" and make the command fail.
+func (p *Pusher) AuditPerms(ctx context.Context) error {
+	if err := p.connect(ctx); err != nil {
+		return err
+	}
+	rootID, err := p.resolveRoot(ctx)
+	if err != nil {
+		return fmt.Errorf("Problem with --gdrive_root_id: %v", err)
+	}
+	p.printf("Auditing permissions under GDrive folder %q\n\n", p.opts.RootID)
+
+	var items, flagged int
+	// audit reports the permissions of |id|, known as |relName|, that |inherited| doesn't have and
+	// returns all of them.
+	audit := func(id, relName string, inherited map[string]bool) (map[string]bool, error) {
+		perms, err := p.listPermissions(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("Problem listing permissions of %q: %v", relName, err)
+		}
+		items++
+		all := make(map[string]bool, len(perms))
+		for _, perm := range perms {
+			all[perm.Id] = true
+			if inherited[perm.Id] {
+				continue
+			}
+			statusPrefix := " "
+			if p.tooBroad(perm) {
+				statusPrefix = "!"
+				flagged++
+			}
+			p.printf("%s /%s  %s: %s\n", statusPrefix, relName, perm.Role, grantee(perm))
+		}
+		return all, nil
+	}
+
+	var walk func(folderID, relDir string, inherited map[string]bool) error
+	walk = func(folderID, relDir string, inherited map[string]bool) error {
+		children, err := p.listQuery(ctx, fmt.Sprintf("'%s' in parents and trashed=false", folderID))
+		if err != nil {
+			return fmt.Errorf("Problem listing GDrive folder %q: %v", relDir, err)
+		}
+		for _, child := range children {
+			relName := path.Join(relDir, child.Title)
+			if child.MimeType == folderMimeType {
+				relName += "/"
+			}
+			perms, err := audit(child.Id, relName, inherited)
+			if err != nil {
+				return err
+			}
+			if child.MimeType == folderMimeType {
+				if err := walk(child.Id, relName, perms); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	perms, err := audit(rootID, "", nil)
+	if err != nil {
+		return err
+	}
+	if err := walk(rootID, "", perms); err != nil {
+		return err
+	}
+
+	p.printf("\nAudited %d item(s)\n", items)
+	usage.print(p.opts.Output)
+	if flagged > 0 {
+		return fmt.Errorf("%d permission(s) share more broadly than --audit_allowed_domains and --audit_allow_anyone allow", flagged)
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package push
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+// bisyncStats counts what a two-way sync did.
+type bisyncStats struct {
+	uploaded, downloaded, deleted int
+	conflicts                     []string
+}
+
+// localChanged reports whether the local file |l| differs from the last synced state |snap|.
+// Files whose size and mtime still match are assumed unchanged, others are hashed so that a mere
+// touch isn't taken for a change.
+func (p *Pusher) localChanged(l *directory_tree.Node, relName string, snap *state.SnapshotEntry) (bool, error) {
+	if l.Info.Size == snap.Size && l.Info.ModTime.Equal(snap.ModTime) {
+		return false, nil
+	}
+	if snap.MD5 == "" {
+		return true, nil
+	}
+	sum, err := p.hashFile(l, relName)
+	if err != nil {
+		return false, err
+	}
+	return sum != snap.MD5, nil
+}
+
+// remoteChanged reports whether the GDrive file |r| differs from the last synced state |snap|.
+func remoteChanged(r *drive.File, snap *state.SnapshotEntry) bool {
+	return r.Id != snap.DriveID || (snap.MD5 != "" && r.Md5Checksum != snap.MD5)
+}
+
+// pulledNode returns a node for the local file at |path| as it is after a download of the GDrive
+// file |r|, and caches its hash, which is known to be that of |r|.
+func (p *Pusher) pulledNode(path, relName string, r *drive.File) (*directory_tree.Node, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	node := &directory_tree.Node{
+		FullPath: path,
+		Info: &directory_tree.FileInfo{
+			Name:    fi.Name(),
+			Size:    fi.Size(),
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime(),
+			IsDir:   fi.IsDir(),
+		},
+		DriveID: r.Id,
+	}
+	p.st.Hashes[relName] = &state.HashEntry{Size: fi.Size(), ModTime: fi.ModTime(), MD5: r.Md5Checksum}
+	return node, nil
+}
+
+// bisyncFolder reconciles the local directory |node| with the GDrive folder |folderID| in both
+// directions, using the snapshot of the last sync to tell which side changed.  Files changed on
+// both sides since then are reported as conflicts and left alone on both.  |relDir| is the path of
+// both below their roots.
+func (p *Pusher) bisyncFolder(ctx context.Context, node *directory_tree.Node, folderID, relDir string, stats *bisyncStats) error {
+	// List the whole folder afresh, out of --remote_scope and saved listings: an item either left
+	// out would look deleted in GDrive and be deleted locally.
+	items, err := p.listQuery(ctx, fmt.Sprintf("'%s' in parents and trashed=false", folderID))
+	if err != nil {
+		return fmt.Errorf("Problem listing GDrive folder: %v", err)
+	}
+	// What --exclude and the like leave out locally is neither synced nor deleted
+	left := make(map[string]bool)
+	for _, name := range node.Filtered {
+		left[normalizeName(name)] = true
+	}
+	remote := make(map[string]*drive.File)
+	local := make(map[string]*directory_tree.Node)
+	var names []string
+	for _, item := range items {
+		if left[normalizeName(item.Title)] {
+			continue
+		}
+		if _, ok := localTitle(item.Title); !ok {
+			p.printf("? %s/%q (title can't be a local name, skipped)\n", EscapeName(filepath.ToSlash(relDir)), item.Title)
+			continue
+		}
+		name := normalizeName(item.Title)
+		if _, dup := remote[name]; dup {
+			p.printf("? /%s (duplicate title in GDrive, skipped)\n", EscapeName(filepath.Join(relDir, item.Title)))
+			continue
+		}
+		remote[name] = item
+		names = append(names, name)
+	}
+	for _, child := range node.Children {
+		name := normalizeName(child.Info.Name)
+		local[name] = child
+		if _, ok := remote[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	conflict := func(relName, why string, snap *state.SnapshotEntry) {
+		stats.conflicts = append(stats.conflicts, relName)
+		if snap != nil {
+			p.snapshot[relName] = snap
+		}
+		p.printf("C /%s (%s)\n", EscapeName(relName), why)
+	}
+
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		l, r := local[name], remote[name]
+		var title string
+		if l != nil {
+			title = l.Info.Name
+		} else {
+			title, _ = localTitle(r.Title)
+		}
+		relName := filepath.Join(relDir, title)
+		if skip, skipped := p.st.Skip[relName]; skipped {
+			p.printf("S /%s (skip list: %s)\n", EscapeName(relName), skip.Reason)
+			continue
+		}
+		snap := p.st.Snapshot[relName]
+		localDir := l != nil && l.Info.IsDir
+		remoteDir := r != nil && r.MimeType == folderMimeType
+
+		if r != nil && !remoteDir && strings.HasPrefix(r.MimeType, "application/vnd.google-apps.") {
+			p.printf("? /%s (%s, skipped)\n", EscapeName(relName), r.MimeType)
+			continue
+		}
+		if l != nil && r != nil && localDir != remoteDir {
+			conflict(relName, "a folder on one side and a file on the other", snap)
+			continue
+		}
+
+		if localDir || remoteDir {
+			if snap != nil && (l == nil || r == nil) {
+				// Deleting whole folders is never propagated, that is too easy to get wrong
+				p.printf("? /%s/ (deleted on one side only, left alone)\n", EscapeName(relName))
+				continue
+			}
+			statusPrefix := " "
+			if l == nil {
+				statusPrefix = "<"
+				path := filepath.Join(node.FullPath, title)
+				if !p.insideLocalDir(path) {
+					return fmt.Errorf("GDrive folder %q would be created at %q, outside --local_dir_to_push", relName, path)
+				}
+				if !p.opts.DryRun {
+					if err := os.Mkdir(path, 0755); err != nil {
+						return err
+					}
+				}
+				l = &directory_tree.Node{
+					FullPath: path,
+					Info:     &directory_tree.FileInfo{Name: title, IsDir: true, ModTime: time.Now()},
+				}
+			}
+			if r == nil {
+				statusPrefix = ">"
+				id, err := p.createFolder(ctx, l.Info.Name, relName, folderID, l.Info.ModTime)
+				if err != nil {
+					return fmt.Errorf("Problem creating GDrive folder %q: %v", relName, err)
+				}
+				r = &drive.File{Id: id}
+			}
+			p.recordSynced(l, relName, r.Id)
+			p.printf("%s /%s/\n", statusPrefix, EscapeName(relName))
+			if r.Id == "" {
+				// Only a --dry_run gets here, the folder would be empty
+				continue
+			}
+			if err := p.bisyncFolder(ctx, l, r.Id, relName, stats); err != nil {
+				return err
+			}
+			continue
+		}
+
+		lc, rc := false, false
+		if snap != nil && l != nil {
+			if lc, err = p.localChanged(l, relName, snap); err != nil {
+				return fmt.Errorf("Problem hashing local file %q: %v", relName, err)
+			}
+		}
+		if snap != nil && r != nil {
+			rc = remoteChanged(r, snap)
+		}
+
+		switch {
+		case l != nil && r != nil && (snap == nil || (lc && rc)):
+			// Both sides are new or both changed, which is fine only if they agree
+			sum, err := p.hashFile(l, relName)
+			if err != nil {
+				return fmt.Errorf("Problem hashing local file %q: %v", relName, err)
+			}
+			if sum != r.Md5Checksum {
+				conflict(relName, "changed on both sides", snap)
+				continue
+			}
+			p.recordSynced(l, relName, r.Id)
+		case l != nil && r != nil && !lc && !rc:
+			p.snapshot[relName] = snap
+		case l != nil && (r == nil && snap == nil || r != nil && lc):
+			// New or changed locally
+			if r != nil && !p.managed(r) {
+				p.printf("S /%s (GDrive file not pushed by this tool, --only_manage_own)\n", EscapeName(relName))
+				continue
+			}
+			if r != nil {
+				if err := p.relocateFile(ctx, relName, r.Id, folderID); err != nil {
+					return fmt.Errorf("Problem relocating GDrive file %q: %v", relName, err)
+				}
+			}
+			if _, err := p.hashFile(l, relName); err != nil {
+				return fmt.Errorf("Problem hashing local file %q: %v", relName, err)
+			}
+			id, err := p.createFile(ctx, l, relName, folderID, Op{})
+			if err != nil {
+				return fmt.Errorf("Problem creating Gdrive file %q: %v", relName, err)
+			}
+			p.recordSynced(l, relName, id)
+			stats.uploaded++
+			p.printf("> /%s (%s)\n", EscapeName(relName), humanize.Bytes(uint64(l.Info.Size)))
+		case r != nil && (l == nil && snap == nil || l != nil && rc):
+			// New or changed in GDrive
+			path := filepath.Join(node.FullPath, title)
+			if l != nil {
+				path = l.FullPath
+			}
+			if !p.insideLocalDir(path) {
+				return fmt.Errorf("GDrive file %q would be downloaded to %q, outside --local_dir_to_push", relName, path)
+			}
+			stats.downloaded++
+			p.printf("< /%s (%s)\n", EscapeName(relName), humanize.Bytes(uint64(r.FileSize)))
+			if p.opts.DryRun {
+				continue
+			}
+			if err := p.downloadFile(ctx, r, path); err != nil {
+				return fmt.Errorf("Problem downloading %q: %v", relName, err)
+			}
+			pulled, err := p.pulledNode(path, relName, r)
+			if err != nil {
+				return err
+			}
+			p.recordSynced(pulled, relName, r.Id)
+		case l != nil && r == nil:
+			// Deleted in GDrive since the last sync
+			if lc {
+				conflict(relName, "changed locally but deleted in GDrive", snap)
+				continue
+			}
+			stats.deleted++
+			p.printf("- /%s (deleted in GDrive, removing locally)\n", EscapeName(relName))
+			if !p.opts.DryRun {
+				if err := os.Remove(l.FullPath); err != nil {
+					return err
+				}
+			}
+		case r != nil && l == nil:
+			// Deleted locally since the last sync
+			if rc {
+				conflict(relName, "changed in GDrive but deleted locally", snap)
+				continue
+			}
+			if !p.managed(r) {
+				p.printf("S /%s (GDrive file not pushed by this tool, --only_manage_own)\n", EscapeName(relName))
+				continue
+			}
+			stats.deleted++
+			p.printf("- /%s (deleted locally, relocating to --old_files_dir)\n", EscapeName(relName))
+			if err := p.relocateFile(ctx, relName, r.Id, folderID); err != nil {
+				return fmt.Errorf("Problem relocating GDrive file %q: %v", relName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Bisync implements "bisync", a two-way sync between Options.LocalDir and Options.RootID.
+// Changes on either side since the last sync are applied to the other, including deletions of
+// files, with replaced or deleted GDrive files relocated to Options.OldFilesDir.  Files changed on
+// both sides are reported as conflicts and left alone.  The sync state is saved.
+func (p *Pusher) Bisync(ctx context.Context) error {
+	if p.opts.OldFilesDir == "" {
+		return fmt.Errorf("--old_files_dir must be provided")
+	}
+	if err := p.connect(ctx); err != nil {
+		return err
+	}
+	p.reset()
+	rootID, err := p.resolveRoot(ctx)
+	if err != nil {
+		return fmt.Errorf("Problem with --gdrive_root_id: %v", err)
+	}
+	tree, err := directory_tree.NewTreeFS(p.sourceFS(), ".", p.opts.LocalDir, p.opts.Filter)
+	if err != nil {
+		return fmt.Errorf("Problem creating directory_tree: %v", err)
+	}
+	// Files missing locally are deleted from GDrive, an unmounted volume would take everything
+	if err := p.checkSource(tree, false); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	p.printf("Syncing %q with GDrive folder %q in both directions\n\n", p.opts.LocalDir, p.opts.RootID)
+	var stats bisyncStats
+	err = p.bisyncFolder(ctx, tree, rootID, ".", &stats)
+	if err == nil && !p.opts.DryRun {
+		p.recordSynced(tree, ".", rootID)
+		p.st.Snapshot = p.snapshot
+	}
+	// What was pulled in is part of the mirror now
+	p.markDrift(ctx)
+	if serr := p.st.Save(); serr != nil {
+		log.Printf("Problem saving sync state: %v", serr)
+	}
+	if err != nil {
+		return err
+	}
+	p.printf("\nUploaded %d, downloaded %d, deleted %d, %d conflict(s)\n", stats.uploaded,
+		stats.downloaded, stats.deleted, len(stats.conflicts))
+	p.printf("Took %v\n", time.Since(start))
+	if len(stats.conflicts) > 0 {
+		return fmt.Errorf("%d file(s) changed on both sides, resolve them by hand", len(stats.conflicts))
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package push
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// errBudgetExhausted is the error given once --max_gdrive_ops write operations were made.
+var errBudgetExhausted = errors.New("--max_gdrive_ops reached")
+
+// opBudget is the paranoia failsafe behind --max_gdrive_ops.  It counts GDrive write operations
+// per kind and, once there were more than allowed, cancels the run's context so that every worker
+// stops promptly.  It is safe for concurrent use.
+type opBudget struct {
+	max   int
+	total int64
+	kinds sync.Map // kind -> *int64
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// watch returns a context derived from |ctx| that is cancelled when the budget trips.
+func (b *opBudget) watch(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	b.mu.Lock()
+	b.cancel = cancel
+	b.mu.Unlock()
+	return ctx, cancel
+}
+
+// take accounts for one write operation of |kind| (one of the Drive API methods in usage.go),
+// which must not be made if an error is returned.
+func (b *opBudget) take(kind string) error {
+	n := atomic.AddInt64(&b.total, 1)
+	c, _ := b.kinds.LoadOrStore(kind, new(int64))
+	atomic.AddInt64(c.(*int64), 1)
+	if b.max <= 0 || n <= int64(b.max) {
+		return nil
+	}
+	b.stop()
+	return fmt.Errorf("Oops, %w (%d), stopping", errBudgetExhausted, n)
+}
+
+// stop cancels the context returned by watch, so that every worker stops promptly.
+func (b *opBudget) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cancel != nil {
+		b.cancel()
+	}
+}
+
+// reset starts counting afresh for another push.
+func (b *opBudget) reset() {
+	atomic.StoreInt64(&b.total, 0)
+	b.kinds.Range(func(kind, _ interface{}) bool {
+		b.kinds.Delete(kind)
+		return true
+	})
+}
+
+// executed returns how many write operations were accounted for, per kind.
+func (b *opBudget) executed() map[string]int64 {
+	counts := make(map[string]int64)
+	b.kinds.Range(func(kind, c interface{}) bool {
+		counts[kind.(string)] = atomic.LoadInt64(c.(*int64))
+		return true
+	})
+	return counts
+}
+
+// print writes the write operations made, per kind, to |w|.
+func (b *opBudget) print(w io.Writer) {
+	counts := b.executed()
+	kinds := make([]string, 0, len(counts))
+	var total int64
+	for kind, n := range counts {
+		kinds = append(kinds, kind)
+		total += n
+	}
+	sort.Strings(kinds)
+	if b.max > 0 {
+		fmt.Fprintf(w, "Write ops: %d of %d allowed by --max_gdrive_ops\n", total, b.max)
+	} else {
+		fmt.Fprintf(w, "Write ops: %d\n", total)
+	}
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "  %-22s %d\n", kind, counts[kind])
+	}
+}
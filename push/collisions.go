@@ -0,0 +1,118 @@
+package push
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// What --name_collisions does about items that would get the same GDrive title.
+const (
+	CollisionFail   = "fail"
+	CollisionSuffix = "suffix"
+)
+
+// driveName returns the name |node| is pushed under: its local name, unless --policy compresses
+// it or --name_collisions=suffix renamed it.
+func driveName(node *directory_tree.Node) string {
+	if node.Title != "" {
+		return node.Title
+	}
+	return node.Info.Name
+}
+
+// suffixedName returns |name| with " (n)" inserted before its extension.
+func suffixedName(name string, n int) string {
+	ext := filepath.Ext(name)
+	if ext == name {
+		ext = "" // Dot files like ".profile" have no extension
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// checkNameCollisions finds the items of |tree| that would end up with the same GDrive title as a
+// sibling, or as a sibling's --sidecar, once their names are escaped and normalized.  Such items
+// would otherwise overwrite each other in GDrive.  Every clash is reported before anything is
+// written; with --name_collisions=suffix all but one of the items of each clash are then given a
+// free "name (2).ext" title, otherwise an error is returned.
+func (p *Pusher) checkNameCollisions(tree *directory_tree.Node) error {
+	var clashes int
+	var walk func(node *directory_tree.Node, relDir string)
+	walk = func(node *directory_tree.Node, relDir string) {
+		// Group the children by the title they'd get, sidecars keep theirs as they can't move
+		groups := make(map[string][]*directory_tree.Node)
+		sidecars := make(map[string]bool)
+		for _, child := range node.Children {
+			title := normalizeName(driveName(child))
+			groups[title] = append(groups[title], child)
+			if p.opts.Sidecar && !child.Info.IsDir {
+				sidecars[normalizeName(driveName(child)+SidecarSuffix)] = true
+			}
+		}
+		taken := make(map[string]bool, len(groups)+len(sidecars))
+		for title := range groups {
+			taken[title] = true
+		}
+		for title := range sidecars {
+			taken[title] = true
+		}
+
+		titles := make([]string, 0, len(groups))
+		for title, group := range groups {
+			if len(group) > 1 || sidecars[title] {
+				titles = append(titles, title)
+			}
+		}
+		sort.Strings(titles)
+		for _, title := range titles {
+			group := groups[title]
+			sort.Slice(group, func(i, j int) bool { return group[i].Info.Name < group[j].Info.Name })
+			clashes++
+			names := make([]string, len(group))
+			for i, child := range group {
+				names[i] = fmt.Sprintf("%q", EscapeName(child.Info.Name))
+			}
+			if sidecars[title] {
+				names = append(names, "a --sidecar")
+			}
+			dir := "/"
+			if relDir != "." {
+				dir += EscapeName(relDir) + "/"
+			}
+			p.printf("Name collision in %s: %s would all be titled %q\n", dir, strings.Join(names, ", "), title)
+			if p.opts.NameCollisions != CollisionSuffix {
+				continue
+			}
+			// The first item keeps the title unless it belongs to a sidecar
+			rename := group[1:]
+			if sidecars[title] {
+				rename = group
+			}
+			for _, child := range rename {
+				name := driveName(child)
+				n := 2
+				for taken[normalizeName(suffixedName(name, n))] {
+					n++
+				}
+				child.Title = suffixedName(name, n)
+				taken[normalizeName(child.Title)] = true
+				p.printf("  pushing %q as %q\n", EscapeName(child.Info.Name), EscapeName(child.Title))
+			}
+		}
+
+		for _, child := range node.Children {
+			if child.Info.IsDir {
+				walk(child, filepath.Join(relDir, child.Info.Name))
+			}
+		}
+	}
+	walk(tree, ".")
+
+	if clashes > 0 && p.opts.NameCollisions != CollisionSuffix {
+		return fmt.Errorf("%d name collision(s), rename the local items or pass --name_collisions=%s", clashes, CollisionSuffix)
+	}
+	return nil
+}
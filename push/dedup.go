@@ -0,0 +1,256 @@
+package push
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"path/filepath"
+	"sort"
+
+	humanize "github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+	"github.com/hatchling/try"
+)
+
+// dirDigest is the content digest of a local directory.
+type dirDigest struct {
+	sum   string
+	files int
+}
+
+// dirCopy is a new local directory that is created in GDrive as a copy of an identical sibling.
+type dirCopy struct {
+	src, dst *directory_tree.Node
+	// srcRel and dstRel are their paths, parentID the GDrive folder the copy goes in.
+	srcRel, dstRel string
+	parentID       string
+}
+
+// digest returns the digest of the names and contents of everything under the local directory
+// |dir|, found at |relDir|, and the number of files it holds.
+func (p *Pusher) digest(dir *directory_tree.Node, relDir string) (dirDigest, error) {
+	p.mu.Lock()
+	d, ok := p.digests[dir]
+	p.mu.Unlock()
+	if ok {
+		return d, nil
+	}
+	children := append([]*directory_tree.Node(nil), dir.Children...)
+	sort.Slice(children, func(i, j int) bool { return children[i].Info.Name < children[j].Info.Name })
+	h := sha256.New()
+	for _, child := range children {
+		relName := filepath.Join(relDir, child.Info.Name)
+		if child.Info.IsDir {
+			sub, err := p.digest(child, relName)
+			if err != nil {
+				return d, err
+			}
+			fmt.Fprintf(h, "d %q %s\n", child.Info.Name, sub.sum)
+			d.files += sub.files
+			continue
+		}
+		sum, err := p.hashFile(child, relName)
+		if err != nil {
+			return d, fmt.Errorf("Problem hashing local file %q: %v", relName, err)
+		}
+		fmt.Fprintf(h, "f %q %d %s\n", child.Info.Name, child.Info.Size, sum)
+		d.files++
+	}
+	d.sum = hex.EncodeToString(h.Sum(nil))
+	p.mu.Lock()
+	if p.digests == nil {
+		p.digests = make(map[*directory_tree.Node]dirDigest)
+	}
+	p.digests[dir] = d
+	p.mu.Unlock()
+	return d, nil
+}
+
+// duplicateOf returns the first sibling of the local directory |dir|, a child of |node| found at
+// |relName|, whose contents are identical, or nil if there is none or --dedup_dirs is off.
+// Directories without files aren't worth copying.
+func (p *Pusher) duplicateOf(node, dir *directory_tree.Node, relName string) (*directory_tree.Node, error) {
+	if !p.opts.DedupDirs || p.opts.DirsOnly || p.opts.FilesOnly != "" {
+		return nil, nil
+	}
+	d, err := p.digest(dir, relName)
+	if err != nil || d.files == 0 {
+		return nil, err
+	}
+	for _, sibling := range node.Children {
+		if sibling == dir {
+			break
+		}
+		if !sibling.Info.IsDir {
+			continue
+		}
+		other, err := p.digest(sibling, filepath.Join(filepath.Dir(relName), sibling.Info.Name))
+		if err != nil {
+			return nil, err
+		}
+		if other.sum == d.sum {
+			return sibling, nil
+		}
+	}
+	return nil, nil
+}
+
+// copyDuplicates creates the directories that processFolder left for --dedup_dirs, now that the
+// siblings they duplicate are pushed.
+func (p *Pusher) copyDuplicates(ctx context.Context) error {
+	p.mu.Lock()
+	copies := p.copies
+	p.copies = nil
+	p.mu.Unlock()
+	for _, c := range copies {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p.stopping() {
+			return nil
+		}
+		if err := p.copyDir(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyDir creates the GDrive folder of |c|.dst and fills it with copies of what its identical
+// sibling |c|.src was pushed as.  Should any of that not have been pushed, |c|.dst is pushed like
+// any other directory instead.
+func (p *Pusher) copyDir(ctx context.Context, c dirCopy) error {
+	op := fileOp(c.dst, c.dstRel, false)
+	p.opts.Listener.OnFileStart(op)
+	id, err := p.createFolder(ctx, driveName(c.dst), c.dstRel, c.parentID, c.dst.Info.ModTime)
+	if err != nil {
+		p.opts.Listener.OnError(op, err)
+		return fmt.Errorf("Problem creating GDrive folder %q: %v", c.dstRel, err)
+	}
+	op.ID = id
+	p.opts.Listener.OnFileDone(op)
+	c.dst.DriveID = id
+	if !p.opts.DryRun {
+		p.resumeLog.record(&resumeEntry{Op: resumeMkdir, Path: c.dstRel, ID: id, Parent: c.parentID, Title: EscapeName(driveName(c.dst))})
+	}
+	p.mu.Lock()
+	p.stats.foldersCreated++
+	p.mu.Unlock()
+	p.planned(CreateFolder, c.dstRel, 0)
+	p.recordSynced(c.dst, c.dstRel, id)
+
+	if !p.opts.DryRun && !p.pushedWhole(c.src) {
+		p.printStatus(fmt.Sprintf("+ /%s/ (not all of /%s/ was pushed, pushing it instead of copying)\n", EscapeName(c.dstRel), EscapeName(c.srcRel)))
+		return p.processNode(ctx, c.dst)
+	}
+	p.printStatus(fmt.Sprintf("+ /%s/ (copy of /%s/)\n", EscapeName(c.dstRel), EscapeName(c.srcRel)))
+	srcChildren := make(map[string]*directory_tree.Node, len(c.src.Children))
+	for _, child := range c.src.Children {
+		srcChildren[child.Info.Name] = child
+	}
+	for _, child := range c.dst.Children {
+		relName := filepath.Join(c.dstRel, child.Info.Name)
+		src := srcChildren[child.Info.Name]
+		if child.Info.IsDir {
+			sub := dirCopy{src: src, dst: child, srcRel: filepath.Join(c.srcRel, child.Info.Name), dstRel: relName, parentID: id}
+			if err := p.copyDir(ctx, sub); err != nil {
+				return err
+			}
+			continue
+		}
+		if p.policyFor(child) == PolicySkip {
+			continue
+		}
+		if err := p.copyFile(ctx, src, child, relName, id); err != nil {
+			return fmt.Errorf("Problem copying GDrive file %q: %v", relName, err)
+		}
+	}
+	return nil
+}
+
+// pushedWhole reports whether everything under the local directory |dir| that a push uploads has
+// a GDrive ID, so that it can be copied.
+func (p *Pusher) pushedWhole(dir *directory_tree.Node) bool {
+	if dir.DriveID == "" {
+		return false
+	}
+	for _, child := range dir.Children {
+		if child.Info.IsDir && !p.pushedWhole(child) {
+			return false
+		}
+		if !child.Info.IsDir && child.DriveID == "" && p.policyFor(child) != PolicySkip {
+			return false
+		}
+	}
+	return true
+}
+
+// copyFile creates the local file |localItem|, found at |relName|, in the GDrive folder
+// |parentID| as a copy of |src|, the identical file that was pushed already.
+func (p *Pusher) copyFile(ctx context.Context, src, localItem *directory_tree.Node, relName, parentID string) error {
+	op := fileOp(localItem, relName, false)
+	p.opts.Listener.OnFileQueued(op)
+	p.opts.Listener.OnFileStart(op)
+	if p.opts.DryRun {
+		p.estimated.add(callCopy, 0)
+		if err := p.applyLabels(ctx, ""); err != nil {
+			return err
+		}
+	} else {
+		if err := p.ops.take(callCopy); err != nil {
+			return err
+		}
+		slog.Debug("copyFile", "path", relName, "src", src.DriveID, "parent", parentID)
+		name := driveName(localItem)
+		f := &drive.File{
+			Title:      EscapeName(name),
+			Properties: append(append(originProperties(relName), rawNameProperties(name)...), p.longNameProperties(relName)...),
+			Parents: []*drive.ParentReference{
+				&drive.ParentReference{Id: parentID},
+			},
+		}
+		p.forgetListings(parentID)
+
+		// Wrap in a simple retry loop since Drive can be unreliable.
+		var r *drive.File
+		if err := try.Do(func(attempt int) (bool, error) {
+			var err error
+			p.countCall(ctx, callCopy)
+			r, err = p.drv.Files.Copy(src.DriveID, f).Context(ctx).Do()
+			if err != nil {
+				log.Print(err)
+			}
+			return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+		}); err != nil {
+			p.opts.Listener.OnError(op, err)
+			return fmt.Errorf("A Copy() error occurred: %v", err)
+		}
+		if err := p.applyLabels(ctx, r.Id); err != nil {
+			return err
+		}
+		localItem.DriveID = r.Id
+		p.storage.add(localItem.Info.Size)
+		if err := p.logUpload(localItem, relName, parentID, r.Id); err != nil {
+			return err
+		}
+		if p.opts.Sidecar {
+			if err := p.createSidecar(ctx, localItem, relName, parentID); err != nil {
+				return fmt.Errorf("Problem creating sidecar for %q: %v", relName, err)
+			}
+		}
+	}
+	p.mu.Lock()
+	p.stats.filesCopied++
+	p.mu.Unlock()
+	p.planned(Copy, relName, localItem.Info.Size)
+	p.recordSynced(localItem, relName, localItem.DriveID)
+	op.ID = localItem.DriveID
+	p.opts.Listener.OnFileDone(op)
+	p.printStatus(fmt.Sprintf("C /%s (%s, copied in GDrive)\n", EscapeName(relName), humanize.Bytes(uint64(localItem.Info.Size))))
+	return nil
+}
@@ -0,0 +1,36 @@
+package push
+
+import (
+	"bytes"
+	"os"
+	"time"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// descriptionData is what Options.Description can refer to.
+type descriptionData struct {
+	Host string // Hostname of the machine pushing
+	Path string // Absolute local path of the file
+	Name string // Base name of the file
+	Time string // When the file was pushed, RFC 3339
+}
+
+// describe renders the GDrive description for |localFile|, or "" when descriptions are disabled.
+func (p *Pusher) describe(localFile *directory_tree.Node) (string, error) {
+	if p.opts.Description == nil {
+		return "", nil
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	var buf bytes.Buffer
+	err = p.opts.Description.Execute(&buf, &descriptionData{
+		Host: host,
+		Path: localFile.FullPath,
+		Name: localFile.Info.Name,
+		Time: time.Now().Format(time.RFC3339),
+	})
+	return buf.String(), err
+}
@@ -0,0 +1,110 @@
+package push
+
+import (
+	"fmt"
+	"path/filepath"
+
+	humanize "github.com/dustin/go-humanize"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// localAsRemote describes the children of the local directory |dir| the way a GDrive listing
+// would, so that they can be matched through a remoteIndex.  It returns the items along with the
+// nodes they were made from.
+func localAsRemote(dir *directory_tree.Node) ([]*drive.File, map[*drive.File]*directory_tree.Node, error) {
+	items := make([]*drive.File, 0, len(dir.Children))
+	nodes := make(map[*drive.File]*directory_tree.Node, len(dir.Children))
+	for _, c := range dir.Children {
+		item := &drive.File{Title: c.Info.Name, FileSize: c.Info.Size}
+		if c.Info.IsDir {
+			item.MimeType = folderMimeType
+		} else {
+			sum, err := nodeMD5(c)
+			if err != nil {
+				return nil, nil, err
+			}
+			item.Md5Checksum = sum
+		}
+		items = append(items, item)
+		nodes[item] = c
+	}
+	return items, nodes, nil
+}
+
+// diffLocal prints what pushing |src| would do if |dst| were the GDrive folder it is pushed to,
+// using the same matching as a real push.  |relDir| is the path of both below their roots.
+func (p *Pusher) diffLocal(src, dst *directory_tree.Node, relDir string) error {
+	var items []*drive.File
+	nodes := map[*drive.File]*directory_tree.Node{}
+	if dst != nil {
+		var err error
+		if items, nodes, err = localAsRemote(dst); err != nil {
+			return err
+		}
+	}
+	idx := newRemoteIndex(items)
+
+	matched := make(map[*drive.File]bool)
+	for _, localItem := range src.Children {
+		relName := filepath.Join(relDir, localItem.Info.Name)
+		remote := idx.match(localItem, relName, p.opts.MatchBy == "origin")
+		if remote != nil {
+			matched[remote] = true
+		}
+		if localItem.Info.IsDir {
+			var other *directory_tree.Node
+			statusPrefix := "+"
+			if remote != nil {
+				statusPrefix = " "
+				other = nodes[remote]
+			}
+			p.printStatus(fmt.Sprintf("%s /%s/\n", statusPrefix, EscapeName(relName)))
+			if err := p.diffLocal(localItem, other, relName); err != nil {
+				return err
+			}
+			continue
+		}
+
+		statusPrefix := "+"
+		if remote != nil {
+			sum, err := nodeMD5(localItem)
+			if err != nil {
+				return err
+			}
+			statusPrefix = "M"
+			if sum == remote.Md5Checksum {
+				statusPrefix = " "
+			}
+		}
+		p.printStatus(fmt.Sprintf("%s /%s (%s)\n", statusPrefix, EscapeName(relName), humanize.Bytes(uint64(localItem.Info.Size))))
+	}
+
+	for _, item := range items {
+		if matched[item] {
+			continue
+		}
+		relName := filepath.Join(relDir, item.Title)
+		if item.MimeType == folderMimeType {
+			relName += "/"
+		}
+		p.printStatus(fmt.Sprintf("- /%s\n", EscapeName(relName)))
+	}
+	return nil
+}
+
+// DiffLocal implements "diff-local SRC DST", which compares the local directories |src| and |dst|
+// with the push diff logic and no GDrive involved.  It is handy for checking how names are
+// matched before pointing the tool at GDrive.
+func (p *Pusher) DiffLocal(src, dst string) error {
+	srcTree, err := directory_tree.NewTree(src)
+	if err != nil {
+		return fmt.Errorf("Problem reading %q: %v", src, err)
+	}
+	dstTree, err := directory_tree.NewTree(dst)
+	if err != nil {
+		return fmt.Errorf("Problem reading %q: %v", dst, err)
+	}
+	return p.diffLocal(srcTree, dstTree, "")
+}
@@ -0,0 +1,103 @@
+package push
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	humanize "github.com/dustin/go-humanize"
+	"google.golang.org/api/googleapi"
+)
+
+// downgradeAfter is how many times a resumable upload has to fail near the same offset before it
+// is retried more conservatively.  Middleboxes that break long streaming requests tend to do so at
+// a similar point every time, where retrying the same way only fails again.
+const downgradeAfter = 2
+
+// uploadGate keeps uploads from running alongside one that was downgraded: regular uploads share
+// it, a downgraded one has it to itself.
+var uploadGate sync.RWMutex
+
+// uploadFailure is a failed attempt at a resumable upload.
+type uploadFailure struct {
+	offset int64 // bytes of the upload read when it failed
+	code   int   // HTTP status, 0 if there was no response
+}
+
+func (f uploadFailure) String() string {
+	status := "no response"
+	if f.code != 0 {
+		status = fmt.Sprintf("HTTP %d", f.code)
+	}
+	return fmt.Sprintf("%s at byte %d", status, f.offset)
+}
+
+// uploadAttempts tracks the attempts at the resumable upload of one file.  After it failed
+// downgradeAfter times within a chunk of the same offset, the chunk size is halved, down to the
+// smallest Drive takes, and the upload runs alone.
+type uploadAttempts struct {
+	relName   string
+	size      int64
+	chunkSize int
+	alone     bool
+	failures  []uploadFailure // since the last downgrade
+	history   []uploadFailure // all of them, for the error of an upload that never succeeded
+}
+
+func newUploadAttempts(relName string, size int64, chunkSize int) *uploadAttempts {
+	return &uploadAttempts{relName: relName, size: size, chunkSize: chunkSize}
+}
+
+// begin waits until the next attempt may run, and returns the function to call once it's done.
+func (a *uploadAttempts) begin() func() {
+	if a.alone {
+		uploadGate.Lock()
+		return uploadGate.Unlock
+	}
+	uploadGate.RLock()
+	return uploadGate.RUnlock
+}
+
+// failed records that an attempt failed with |err| after |offset| bytes of the upload were read,
+// logging the diagnostics, and downgrades the upload if it failed near there before.
+func (a *uploadAttempts) failed(offset int64, err error) {
+	f := uploadFailure{offset: offset}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		f.code = apiErr.Code
+	}
+	a.failures = append(a.failures, f)
+	a.history = append(a.history, f)
+	log.Printf("Upload of %q failed, %s of %d in %s chunks", a.relName, f, a.size, humanize.IBytes(uint64(a.chunkSize)))
+
+	near := 0
+	for _, other := range a.failures {
+		if d := other.offset - offset; d <= int64(a.chunkSize) && d >= -int64(a.chunkSize) {
+			near++
+		}
+	}
+	if near < downgradeAfter || (a.alone && a.chunkSize <= googleapi.MinUploadChunkSize) {
+		return
+	}
+	if a.chunkSize /= 2; a.chunkSize < googleapi.MinUploadChunkSize {
+		a.chunkSize = googleapi.MinUploadChunkSize
+	}
+	a.alone = true
+	a.failures = nil
+	log.Printf("Upload of %q failed %d times near byte %d, retrying alone in %s chunks", a.relName,
+		near, offset, humanize.IBytes(uint64(a.chunkSize)))
+}
+
+// diagnose adds the failed attempts to |err|, the error the upload finally failed with.
+func (a *uploadAttempts) diagnose(err error) error {
+	if len(a.history) < 2 {
+		return err
+	}
+	failures := make([]string, len(a.history))
+	for i, f := range a.history {
+		failures[i] = f.String()
+	}
+	return fmt.Errorf("%v (attempts failed with %s)", err, strings.Join(failures, ", "))
+}
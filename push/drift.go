@@ -0,0 +1,210 @@
+package push
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+	"github.com/hatchling/gdrive-dir-push/state"
+	"github.com/hatchling/try"
+)
+
+// What --drift does about changes made in GDrive by something other than this tool.
+const (
+	DriftOff    = "off"
+	DriftReport = "report"
+	DriftFail   = "fail"
+)
+
+// changeFields limits the change feed to the fields the drift report and --remote_changes look at.
+const changeFields = "nextPageToken,items(fileId,deleted,file(id,title,mimeType,fileSize,md5Checksum,parents(id),properties,labels(trashed)))"
+
+// startChangeToken returns the token GDrive's change feed continues from after everything done
+// so far.
+func (p *Pusher) startChangeToken(ctx context.Context) (string, error) {
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	var r *drive.StartPageToken
+	if err := try.Do(func(attempt int) (bool, error) {
+		var err error
+		p.countCall(ctx, callStartToken)
+		r, err = p.drv.Changes.GetStartPageToken().Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return "", fmt.Errorf("A Changes.GetStartPageToken() error occurred: %v", err)
+	}
+	return r.StartPageToken, nil
+}
+
+// changesSince returns the latest change to each item in the user's whole Drive since |token|,
+// oldest first.
+func (p *Pusher) changesSince(ctx context.Context, token string) ([]*drive.Change, error) {
+	slog.Debug("changesSince", "token", token)
+	latest := make(map[string]int)
+	var changes []*drive.Change
+	for {
+		// Wrap in a simple retry loop since Drive can be unreliable.
+		var r *drive.ChangeList
+		if err := try.Do(func(attempt int) (bool, error) {
+			var err error
+			p.countCall(ctx, callChanges)
+			r, err = p.drv.Changes.List().PageToken(token).IncludeDeleted(true).MaxResults(1000).
+				Fields(changeFields).Context(ctx).Do()
+			if err != nil {
+				log.Print(err)
+			}
+			return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+		}); err != nil {
+			return nil, fmt.Errorf("A Changes.List() error occurred: %v", err)
+		}
+		for _, c := range r.Items {
+			if i, ok := latest[c.FileId]; ok {
+				changes[i] = c
+				continue
+			}
+			latest[c.FileId] = len(changes)
+			changes = append(changes, c)
+		}
+		if r.NextPageToken == "" {
+			return changes, nil
+		}
+		token = r.NextPageToken
+	}
+}
+
+// expectedTitle returns the title the push of |tree| gives the item at |relName|, or "" if that
+// isn't known because the item isn't part of |tree| where its path says.
+func expectedTitle(tree *directory_tree.Node, relName string) string {
+	node := findNode(tree, relName)
+	if node == nil {
+		return ""
+	}
+	return normalizeName(driveName(node))
+}
+
+// driftLines describes how the |changes| made to GDrive since the last run depart from the
+// synced state |st| of |tree|, rooted in GDrive at |rootID|, one status line each.  Changes to
+// items outside of the synced tree, and those that leave synced items as they were, such as
+// views, stars and shares, don't count.
+func (p *Pusher) driftLines(st *state.State, tree *directory_tree.Node, rootID string, changes []*drive.Change) []string {
+	byID := make(map[string]string, len(st.Snapshot))
+	folders := map[string]string{rootID: "."}
+	for relName, e := range st.Snapshot {
+		byID[e.DriveID] = relName
+		if e.IsDir {
+			folders[e.DriveID] = relName
+		}
+	}
+	display := func(relName string, isDir bool) string {
+		d := "/" + EscapeName(filepath.ToSlash(relName))
+		if isDir {
+			d += "/"
+		}
+		return d
+	}
+
+	var lines []string
+	for _, c := range changes {
+		f := c.File
+		gone := c.Deleted || f == nil || (f.Labels != nil && f.Labels.Trashed)
+		relName, known := byID[c.FileId]
+		if !known {
+			if gone {
+				continue
+			}
+			for _, parent := range f.Parents {
+				if relDir, ok := folders[parent.Id]; ok {
+					lines = append(lines, fmt.Sprintf("A %s (added in GDrive)\n", display(filepath.Join(relDir, f.Title), f.MimeType == folderMimeType)))
+					break
+				}
+			}
+			continue
+		}
+
+		e := st.Snapshot[relName]
+		shown := display(relName, e.IsDir)
+		if gone {
+			lines = append(lines, fmt.Sprintf("D %s (deleted or trashed in GDrive)\n", shown))
+			continue
+		}
+		parentID := rootID
+		if relDir := filepath.Dir(relName); relDir != "." {
+			if parent, ok := st.Snapshot[relDir]; ok {
+				parentID = parent.DriveID
+			} else {
+				parentID = "" // Flattened by --long_paths=remap
+			}
+		}
+		inParent := parentID == ""
+		for _, parent := range f.Parents {
+			inParent = inParent || parent.Id == parentID
+		}
+		switch {
+		case !inParent:
+			lines = append(lines, fmt.Sprintf("R %s (moved elsewhere in GDrive)\n", shown))
+		case !e.IsDir && e.MD5 != "" && f.Md5Checksum != "" && f.Md5Checksum != e.MD5 && !p.transformed(relName):
+			lines = append(lines, fmt.Sprintf("M %s (content changed in GDrive)\n", shown))
+		default:
+			if title := expectedTitle(tree, relName); title != "" && normalizeName(f.Title) != title {
+				lines = append(lines, fmt.Sprintf("R %s (renamed to %q in GDrive)\n", shown, f.Title))
+			}
+		}
+	}
+	return lines
+}
+
+// transformed reports whether --policy uploads the file at |relName| in a form whose checksum
+// isn't that of the local file.
+func (p *Pusher) transformed(relName string) bool {
+	policy := p.policyFor(&directory_tree.Node{Info: &directory_tree.FileInfo{Name: filepath.Base(relName)}})
+	return policy == PolicyConvert || policy == PolicyCompress
+}
+
+// checkDrift reports the changes made under the GDrive folder |rootID| by anything but this tool
+// since the end of its last run, which the change feed token in the sync state marks, so that
+// mirrors meant to be written by nothing else are protected.  |tree| is the local tree about to be
+// pushed.  With --drift=fail an error is returned if there are any, unless --accept_drift is set.
+func (p *Pusher) checkDrift(ctx context.Context, tree *directory_tree.Node, rootID string) error {
+	if p.opts.Drift == DriftOff || p.st.DriftToken == "" {
+		return nil
+	}
+	changes, err := p.changesSince(ctx, p.st.DriftToken)
+	if err != nil {
+		return err
+	}
+	lines := p.driftLines(p.st, tree, rootID, changes)
+	if len(lines) == 0 {
+		return nil
+	}
+	p.printf("GDrive changed since the last run in ways gdrive-dir-push didn't:\n")
+	for _, line := range lines {
+		p.printStatus(line)
+	}
+	p.printf("\n")
+	if p.opts.Drift == DriftFail && !p.opts.AcceptDrift {
+		return fmt.Errorf("%d item(s) drifted, look them over and pass --accept_drift to push anyway", len(lines))
+	}
+	return nil
+}
+
+// markDrift remembers where GDrive's change feed stands at the end of a run, so that the next run
+// reports only what changed after it.  Failing to leaves the mark where it was, at worst
+// reporting this run's own writes next time.
+func (p *Pusher) markDrift(ctx context.Context) {
+	if p.opts.Drift == DriftOff || p.opts.DryRun || p.drv == nil {
+		return
+	}
+	token, err := p.startChangeToken(ctx)
+	if err != nil {
+		log.Printf("Problem marking the GDrive change feed for --drift: %v", err)
+		return
+	}
+	p.st.DriftToken = token
+}
@@ -0,0 +1,68 @@
+package push
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// estimate tallies the Drive API requests and bytes a --dry_run would have needed, using the same
+// method names as apiUsage.
+type estimate struct {
+	mu    sync.Mutex
+	ops   map[string]int
+	bytes int64
+}
+
+// add records one |method| request that would have transferred |bytes|.
+func (e *estimate) add(method string, bytes int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ops[method]++
+	e.bytes += bytes
+}
+
+// estimatedDuration projects how long the estimated requests of |p| would take given the
+// --estimate_op_latency per request and |bandwidth| bytes per second of upload capacity.
+// Requests take no less than --max_qps allows.
+func (p *Pusher) estimatedDuration(bandwidth uint64) time.Duration {
+	e := p.estimated
+	var n int
+	for _, c := range e.ops {
+		n += c
+	}
+	d := time.Duration(n) * p.opts.EstimateOpLatency
+	if p.opts.MaxQPS > 0 {
+		if paced := time.Duration(float64(n) / p.opts.MaxQPS * float64(time.Second)); paced > d {
+			d = paced
+		}
+	}
+	if bandwidth > 0 {
+		d += time.Duration(float64(e.bytes) / float64(bandwidth) * float64(time.Second))
+	}
+	return d
+}
+
+// printEstimate writes the estimate of the dry run to Options.Output.  Uploads are assumed to go
+// at Options.EstimateBandwidth, or Options.BWLimit if that is lower.
+func (p *Pusher) printEstimate() {
+	e := p.estimated
+	bandwidth := p.opts.EstimateBandwidth
+	if limit := p.opts.BWLimit; limit > 0 && limit < bandwidth {
+		bandwidth = limit
+	}
+	methods := make([]string, 0, len(e.ops))
+	var n int
+	for m, c := range e.ops {
+		methods = append(methods, m)
+		n += c
+	}
+	sort.Strings(methods)
+	p.printf("Estimated API calls: %d, to upload %s\n", n, humanize.Bytes(uint64(e.bytes)))
+	for _, m := range methods {
+		p.printf("  %-22s %d\n", m, e.ops[m])
+	}
+	p.printf("Estimated duration at %s/s: %v\n", humanize.Bytes(bandwidth), p.estimatedDuration(bandwidth).Round(time.Second))
+}
@@ -0,0 +1,218 @@
+package push
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+	"github.com/hatchling/gdrive-dir-push/state"
+	"github.com/hatchling/try"
+)
+
+// What --delete_extraneous does with GDrive items that stayed missing locally past the grace.
+const (
+	DeleteRelocate = "relocate"
+	DeleteTrash    = "trash"
+)
+
+// missingProperty marks GDrive items that --delete_extraneous found missing locally, its value is
+// when that was first seen (RFC 3339).
+const missingProperty = "gdrive_dir_push_missing_since"
+
+// ownItem reports whether |item| in the GDrive folder of the local directory |relDir|, which holds
+// items with the normalized |titles|, is one this tool keeps there besides the pushed files:
+// sidecars, partial uploads, the manifest, the --annotate=status_file file and the --old_files_dir
+// folders.
+func (p *Pusher) ownItem(relDir string, item *drive.File, titles map[string]bool) bool {
+	switch {
+	case p.isOldFilesDir(item.Id):
+		return true
+	case strings.HasSuffix(item.Title, SidecarSuffix) && titles[normalizeName(strings.TrimSuffix(item.Title, SidecarSuffix))]:
+		return true
+	case p.opts.PartialName != "" && p.isPartialTitle(item.Title):
+		return true
+	case relDir == "." && p.opts.Manifest != "" && strings.HasPrefix(item.Title, filepath.Base(p.opts.Manifest)):
+		return true
+	case relDir == "." && p.opts.Annotate == "status_file" && item.Title == statusFileTitle:
+		return true
+	}
+	return false
+}
+
+// graceOver reports whether the item that |e| tracks has been missing locally for long enough to be
+// removed.
+func (p *Pusher) graceOver(e *state.MissingEntry) bool {
+	if p.opts.DeleteGraceRuns <= 0 && p.opts.DeleteGracePeriod <= 0 {
+		return true
+	}
+	return (p.opts.DeleteGraceRuns > 0 && e.Runs > p.opts.DeleteGraceRuns) ||
+		(p.opts.DeleteGracePeriod > 0 && time.Since(e.Since) >= p.opts.DeleteGracePeriod)
+}
+
+// pruneExtraneous handles the items of |remoteItems|, the listing of the GDrive folder of |node|
+// at |relDir|, that match nothing in |node| for --delete_extraneous.  The first time one is seen it
+// is only marked and reported, as a source volume that isn't mounted looks just like one whose
+// files were deleted.  It is removed once it is still missing after the grace, while items that
+// reappear locally lose their mark.  Status lines are added below |out|.
+func (p *Pusher) pruneExtraneous(ctx context.Context, node *directory_tree.Node, relDir string, remoteItems *remoteIndex, out *statusLine) error {
+	present := make(map[string]bool)
+	titles := make(map[string]bool)
+	for _, name := range node.Filtered {
+		// What --exclude and the like leave out isn't pushed, but isn't gone either
+		titles[normalizeName(name)] = true
+	}
+	for _, localItem := range node.Children {
+		titles[normalizeName(driveName(localItem))] = true
+		if remote := remoteItems.match(localItem, filepath.Join(relDir, localItem.Info.Name), p.opts.MatchBy == "origin"); remote != nil {
+			present[remote.Id] = true
+		}
+	}
+	var items []*drive.File
+	listed := make(map[string]bool)
+	for _, named := range remoteItems.byName {
+		for _, item := range named {
+			listed[item.Id] = true
+			if !present[item.Id] && !titles[normalizeName(item.Title)] && !p.ownItem(relDir, item, titles) && p.managed(item) {
+				items = append(items, item)
+			}
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Title < items[j].Title })
+
+	// Forget the items that came back or were removed from GDrive by something else
+	p.mu.Lock()
+	var back []string
+	for id, e := range p.st.Missing {
+		if e.ParentID == node.DriveID && (present[id] || !listed[id]) {
+			if present[id] {
+				back = append(back, id)
+			}
+			if !p.opts.DryRun {
+				delete(p.st.Missing, id)
+			}
+		}
+	}
+	p.mu.Unlock()
+	for _, id := range back {
+		if !p.opts.DryRun {
+			if err := p.clearMissing(ctx, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	now := time.Now()
+	for _, item := range items {
+		relName := filepath.Join(relDir, item.Title)
+		shown := "/" + filepath.ToSlash(relName)
+		if item.MimeType == folderMimeType {
+			shown += "/"
+		}
+		p.mu.Lock()
+		e, ok := p.st.Missing[item.Id]
+		if ok {
+			e = &state.MissingEntry{Path: e.Path, ParentID: e.ParentID, Since: e.Since, Runs: e.Runs + 1}
+		} else {
+			e = &state.MissingEntry{Path: relName, ParentID: node.DriveID, Since: now, Runs: 1}
+		}
+		if !p.opts.DryRun {
+			p.st.Missing[item.Id] = e
+		}
+		p.mu.Unlock()
+
+		line := out.add()
+		if !p.graceOver(e) {
+			if !ok && !p.opts.DryRun {
+				if err := p.markMissing(ctx, item.Id, now); err != nil {
+					return err
+				}
+			}
+			line.print("? %s (missing locally since %s, %d run(s), kept for now)\n", shown, e.Since.Format("2006-01-02"), e.Runs)
+			continue
+		}
+
+		switch p.opts.DeleteAction {
+		case DeleteTrash:
+			if !p.opts.DryRun {
+				if err := p.trashFile(ctx, item.Id); err != nil {
+					return fmt.Errorf("Problem trashing GDrive item %q: %v", relName, err)
+				}
+				p.storage.trash(item.FileSize)
+			}
+			line.print("- %s (missing locally since %s, trashed)\n", shown, e.Since.Format("2006-01-02"))
+		default:
+			if err := p.relocateFile(ctx, relName, item.Id, node.DriveID); err != nil {
+				return fmt.Errorf("Problem relocating GDrive item %q: %v", relName, err)
+			}
+			if !p.opts.DryRun {
+				p.storage.relocate(item.FileSize)
+			}
+			p.planned(Relocate, relName, item.FileSize)
+			p.relocated(relName, item.Id, item.FileSize)
+			line.print("- %s (missing locally since %s, moved to --old_files_dir)\n", shown, e.Since.Format("2006-01-02"))
+		}
+		if !p.opts.DryRun {
+			p.mu.Lock()
+			delete(p.st.Missing, item.Id)
+			p.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// markMissing tags |fileID| with missingProperty, recording it missing locally since |since|.  It
+// returns an error if the operation fails.
+func (p *Pusher) markMissing(ctx context.Context, fileID string, since time.Time) error {
+	if err := p.ops.take(callPatch); err != nil {
+		return err
+	}
+	slog.Debug("markMissing", "id", fileID)
+	tags := &drive.File{
+		Properties: []*drive.Property{
+			{Key: missingProperty, Value: since.UTC().Format(time.RFC3339), Visibility: "PRIVATE"},
+		},
+	}
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	if err := try.Do(func(attempt int) (bool, error) {
+		p.countCall(ctx, callPatch)
+		_, err := p.drv.Files.Patch(fileID, tags).Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return fmt.Errorf("A Patch() error occurred: %v", err)
+	}
+	return nil
+}
+
+// clearMissing removes missingProperty from |fileID|, which is back locally.  It returns an error
+// if the operation fails.
+func (p *Pusher) clearMissing(ctx context.Context, fileID string) error {
+	if err := p.ops.take(callPropertyDelete); err != nil {
+		return err
+	}
+	slog.Debug("clearMissing", "id", fileID)
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	if err := try.Do(func(attempt int) (bool, error) {
+		p.countCall(ctx, callPropertyDelete)
+		err := p.drv.Properties.Delete(fileID, missingProperty).Visibility("PRIVATE").Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return fmt.Errorf("A Properties.Delete() error occurred: %v", err)
+	}
+	return nil
+}
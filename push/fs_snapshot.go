@@ -0,0 +1,78 @@
+package push
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Environment variables passed to --snapshot_cmd and --snapshot_release_cmd.
+const (
+	SnapshotLocalDirEnv = "GDRIVE_PUSH_LOCAL_DIR"
+	SnapshotPathEnv     = "GDRIVE_PUSH_SNAPSHOT"
+)
+
+// runHook runs the shell command |command| with |env| added to the environment and returns its
+// stdout.  Its stderr is passed through.
+func runHook(command string, env ...string) (string, error) {
+	slog.Debug("runHook", "command", command, "env", env)
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout, cmd.Stderr = &out, os.Stderr
+	err := cmd.Run()
+	return out.String(), err
+}
+
+// takeFsSnapshot runs --snapshot_cmd, which creates a read-only filesystem snapshot (ZFS, btrfs,
+// LVM, ...) of --local_dir_to_push and prints where the snapshot of that directory is mounted as
+// the last line of its output.  The push then reads from the snapshot, so files changing during a
+// long push can't leave an inconsistent mirror.  Sync state stays keyed by the real directory.
+//
+// It returns a function that runs --snapshot_release_cmd to release the snapshot again, which must
+// be called once nothing needs the local files anymore, and has the Pusher read the real directory
+// again.  Without --snapshot_cmd both do nothing.
+func (p *Pusher) takeFsSnapshot() (func(), error) {
+	if p.opts.SnapshotCmd == "" {
+		return func() {}, nil
+	}
+	localDir, stagedName := p.opts.LocalDir, p.opts.StagedName
+	out, err := runHook(p.opts.SnapshotCmd, SnapshotLocalDirEnv+"="+localDir)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	mount := strings.TrimSpace(lines[len(lines)-1])
+	if mount == "" {
+		return nil, fmt.Errorf("--snapshot_cmd didn't print where the snapshot is mounted")
+	}
+	if mount, err = filepath.Abs(mount); err != nil {
+		return nil, err
+	}
+
+	release := func() {
+		p.opts.LocalDir, p.opts.StagedName = localDir, stagedName
+		if p.opts.SnapshotReleaseCmd == "" {
+			return
+		}
+		if _, err := runHook(p.opts.SnapshotReleaseCmd, SnapshotLocalDirEnv+"="+localDir, SnapshotPathEnv+"="+mount); err != nil {
+			log.Printf("Problem releasing snapshot %q: %v", mount, err)
+		}
+	}
+	if fi, err := os.Stat(mount); err != nil || !fi.IsDir() {
+		release()
+		return nil, fmt.Errorf("Snapshot %q is not a directory", mount)
+	}
+	p.printf("Pushing from snapshot %q\n", mount)
+	// --staged publishes under the name of the real directory, not that of the mount point
+	if p.opts.StagedName == "" {
+		p.opts.StagedName = filepath.Base(localDir)
+	}
+	p.opts.LocalDir = mount
+	return release, nil
+}
@@ -0,0 +1,81 @@
+package push
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// The hashes a hash list can hold.
+const (
+	hashListMD5    = "md5"
+	hashListSHA256 = "sha256"
+)
+
+// WriteHashList writes the |kind| hashes of the local files that pushes upload as they are to |w|,
+// as md5sum, sha256sum and rclone md5sum/sha256sum list them: "HASH  PATH" with PATH relative to
+// --local_dir_to_push.  rclone checksum can then check the GDrive copy against an MD5 list, and
+// sha256sum -c the local dir against a SHA-256 one.  Files that --policy skips, converts or
+// compresses are left out as their GDrive copies differ.  MD5s come from the sync state where it
+// has them and are added to it otherwise, saving it is up to the caller.  It returns how many
+// files were listed.
+func (p *Pusher) WriteHashList(w io.Writer, kind string) (int, error) {
+	if kind != hashListMD5 && kind != hashListSHA256 {
+		return 0, fmt.Errorf("Unknown hash %q, expected %q or %q", kind, hashListMD5, hashListSHA256)
+	}
+	tree, err := directory_tree.NewTreeFS(p.sourceFS(), ".", p.opts.LocalDir, p.opts.Filter)
+	if err != nil {
+		return 0, fmt.Errorf("Problem creating directory_tree: %v", err)
+	}
+
+	out := bufio.NewWriter(w)
+	var n int
+	var list func(node *directory_tree.Node, relDir string) error
+	list = func(node *directory_tree.Node, relDir string) error {
+		for _, child := range node.Children {
+			relName := filepath.Join(relDir, child.Info.Name)
+			if child.Info.IsDir {
+				if err := list(child, relName); err != nil {
+					return err
+				}
+				continue
+			}
+			if policy := p.policyFor(child); policy != "" && policy != PolicySizeOnly {
+				continue
+			}
+			var sum string
+			var err error
+			if kind == hashListMD5 {
+				sum, err = p.hashFile(child, relName)
+			} else {
+				sum, err = localSHA256(p.sourceFS(), filepath.ToSlash(relName))
+			}
+			if err != nil {
+				return fmt.Errorf("Problem hashing local file %q: %v", relName, err)
+			}
+			if _, err := out.WriteString(hashListLine(sum, filepath.ToSlash(relName))); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	}
+	if err := list(tree, "."); err != nil {
+		return n, err
+	}
+	return n, out.Flush()
+}
+
+// hashListLine returns the line of the file |name| with hash |sum|.  Like md5sum, names with
+// backslashes or line breaks are escaped and the line then starts with a backslash.
+func hashListLine(sum, name string) string {
+	if !strings.ContainsAny(name, "\\\n\r") {
+		return sum + "  " + name + "\n"
+	}
+	name = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r").Replace(name)
+	return "\\" + sum + "  " + name + "\n"
+}
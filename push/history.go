@@ -0,0 +1,114 @@
+package push
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+// runStats counts what a run changed in GDrive.
+type runStats struct {
+	foldersCreated int
+	filesUploaded  int
+	filesReplaced  int
+	filesUnchanged int
+	filesCopied    int
+	filesRelocated int
+	bytesUploaded  int64
+}
+
+// runIDFormat makes the ID of a run from when it started, to the microsecond so that runs started
+// within the same second, as watch and verify after a push can, don't share one.
+const runIDFormat = "20060102-150405.000000"
+
+// newRun returns a history entry of |kind| for a run that started at |start| and ended now with
+// |result|.
+func (p *Pusher) newRun(kind string, start time.Time, result string) *state.Run {
+	usage.mu.Lock()
+	calls := make(map[string]int, len(usage.Calls))
+	for m, c := range usage.Calls {
+		calls[m] = c
+	}
+	usage.mu.Unlock()
+	p.mu.Lock()
+	bytes := p.stats.bytesUploaded
+	p.mu.Unlock()
+	return &state.Run{
+		ID:            start.Format(runIDFormat),
+		Kind:          kind,
+		Start:         start,
+		End:           time.Now(),
+		RootID:        p.opts.RootID,
+		LocalDir:      p.opts.LocalDir,
+		DryRun:        p.opts.DryRun,
+		BytesUploaded: bytes,
+		APICalls:      calls,
+		Result:        result,
+	}
+}
+
+// appendRun adds |r| to the history, failing to do so isn't worth failing the run over.
+func (p *Pusher) appendRun(r *state.Run) {
+	if err := state.AppendHistory(p.opts.StateDir, r); err != nil {
+		fmt.Fprintf(os.Stderr, "Problem recording run history: %v\n", err)
+	}
+}
+
+// RecordRun appends the last push to the run history kept in Options.StateDir and returns the
+// entry, whose result is "ok" unless the push failed or left --immutable violations.  Pushes that
+// didn't get as far as walking the local tree aren't recorded and nil is returned.
+func (p *Pusher) RecordRun() *state.Run {
+	if p.result == nil {
+		return nil
+	}
+	result := "ok"
+	switch {
+	case p.result.Err != nil:
+		result = p.result.Err.Error()
+	case len(p.violations) > 0:
+		result = fmt.Sprintf("%d --immutable violation(s)", len(p.violations))
+	}
+	r := p.newRun("push", p.start, result)
+	r.FoldersCreated = p.result.FoldersCreated
+	r.FilesUploaded = p.result.FilesUploaded
+	r.FilesReplaced = p.result.FilesReplaced
+	r.FilesCopied = p.result.FilesCopied
+	p.storage.mu.Lock()
+	r.StorageAdded = p.storage.added
+	p.storage.mu.Unlock()
+	r.Report, r.Journal = absPath(p.opts.Report), absPath(p.opts.Journal)
+	if !p.opts.DryRun {
+		// A dry run leaves alone the log of the run before it
+		logPath := resumeLogPath(p.st.Path())
+		if _, err := os.Stat(logPath); err == nil {
+			r.ResumeLog = absPath(logPath)
+		}
+	}
+	p.appendRun(r)
+	return r
+}
+
+// absPath returns |path| made absolute, so that it can still be found from another directory,
+// or as is if that fails.
+func absPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// history returns the runs in the history, none if it can't be read as it only adds to the
+// report.
+func (p *Pusher) history() []*state.Run {
+	runs, err := state.History(p.opts.StateDir)
+	if err != nil {
+		return nil
+	}
+	return runs
+}
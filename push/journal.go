@@ -0,0 +1,130 @@
+package push
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// journalWrites are the events of a --journal that can leave something to push, named as
+// inotifywait and fsnotify do.  Deletions are left out as pushes never delete.
+var journalWrites = map[string]bool{
+	"CREATE":      true,
+	"MODIFY":      true,
+	"CLOSE_WRITE": true,
+	"MOVED_TO":    true,
+	"WRITE":       true,
+	"RENAME":      true,
+}
+
+// parseJournalTime parses a --journal timestamp, given in Unix seconds or as RFC 3339.
+func parseJournalTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// readJournal returns the paths, relative to --local_dir_to_push, that the change journal |r|
+// recorded writes to after |since|, along with the time of the last entry.  Each line is
+// "TIME EVENTS PATH", with comma separated EVENTS, which is what
+// `inotifywait -m -r --timefmt %s --format "%T %e %w%f"` writes.
+func (p *Pusher) readJournal(r io.Reader, since time.Time) ([]string, time.Time, error) {
+	paths := make(map[string]bool)
+	last := since
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 3 {
+			return nil, last, fmt.Errorf("Line %d: expected \"TIME EVENTS PATH\", got %q", n, line)
+		}
+		t, err := parseJournalTime(fields[0])
+		if err != nil {
+			return nil, last, fmt.Errorf("Line %d: bad time %q", n, fields[0])
+		}
+		// Entries of the second the last replay ended in are replayed again, they may be new
+		if t.Before(since) {
+			continue
+		}
+		if t.After(last) {
+			last = t
+		}
+		write := false
+		for _, event := range strings.Split(fields[1], ",") {
+			write = write || journalWrites[strings.ToUpper(event)]
+		}
+		if !write {
+			continue
+		}
+
+		name := fields[2]
+		if filepath.IsAbs(name) {
+			if name, err = filepath.Rel(p.opts.LocalDir, name); err != nil {
+				continue
+			}
+		}
+		name = filepath.ToSlash(filepath.Clean(name))
+		if name == ".." || strings.HasPrefix(name, "../") {
+			continue // Outside --local_dir_to_push
+		}
+		paths[name] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, last, err
+	}
+
+	result := make([]string, 0, len(paths))
+	for name := range paths {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result, last, nil
+}
+
+// journalPaths reads the --journal, "-" for stdin, for the paths changed since |since|.
+func (p *Pusher) journalPaths(since time.Time) ([]string, time.Time, error) {
+	if p.opts.Journal == "-" {
+		return p.readJournal(os.Stdin, since)
+	}
+	f, err := os.Open(p.opts.Journal)
+	if err != nil {
+		return nil, since, err
+	}
+	defer f.Close()
+	return p.readJournal(f, since)
+}
+
+// journalFilter returns the tree filter for a push of the journaled |paths|, which is
+// Options.Filter limited to them.  Without |paths| the whole tree is pushed, as it is when the
+// journal recorded a change to --local_dir_to_push itself.
+func (p *Pusher) journalFilter(paths []string) *directory_tree.Filter {
+	filter := p.opts.Filter
+	for _, name := range paths {
+		if name == "." {
+			return filter
+		}
+	}
+	if len(paths) == 0 {
+		return filter
+	}
+	if filter == nil {
+		filter = &directory_tree.Filter{}
+	} else {
+		copied := *filter
+		filter = &copied
+	}
+	filter.Only = paths
+	return filter
+}
@@ -0,0 +1,100 @@
+package push
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/try"
+)
+
+// LabelList collects the repeatable --label flag.  Each value is LABEL_ID to apply a label without
+// fields, LABEL_ID.FIELD_ID=TEXT to also set a text field, or LABEL_ID.FIELD_ID=choice:CHOICE_ID
+// to set a selection field.  IDs are the ones shown by the Drive Labels admin console.
+type LabelList struct {
+	mods []*drive.LabelModification
+}
+
+func (l *LabelList) String() string {
+	var s []string
+	for _, mod := range l.mods {
+		if len(mod.FieldModifications) == 0 {
+			s = append(s, mod.LabelId)
+		}
+		for _, field := range mod.FieldModifications {
+			s = append(s, mod.LabelId+"."+field.FieldId)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+// Set parses one --label value, merging fields of the same label into one modification.
+func (l *LabelList) Set(value string) error {
+	spec, fieldValue := value, ""
+	hasValue := false
+	if i := strings.Index(value, "="); i >= 0 {
+		spec, fieldValue, hasValue = value[:i], value[i+1:], true
+	}
+	labelID, fieldID := spec, ""
+	if i := strings.Index(spec, "."); i >= 0 {
+		labelID, fieldID = spec[:i], spec[i+1:]
+	}
+	if labelID == "" || (fieldID == "") != !hasValue {
+		return fmt.Errorf("expected LABEL_ID or LABEL_ID.FIELD_ID=VALUE, got %q", value)
+	}
+
+	var mod *drive.LabelModification
+	for _, m := range l.mods {
+		if m.LabelId == labelID {
+			mod = m
+		}
+	}
+	if mod == nil {
+		mod = &drive.LabelModification{LabelId: labelID}
+		l.mods = append(l.mods, mod)
+	}
+	if fieldID == "" {
+		return nil
+	}
+	field := &drive.LabelFieldModification{FieldId: fieldID}
+	if strings.HasPrefix(fieldValue, "choice:") {
+		field.SetSelectionValues = []string{strings.TrimPrefix(fieldValue, "choice:")}
+	} else {
+		field.SetTextValues = []string{fieldValue}
+	}
+	mod.FieldModifications = append(mod.FieldModifications, field)
+	return nil
+}
+
+// applyLabels applies the --label flags to |fileID|.  It returns an error if the operation fails.
+func (p *Pusher) applyLabels(ctx context.Context, fileID string) error {
+	if len(p.opts.Labels.mods) == 0 {
+		return nil
+	}
+	if p.opts.DryRun {
+		p.estimated.add(callModifyLabels, 0)
+		return nil
+	}
+	if err := p.ops.take(callModifyLabels); err != nil {
+		return err
+	}
+	slog.Debug("applyLabels", "id", fileID, "labels", p.opts.Labels.String())
+	req := &drive.ModifyLabelsRequest{LabelModifications: p.opts.Labels.mods}
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	if err := try.Do(func(attempt int) (bool, error) {
+		p.countCall(ctx, callModifyLabels)
+		_, err := p.drv.Files.ModifyLabels(fileID, req).Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return fmt.Errorf("A ModifyLabels() error occurred: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package push
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// What --long_paths does about items over the limits.
+const (
+	LongPathsFail  = "fail"
+	LongPathsRemap = "remap"
+)
+
+// flattenSeparator joins the names of the folders that --long_paths=remap flattens into the titles
+// of the files they held.  It looks like a slash but is allowed in titles everywhere.
+const flattenSeparator = "∕"
+
+// longNameProperty, suffixed with the chunk number, keeps the name of an item whose title
+// --long_paths=remap shortened, split in chunks to fit in properties.
+const longNameProperty = "gdrive_dir_push_name_"
+
+// shortenName returns |name| cut down to |limit| characters, keeping its extension and making it
+// unique with a hash of the whole name.
+func shortenName(name string, limit int) string {
+	sum := sha1.Sum([]byte(name))
+	tag := "~" + hex.EncodeToString(sum[:4])
+	ext := filepath.Ext(name)
+	if ext == name || utf8.RuneCountInString(ext) > limit/4 {
+		ext = ""
+	}
+	keep := limit - utf8.RuneCountInString(tag+ext)
+	if keep < 1 {
+		keep = 1
+	}
+	runes := []rune(strings.TrimSuffix(name, ext))
+	if len(runes) > keep {
+		runes = runes[:keep]
+	}
+	return string(runes) + tag + ext
+}
+
+// longNameProperties returns the properties that keep the name of the item at |relName| when its
+// title was shortened, nil otherwise.
+func (p *Pusher) longNameProperties(relName string) []*drive.Property {
+	if !p.remapped[relName] {
+		return nil
+	}
+	name := EscapeName(filepath.Base(relName))
+	var props []*drive.Property
+	for n := 0; name != ""; n++ {
+		key := fmt.Sprintf("%s%d", longNameProperty, n)
+		chunk := len(name)
+		if max := maxPropertyBytes - len(key); chunk > max {
+			chunk = max
+			for !utf8.RuneStart(name[chunk]) {
+				chunk--
+			}
+		}
+		props = append(props, &drive.Property{Key: key, Value: name[:chunk], Visibility: "PRIVATE"})
+		name = name[chunk:]
+	}
+	return props
+}
+
+// flattenFiles returns the files below |dir|, titled with their path from |dir| joined by
+// flattenSeparator, and how many folders were left out on the way.
+func flattenFiles(dir *directory_tree.Node, prefix string) ([]*directory_tree.Node, int) {
+	var files []*directory_tree.Node
+	folders := 1
+	for _, child := range dir.Children {
+		title := prefix + flattenSeparator + driveName(child)
+		if child.Info.IsDir {
+			below, n := flattenFiles(child, title)
+			files = append(files, below...)
+			folders += n
+			continue
+		}
+		child.Title = title
+		files = append(files, child)
+	}
+	return files, folders
+}
+
+// checkPathLimits finds the items of |tree| that go beyond --max_depth, --max_name_length or
+// --max_path_length, which GDrive or the clients syncing it can't cope with, before anything is
+// written.  With --long_paths=remap they are pushed under shortened titles, the original kept in
+// properties, and the files below the deepest allowed folders are flattened into them.  Otherwise
+// an error is returned.  It must run before checkNameCollisions, which catches clashes this causes.
+func (p *Pusher) checkPathLimits(tree *directory_tree.Node) error {
+	remap := p.opts.LongPaths == LongPathsRemap
+	var unfixed int
+	// fit shortens the title of |node|, at |relName| in a folder whose path is |pathLen| long, if
+	// it is over the limits, and returns the title.
+	fit := func(node *directory_tree.Node, relName, display string, pathLen int) string {
+		title := EscapeName(driveName(node))
+		limit := p.opts.MaxNameLength
+		if room := p.opts.MaxPathLength - pathLen - 1; p.opts.MaxPathLength > 0 && (limit <= 0 || room < limit) {
+			limit = room
+		}
+		if p.opts.MaxNameLength <= 0 && p.opts.MaxPathLength <= 0 {
+			return title
+		}
+		length := utf8.RuneCountInString(title)
+		if length <= limit {
+			return title
+		}
+		p.printf("Too long: %s (%d characters where %d fit)\n", display, length, limit)
+		switch {
+		case !remap:
+			unfixed++
+		case limit < 16:
+			p.printf("  can't be shortened enough, shorten the folders above it\n")
+			unfixed++
+		default:
+			node.Title = shortenName(title, limit)
+			p.remapped[relName] = true
+			p.printf("  pushing it as %q\n", node.Title)
+			title = node.Title
+		}
+		return title
+	}
+
+	var walk func(node *directory_tree.Node, relDir string, depth, pathLen int)
+	walk = func(node *directory_tree.Node, relDir string, depth, pathLen int) {
+		sort.Slice(node.Children, func(i, j int) bool { return node.Children[i].Info.Name < node.Children[j].Info.Name })
+		var flattened []*directory_tree.Node
+		children := node.Children[:0]
+		for _, child := range node.Children {
+			relName := filepath.Join(relDir, child.Info.Name)
+			display := "/" + EscapeName(relName)
+			if child.Info.IsDir {
+				display += "/"
+				if p.opts.MaxDepth > 0 && depth+1 > p.opts.MaxDepth {
+					p.printf("Too deep: %s (%d levels, --max_depth %d)\n", display, depth+1, p.opts.MaxDepth)
+					if !remap {
+						unfixed++
+						children = append(children, child)
+						continue
+					}
+					files, folders := flattenFiles(child, driveName(child))
+					p.printf("  pushing the %d file(s) below it into its parent, leaving out %d folder(s)\n", len(files), folders)
+					flattened = append(flattened, files...)
+					continue
+				}
+			}
+			children = append(children, child)
+			title := fit(child, relName, display, pathLen)
+			if child.Info.IsDir {
+				walk(child, relName, depth+1, pathLen+1+utf8.RuneCountInString(title))
+			}
+		}
+		for _, file := range flattened {
+			relName, _ := filepath.Rel(p.opts.LocalDir, file.FullPath)
+			display := "/" + EscapeName(relName)
+			fit(file, relName, display, pathLen)
+			p.printf("  pushing %s as %q\n", display, file.Title)
+		}
+		node.Children = append(children, flattened...)
+	}
+	walk(tree, ".", 0, 0)
+
+	if unfixed > 0 && remap {
+		return fmt.Errorf("%d path(s) over the limits can't be remapped", unfixed)
+	}
+	if unfixed > 0 {
+		return fmt.Errorf("%d path(s) over the limits, shorten them or pass --long_paths=%s", unfixed, LongPathsRemap)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package push
+
+import (
+	"time"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// Listener is told how a push goes, for progress displays, logs and metrics.  Pushes may work on
+// several items at once and call it from several goroutines, so implementations must be safe for
+// concurrent use.  Embedding NopListener leaves out the methods of no interest.
+type Listener interface {
+	// OnScan is called with the local |tree| once it was read, which took |took|.
+	OnScan(tree *directory_tree.Node, took time.Duration)
+	// OnFileQueued is called when the upload of |op| is queued, before OnFileStart, so that the
+	// bytes left to send are known ahead.
+	OnFileQueued(op Op)
+	// OnFileStart is called when work on |op| starts.
+	OnFileStart(op Op)
+	// OnFileProgress is called as Drive acknowledges the chunks of a resumable upload for |op|,
+	// with the bytes |sent| so far out of op.Size.
+	OnFileProgress(op Op, sent int64)
+	// OnFileDone is called once |op| succeeded.  Files moved to an old files folder are reported
+	// as done Relocate operations only.
+	OnFileDone(op Op)
+	// OnError is called when |op| failed with |err|, which usually ends the push.
+	OnError(op Op, err error)
+	// OnSummary is called once at the end of the push.
+	OnSummary(s Summary)
+}
+
+// Summary totals what a push did.
+type Summary struct {
+	FoldersCreated int
+	FilesUploaded  int
+	// FilesReplaced counts the uploads that moved an older GDrive version aside, they are part of
+	// FilesUploaded too.
+	FilesReplaced  int
+	FilesCopied    int
+	FilesRelocated int
+	FilesUnchanged int
+	BytesUploaded  int64
+	Duration       time.Duration
+	// Failures are the uploads that failed without ending the push, with --quarantine_failures.
+	Failures []Failure
+	// Violations are the paths of files left untouched because they changed locally while
+	// --immutable is set, escaped like Op.Path.
+	Violations []string
+	// Err is what ended the push early, nil if it completed.
+	Err error
+}
+
+// Failure is an item a push failed on.
+type Failure struct {
+	// Path is that of the item, escaped like Op.Path.
+	Path  string
+	Error string
+}
+
+// NopListener ignores everything, it is the Listener of pushes that are given none.
+type NopListener struct{}
+
+func (NopListener) OnScan(*directory_tree.Node, time.Duration) {}
+func (NopListener) OnFileQueued(Op)                            {}
+func (NopListener) OnFileStart(Op)                             {}
+func (NopListener) OnFileProgress(Op, int64)                   {}
+func (NopListener) OnFileDone(Op)                              {}
+func (NopListener) OnError(Op, error)                          {}
+func (NopListener) OnSummary(Summary)                          {}
@@ -0,0 +1,118 @@
+package push
+
+import (
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// cachedListing rebuilds the GDrive listing of |node| from the last sync snapshot, so that
+// directories that haven't changed since then don't need to be listed.  It returns false when the
+// snapshot can't be trusted for |node|: the directory's mtime changed (entries were added, removed
+// or renamed), it is missing from the snapshot, or --skip_unchanged_listings is off.
+func (p *Pusher) cachedListing(node *directory_tree.Node, relDir string) ([]*drive.File, bool) {
+	if !p.opts.SkipUnchangedListings || node.DriveID == "" {
+		return nil, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dir, ok := p.st.Snapshot[relDir]
+	if !ok || !dir.IsDir || dir.DriveID != node.DriveID || !dir.ModTime.Equal(node.Info.ModTime) {
+		return nil, false
+	}
+	items := make([]*drive.File, 0, len(node.Children))
+	for _, child := range node.Children {
+		relName := filepath.Join(relDir, child.Info.Name)
+		e, ok := p.st.Snapshot[relName]
+		if !ok || e.IsDir != child.Info.IsDir {
+			return nil, false
+		}
+		item := &drive.File{
+			Id:          e.DriveID,
+			Title:       driveName(child),
+			FileSize:    e.Size,
+			Md5Checksum: e.MD5,
+			Properties:  originProperties(relName),
+		}
+		if e.IsDir {
+			item.MimeType = folderMimeType
+		}
+		items = append(items, item)
+	}
+	return items, true
+}
+
+// invalidateFolder forgets the cached folder ID of |relDir| and everything below it after it
+// turned out to be stale, so the next run lists it from its parent again.
+func (p *Pusher) invalidateFolder(relDir string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prefix := relDir + string(filepath.Separator)
+	for relName := range p.st.Snapshot {
+		if relName == relDir || relDir == "." || len(relName) > len(prefix) && relName[:len(prefix)] == prefix {
+			delete(p.st.Snapshot, relName)
+		}
+	}
+}
+
+// savedListing returns the listing of the GDrive folder |parentID| saved by an earlier run, when it
+// can be trusted: --remote_changes brought it up to date, or it is within --listing_ttl and this
+// tool didn't write to the folder since.  Each is used once per run, a folder listed again gets
+// this run's own writes from GDrive.
+func (p *Pusher) savedListing(parentID string) ([]*drive.File, bool) {
+	if p.st == nil {
+		return nil, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entries, ok := p.st.Remote[parentID]
+	if !ok || p.served[parentID] {
+		return nil, false
+	}
+	listed, ok := p.st.Listed[parentID]
+	fresh := p.opts.ListingTTL > 0 && ok && time.Since(listed) < p.opts.ListingTTL
+	if !fresh && !p.followed[parentID] {
+		return nil, false
+	}
+	if p.served == nil {
+		p.served = make(map[string]bool)
+	}
+	p.served[parentID] = true
+	slog.Debug("savedListing", "id", parentID)
+	return remoteFiles(entries), true
+}
+
+// forgetListings stops trusting the saved listings of the GDrive folders |folderIDs| for
+// --listing_ttl, before this tool writes to them.  Commands that keep no sync state have none.
+func (p *Pusher) forgetListings(folderIDs ...string) {
+	if p.st == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range folderIDs {
+		delete(p.st.Listed, id)
+	}
+}
+
+// forgetItem stops trusting the saved listings that hold the GDrive item |fileID| for
+// --listing_ttl, before this tool changes it.
+func (p *Pusher) forgetItem(fileID string) {
+	if p.st == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for folderID, entries := range p.st.Remote {
+		for _, e := range entries {
+			if e.ID == fileID {
+				delete(p.st.Listed, folderID)
+				break
+			}
+		}
+	}
+}
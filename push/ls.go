@@ -0,0 +1,94 @@
+package push
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	humanize "github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+)
+
+// lsTotals counts what the ls command listed.
+type lsTotals struct {
+	folders int
+	files   int
+	bytes   int64
+}
+
+// lsFolder prints the GDrive folder |folderID|, found at |relDir| below the root, and everything
+// below it, folders after the files next to them.
+func (p *Pusher) lsFolder(ctx context.Context, folderID, relDir string, totals *lsTotals) error {
+	items, err := p.listFolder(ctx, folderID)
+	if err != nil {
+		return err
+	}
+	sort.Slice(items, func(i, j int) bool {
+		iDir, jDir := items[i].MimeType == folderMimeType, items[j].MimeType == folderMimeType
+		if iDir != jDir {
+			return jDir
+		}
+		return items[i].Title < items[j].Title
+	})
+	for _, item := range items {
+		relName := path.Join(relDir, item.Title)
+		if item.MimeType != folderMimeType {
+			totals.files++
+			totals.bytes += item.FileSize
+			p.printf("/%s (%s)\n", relName, humanize.Bytes(uint64(item.FileSize)))
+			continue
+		}
+		totals.folders++
+		p.printf("/%s/\n", relName)
+		if err := p.lsFolder(ctx, item.Id, relName, totals); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ls implements "ls [PATH]", which lists the GDrive tree under Options.RootID, or under the folder
+// at PATH below it.  With Options.Offline the listings saved by Snapshot are shown instead.
+func (p *Pusher) Ls(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Usage: ls [PATH]")
+	}
+	var rootID string
+	var err error
+	if p.opts.Offline {
+		rootID = p.offlineRootID()
+	} else {
+		if err = p.connect(ctx); err != nil {
+			return err
+		}
+		if rootID, err = p.resolveRoot(ctx); err != nil {
+			return fmt.Errorf("Problem with --gdrive_root_id: %v", err)
+		}
+	}
+
+	folderID, relDir := rootID, "."
+	if len(args) == 1 {
+		relDir = path.Clean(strings.Trim(args[0], "/"))
+	}
+	if relDir != "." {
+		for _, name := range strings.Split(relDir, "/") {
+			idx, err := p.indexFolder(ctx, folderID)
+			if err != nil {
+				return err
+			}
+			item := idx.named(name)
+			if item == nil || item.MimeType != folderMimeType {
+				return fmt.Errorf("No GDrive folder /%s under --gdrive_root_id", relDir)
+			}
+			folderID = item.Id
+		}
+	}
+
+	var totals lsTotals
+	if err := p.lsFolder(ctx, folderID, relDir, &totals); err != nil {
+		return err
+	}
+	p.printf("\n%d folder(s), %d file(s), %s\n", totals.folders, totals.files, humanize.Bytes(uint64(totals.bytes)))
+	return nil
+}
@@ -0,0 +1,192 @@
+package push
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// driveFileLink is the URL GDrive shows a file at.
+const driveFileLink = "https://drive.google.com/file/d/%s/view"
+
+// manifest is a bill of materials for a push, loosely following the SPDX 2.3 JSON layout so that
+// it can be attached to release notes and read by SPDX aware tooling.
+type manifest struct {
+	SPDXVersion  string              `json:"spdxVersion"`
+	DataLicense  string              `json:"dataLicense"`
+	SPDXID       string              `json:"SPDXID"`
+	Name         string              `json:"name"`
+	Namespace    string              `json:"documentNamespace"`
+	CreationInfo manifestCreation    `json:"creationInfo"`
+	Files        []*manifestFileInfo `json:"files"`
+	// Folders extends SPDX with the GDrive folders of the push, for --warm_start.
+	Folders []*manifestFolder `json:"folders,omitempty"`
+}
+
+type manifestCreation struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type manifestChecksum struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"checksumValue"`
+}
+
+// manifestFileInfo describes one pushed file.  FileSize, DriveID and Link extend SPDX.
+type manifestFileInfo struct {
+	SPDXID    string             `json:"SPDXID"`
+	FileName  string             `json:"fileName"`
+	Checksums []manifestChecksum `json:"checksums"`
+	FileSize  int64              `json:"fileSize"`
+	DriveID   string             `json:"driveId"`
+	Link      string             `json:"downloadLocation"`
+}
+
+// manifestFolder is one GDrive folder of a push.
+type manifestFolder struct {
+	FileName string `json:"fileName"`
+	DriveID  string `json:"driveId"`
+}
+
+// manifestName returns how the manifest names the local item at |relName|.
+func manifestName(relName string) string {
+	return "./" + filepath.ToSlash(EscapeName(relName))
+}
+
+// localSHA256 returns the hex SHA-256 of the file |name| in |fsys|.
+func localSHA256(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// buildManifest lists every file of the completed sync recorded in the snapshot.
+func (p *Pusher) buildManifest(start time.Time) (*manifest, error) {
+	name := filepath.Base(p.opts.LocalDir)
+	m := &manifest{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        name,
+		Namespace:   fmt.Sprintf("https://drive.google.com/drive/folders/%s/%s-%d", p.opts.RootID, name, start.Unix()),
+		CreationInfo: manifestCreation{
+			Created:  start.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: gdrive-dir-push"},
+		},
+		Files: []*manifestFileInfo{},
+	}
+
+	relNames := make([]string, 0, len(p.snapshot))
+	var dirNames []string
+	for relName, e := range p.snapshot {
+		if !e.IsDir {
+			relNames = append(relNames, relName)
+		} else if relName != "." {
+			dirNames = append(dirNames, relName)
+		}
+	}
+	sort.Strings(relNames)
+	sort.Strings(dirNames)
+	for _, relName := range dirNames {
+		m.Folders = append(m.Folders, &manifestFolder{FileName: manifestName(relName), DriveID: p.snapshot[relName].DriveID})
+	}
+	for i, relName := range relNames {
+		e := p.snapshot[relName]
+		sum, err := localSHA256(p.sourceFS(), filepath.ToSlash(relName))
+		if err != nil {
+			return nil, fmt.Errorf("Problem hashing %q: %v", relName, err)
+		}
+		m.Files = append(m.Files, &manifestFileInfo{
+			SPDXID:    fmt.Sprintf("SPDXRef-File-%d", i+1),
+			FileName:  manifestName(relName),
+			Checksums: []manifestChecksum{{Algorithm: "SHA256", Value: sum}},
+			FileSize:  e.Size,
+			DriveID:   e.DriveID,
+			Link:      fmt.Sprintf(driveFileLink, e.DriveID),
+		})
+	}
+	return m, nil
+}
+
+// writeManifest writes the manifest of the push that began at |start| to --manifest, signed if
+// --sign is given, and with --upload_manifest uploads it (and its signature) to the GDrive folder
+// |rootID|.  It returns the link of the uploaded manifest, if any.
+func (p *Pusher) writeManifest(ctx context.Context, start time.Time, rootID string) (string, error) {
+	m, err := p.buildManifest(start)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Create(p.opts.Manifest)
+	if err != nil {
+		return "", err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	sigPath := ""
+	if p.opts.Sign != "" {
+		if sigPath, err = p.signFile(p.opts.Manifest); err != nil {
+			return "", err
+		}
+	}
+	if !p.opts.UploadManifest {
+		return "", nil
+	}
+
+	id, err := p.uploadBeside(ctx, p.opts.Manifest, rootID)
+	if err != nil {
+		return "", err
+	}
+	if sigPath != "" {
+		if _, err := p.uploadBeside(ctx, sigPath, rootID); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf(driveFileLink, id), nil
+}
+
+// uploadBeside uploads the local file |path|, which is not part of the pushed tree, to the GDrive
+// folder |rootID|, relocating the one uploaded by the previous push to --old_files_dir.  It
+// returns the ID of the new file.
+func (p *Pusher) uploadBeside(ctx context.Context, path, rootID string) (string, error) {
+	node, err := directory_tree.NewTree(path)
+	if err != nil {
+		return "", err
+	}
+	title := filepath.Base(path)
+	remote, err := p.indexFolder(ctx, rootID)
+	if err != nil {
+		return "", fmt.Errorf("Problem listing GDrive folder: %v", err)
+	}
+	if old := remote.named(title); old != nil {
+		if err := p.relocateFile(ctx, ".", old.Id, rootID); err != nil {
+			return "", err
+		}
+	}
+	return p.createFile(ctx, node, title, rootID, Op{})
+}
@@ -0,0 +1,121 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+
+	humanize "github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+
+	"github.com/hatchling/try"
+)
+
+// driveLinkRE extracts the file ID from a GDrive link such as the ones --upload_manifest prints.
+var driveLinkRE = regexp.MustCompile(`/d/([-\w]+)`)
+
+// readManifest decodes a manifest from |r|.
+func readManifest(r io.Reader) (*manifest, error) {
+	var m manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("Not a manifest: %v", err)
+	}
+	return &m, nil
+}
+
+// loadManifest reads the manifest |ref|, which is a local file or else the ID or link of an
+// uploaded manifest.  The Drive client is only needed for the latter.
+func (p *Pusher) loadManifest(ctx context.Context, ref string) (*manifest, error) {
+	if f, err := os.Open(ref); err == nil {
+		defer f.Close()
+		return readManifest(f)
+	}
+	id := ref
+	if m := driveLinkRE.FindStringSubmatch(ref); m != nil {
+		id = m[1]
+	}
+	if err := p.connect(ctx); err != nil {
+		return nil, err
+	}
+	slog.Debug("download", "id", id)
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	var m *manifest
+	if err := try.Do(func(attempt int) (bool, error) {
+		p.countCall(ctx, callGet)
+		resp, err := p.drv.Files.Get(id).Context(ctx).Download()
+		if err == nil {
+			m, err = readManifest(resp.Body)
+			resp.Body.Close()
+		}
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return nil, fmt.Errorf("Problem downloading manifest %q: %v", ref, err)
+	}
+	return m, nil
+}
+
+// manifestSHA256 returns the SHA-256 recorded for |f|, or "" if there is none.
+func manifestSHA256(f *manifestFileInfo) string {
+	for _, c := range f.Checksums {
+		if c.Algorithm == "SHA256" {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// DiffManifests implements "manifest diff A B", which prints the files added (+), removed (-)
+// and changed (M) between the pushes described by the manifests |refA| and |refB|, local files or
+// uploaded ones, without touching GDrive contents.
+func (p *Pusher) DiffManifests(ctx context.Context, refA, refB string) error {
+	a, err := p.loadManifest(ctx, refA)
+	if err != nil {
+		return err
+	}
+	b, err := p.loadManifest(ctx, refB)
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string][2]*manifestFileInfo)
+	for i, m := range []*manifest{a, b} {
+		for _, f := range m.Files {
+			pair := files[f.FileName]
+			pair[i] = f
+			files[f.FileName] = pair
+		}
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var added, removed, changed int
+	for _, name := range names {
+		pair := files[name]
+		switch {
+		case pair[0] == nil:
+			added++
+			p.printStatus(fmt.Sprintf("+ %s (%s)\n", name, humanize.Bytes(uint64(pair[1].FileSize))))
+		case pair[1] == nil:
+			removed++
+			p.printStatus(fmt.Sprintf("- %s\n", name))
+		case manifestSHA256(pair[0]) != manifestSHA256(pair[1]):
+			changed++
+			p.printStatus(fmt.Sprintf("M %s (%s -> %s)\n", name, humanize.Bytes(uint64(pair[0].FileSize)), humanize.Bytes(uint64(pair[1].FileSize))))
+		}
+	}
+	p.printf("\n%s -> %s: %d added, %d removed, %d changed\n",
+		a.CreationInfo.Created, b.CreationInfo.Created, added, removed, changed)
+	return nil
+}
@@ -0,0 +1,207 @@
+package push
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+)
+
+// folderMerger consolidates same-named sibling folders under the managed root, which interrupted
+// runs that created a folder without recording it leave behind with the content split between
+// them.
+type folderMerger struct {
+	p     *Pusher
+	apply bool
+	// merged holds the relative paths of the folders duplicates were merged into.
+	merged []string
+	moves  int
+}
+
+// report prints one planned or applied step for |relName|.
+func (m *folderMerger) report(prefix, relName, what string) {
+	m.p.printf("%s /%s (%s)\n", prefix, EscapeName(relName), what)
+}
+
+// dedupe merges the same-named folders among the items of the GDrive folder |folderID|, found at
+// |relDir|, and then does the same in each subfolder.
+func (m *folderMerger) dedupe(ctx context.Context, folderID, relDir string) error {
+	items, err := m.p.listFolder(ctx, folderID)
+	if err != nil {
+		return fmt.Errorf("Problem listing %q: %v", relDir, err)
+	}
+	groups := make(map[string][]*drive.File)
+	var titles []string
+	for _, item := range items {
+		if item.MimeType != folderMimeType {
+			continue
+		}
+		title := normalizeName(item.Title)
+		if len(groups[title]) == 0 {
+			titles = append(titles, title)
+		}
+		groups[title] = append(groups[title], item)
+	}
+	sort.Strings(titles)
+
+	for _, title := range titles {
+		dups := groups[title]
+		relName := path.Join(relDir, dups[0].Title)
+		if len(dups) > 1 {
+			keeper, err := m.mergeDuplicates(ctx, dups, folderID, relName)
+			if err != nil {
+				return err
+			}
+			dups = []*drive.File{keeper}
+		}
+		if err := m.dedupe(ctx, dups[0].Id, relName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeDuplicates merges the same-named folders |dups| in the GDrive folder |parentID|, found at
+// |relName|, into one of them, which is returned.  The folder the sync state knows is kept so that
+// pushes carry on with it, otherwise the one holding the most items.
+func (m *folderMerger) mergeDuplicates(ctx context.Context, dups []*drive.File, parentID, relName string) (*drive.File, error) {
+	contents := make(map[string][]*drive.File, len(dups))
+	for _, dup := range dups {
+		items, err := m.p.listFolder(ctx, dup.Id)
+		if err != nil {
+			return nil, fmt.Errorf("Problem listing %q: %v", relName, err)
+		}
+		contents[dup.Id] = items
+	}
+	known := ""
+	if e, ok := m.p.st.Snapshot[relName]; ok {
+		known = e.DriveID
+	}
+	sort.SliceStable(dups, func(i, j int) bool {
+		if (dups[i].Id == known) != (dups[j].Id == known) {
+			return dups[i].Id == known
+		}
+		return len(contents[dups[i].Id]) > len(contents[dups[j].Id])
+	})
+
+	keeper := dups[0]
+	m.merged = append(m.merged, relName)
+	m.report("M", relName+"/", fmt.Sprintf("%d folders of this name, merging into %s", len(dups), keeper.Id))
+	for _, donor := range dups[1:] {
+		if err := m.merge(ctx, donor, contents[donor.Id], keeper, contents[keeper.Id], relName); err != nil {
+			return nil, err
+		}
+		m.report("-", relName+"/", fmt.Sprintf("emptied duplicate %s, trashing it", donor.Id))
+		if m.apply {
+			if err := m.p.trashFile(ctx, donor.Id); err != nil {
+				return nil, fmt.Errorf("Problem trashing duplicate of %q: %v", relName, err)
+			}
+		}
+	}
+	return keeper, nil
+}
+
+// merge moves the items |donorItems| of the folder |donor| into |keeper|, which holds
+// |keeperItems|, both found at |relName|.  Where both hold an item of the same name, subfolders
+// are merged in turn, identical files are dropped and otherwise the newer file is kept.  Items
+// that lose out are moved to --old_files_dir.
+func (m *folderMerger) merge(ctx context.Context, donor *drive.File, donorItems []*drive.File, keeper *drive.File, keeperItems []*drive.File, relName string) error {
+	existing := newRemoteIndex(keeperItems)
+	move := func(item *drive.File) error {
+		m.moves++
+		if !m.apply {
+			return nil
+		}
+		return m.p.moveFile(ctx, item.Id, donor.Id, keeper.Id)
+	}
+	retire := func(item *drive.File, parentID string) error {
+		m.moves++
+		if !m.apply {
+			return nil
+		}
+		return m.p.relocateFile(ctx, path.Join(relName, item.Title), item.Id, parentID)
+	}
+
+	for _, item := range donorItems {
+		itemRel := path.Join(relName, item.Title)
+		other := existing.named(item.Title)
+		var err error
+		switch {
+		case other == nil || (other.MimeType == folderMimeType) != (item.MimeType == folderMimeType):
+			m.report(">", itemRel, "moving into the kept folder")
+			if err = move(item); err == nil {
+				existing.add([]*drive.File{item})
+			}
+		case item.MimeType == folderMimeType:
+			var donorChildren, keeperChildren []*drive.File
+			if donorChildren, err = m.p.listFolder(ctx, item.Id); err != nil {
+				return fmt.Errorf("Problem listing %q: %v", itemRel, err)
+			}
+			if keeperChildren, err = m.p.listFolder(ctx, other.Id); err != nil {
+				return fmt.Errorf("Problem listing %q: %v", itemRel, err)
+			}
+			m.merged = append(m.merged, itemRel)
+			if err = m.merge(ctx, item, donorChildren, other, keeperChildren, itemRel); err != nil {
+				return err
+			}
+			m.report("-", itemRel+"/", fmt.Sprintf("emptied duplicate %s, trashing it", item.Id))
+			if m.apply {
+				err = m.p.trashFile(ctx, item.Id)
+			}
+		case item.Md5Checksum != "" && item.Md5Checksum == other.Md5Checksum:
+			m.report("O", itemRel, "identical copy, moving it to --old_files_dir")
+			err = retire(item, donor.Id)
+		case item.ModifiedDate > other.ModifiedDate:
+			m.report("O", itemRel, "older copy in the kept folder, moving it to --old_files_dir and the newer one in")
+			if err = retire(other, keeper.Id); err == nil {
+				err = move(item)
+			}
+		default:
+			m.report("O", itemRel, "older copy, moving it to --old_files_dir")
+			err = retire(item, donor.Id)
+		}
+		if err != nil {
+			return fmt.Errorf("Problem merging %q: %v", itemRel, err)
+		}
+	}
+	return nil
+}
+
+// MergeFolders implements "merge-folders", which reports the same-named sibling folders under
+// Options.RootID and how they would be merged, and "merge-folders apply", which merges them if
+// |apply| is set.  The sync state is saved.
+func (p *Pusher) MergeFolders(ctx context.Context, apply bool) error {
+	if p.opts.OldFilesDir == "" {
+		return fmt.Errorf("--old_files_dir must be provided")
+	}
+	if err := p.connect(ctx); err != nil {
+		return err
+	}
+	m := &folderMerger{p: p, apply: apply}
+	rootID, err := p.resolveRoot(ctx)
+	if err != nil {
+		return fmt.Errorf("Problem with --gdrive_root_id: %v", err)
+	}
+	err = m.dedupe(ctx, rootID, "")
+	if apply && len(m.merged) > 0 {
+		// IDs remembered below merged folders may belong to the trashed duplicates
+		for _, relName := range m.merged {
+			m.p.invalidateFolder(relName)
+		}
+		if err := p.st.Save(); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	p.printf("%d folder(s) with duplicates, %d item(s) to move\n", len(m.merged), m.moves)
+	if !apply && len(m.merged) > 0 {
+		p.printf("Run \"merge-folders apply\" to merge them\n")
+	}
+	usage.print(p.opts.Output)
+	return nil
+}
@@ -0,0 +1,120 @@
+package push
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// mimeOverride gives the files whose names match |glob| the MIME type |mimeType|.
+type mimeOverride struct {
+	glob     string
+	mimeType string
+}
+
+// MimeOverrides collects the repeatable --mime_type flag.  The first override that matches a file
+// decides.
+type MimeOverrides []mimeOverride
+
+func (m *MimeOverrides) String() string {
+	overrides := make([]string, len(*m))
+	for i, o := range *m {
+		overrides[i] = o.glob + "=" + o.mimeType
+	}
+	return strings.Join(overrides, ",")
+}
+
+func (m *MimeOverrides) Set(value string) error {
+	eq := strings.Index(value, "=")
+	if eq <= 0 {
+		return fmt.Errorf("Invalid MIME type override %q, expected GLOB=TYPE", value)
+	}
+	o := mimeOverride{glob: value[:eq], mimeType: strings.TrimSpace(value[eq+1:])}
+	if _, err := path.Match(o.glob, ""); err != nil {
+		return fmt.Errorf("Invalid glob %q: %v", o.glob, err)
+	}
+	if _, _, err := mime.ParseMediaType(o.mimeType); err != nil {
+		return fmt.Errorf("Invalid MIME type %q: %v", o.mimeType, err)
+	}
+	*m = append(*m, o)
+	return nil
+}
+
+// interpreterTypes maps the interpreters of "#!" lines to the MIME type of their scripts.
+var interpreterTypes = map[string]string{
+	"sh":      "text/x-shellscript",
+	"bash":    "text/x-shellscript",
+	"zsh":     "text/x-shellscript",
+	"ksh":     "text/x-shellscript",
+	"dash":    "text/x-shellscript",
+	"python":  "text/x-python",
+	"python2": "text/x-python",
+	"python3": "text/x-python",
+	"perl":    "text/x-perl",
+	"ruby":    "text/x-ruby",
+	"node":    "text/javascript",
+}
+
+// sniffMimeType guesses the MIME type of a file from its first bytes |head|, recognizing scripts by
+// their "#!" line and executables by their magic numbers besides what http.DetectContentType knows.
+func sniffMimeType(head []byte) string {
+	if bytes.HasPrefix(head, []byte("#!")) {
+		line := string(head[2:])
+		if nl := strings.IndexByte(line, '\n'); nl >= 0 {
+			line = line[:nl]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			interpreter := path.Base(fields[0])
+			if interpreter == "env" && len(fields) > 1 {
+				interpreter = fields[1]
+			}
+			if t, ok := interpreterTypes[interpreter]; ok {
+				return t
+			}
+		}
+		return "text/x-script"
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "application/x-executable"
+	case bytes.HasPrefix(head, []byte{0xcf, 0xfa, 0xed, 0xfe}), bytes.HasPrefix(head, []byte{0xce, 0xfa, 0xed, 0xfe}),
+		bytes.HasPrefix(head, []byte{0xca, 0xfe, 0xba, 0xbe}):
+		return "application/x-mach-binary"
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return "application/vnd.microsoft.portable-executable"
+	}
+	return http.DetectContentType(head)
+}
+
+// mimeTypeFor returns the MIME type to upload |localFile|, titled |title|, with: a --mime_type
+// override, else the type of its extension, else one sniffed from its contents.
+func (p *Pusher) mimeTypeFor(localFile *directory_tree.Node, title string) string {
+	name := strings.ToLower(localFile.Info.Name)
+	for _, o := range p.opts.MimeTypes {
+		if ok, _ := path.Match(strings.ToLower(o.glob), name); ok {
+			return o.mimeType
+		}
+	}
+	if t := mime.TypeByExtension(filepath.Ext(title)); t != "" {
+		return t
+	}
+	f, err := localFile.Open()
+	if err != nil {
+		return "" // The upload will report it
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return ""
+	}
+	return sniffMimeType(head[:n])
+}
@@ -0,0 +1,47 @@
+package push
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// rawNameProperty preserves the original bytes of a name that had to be escaped, base64 encoded.
+const rawNameProperty = "gdrive_dir_push_raw_name"
+
+// EscapeName makes |name| valid UTF-8 by replacing every byte that isn't part of a valid UTF-8
+// sequence, as found on legacy filesystems, with %XX.  The same form is used for status output,
+// reports and GDrive titles so that a name reads the same everywhere.  Valid names are returned
+// unchanged.
+func EscapeName(name string) string {
+	if utf8.ValidString(name) {
+		return name
+	}
+	var b strings.Builder
+	for len(name) > 0 {
+		r, size := utf8.DecodeRuneInString(name)
+		if r == utf8.RuneError && size == 1 {
+			fmt.Fprintf(&b, "%%%02X", name[0])
+		} else {
+			b.WriteString(name[:size])
+		}
+		name = name[size:]
+	}
+	return b.String()
+}
+
+// rawNameProperties returns the properties that preserve |name| on a GDrive item whose title is
+// its escaped form, or nil when the name needed no escaping or is too long for a property.
+func rawNameProperties(name string) []*drive.Property {
+	if utf8.ValidString(name) {
+		return nil
+	}
+	v := base64.StdEncoding.EncodeToString([]byte(name))
+	if len(rawNameProperty)+len(v) > maxPropertyBytes {
+		return nil
+	}
+	return []*drive.Property{{Key: rawNameProperty, Value: v, Visibility: "PRIVATE"}}
+}
@@ -0,0 +1,160 @@
+package push
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Bounds of the pause --nice puts between requests.
+const (
+	niceMinDelay = 50 * time.Millisecond
+	niceMaxDelay = 10 * time.Second
+)
+
+// niceTransport wraps the HTTP transport of the Drive client for --nice.  It watches how long
+// requests take and how often Drive pushes back, and while the account looks busy it lets fewer
+// requests be in flight and pauses before each one, so that people using Drive interactively and
+// other sync clients on the same account aren't starved by a big push.  Once requests are fast
+// and accepted again it speeds back up, one step at a time.
+type niceTransport struct {
+	base http.RoundTripper
+
+	mu sync.Mutex
+	// freed is closed, and replaced, whenever requests waiting for the limit may go in flight.
+	freed    chan struct{}
+	maxLimit int
+	limit    int // requests allowed in flight
+	inFlight int
+	delay    time.Duration // pause before each request
+	baseline time.Duration // smoothed latency of small requests that went through fine
+	healthy  int           // responses that went through fine since the last change
+}
+
+// NewNiceTransport returns an HTTP transport for Drive clients that backs off from |base| while
+// the account looks busy (--nice), letting no more than |maxLimit| requests be in flight.
+func NewNiceTransport(base http.RoundTripper, maxLimit int) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if maxLimit < 1 {
+		maxLimit = 1
+	}
+	return &niceTransport{base: base, maxLimit: maxLimit, limit: maxLimit, freed: make(chan struct{})}
+}
+
+// wake lets the requests waiting for the limit check it again.  The caller holds t.mu.
+func (t *niceTransport) wake() {
+	close(t.freed)
+	t.freed = make(chan struct{})
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *niceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	for t.inFlight >= t.limit {
+		freed := t.freed
+		t.mu.Unlock()
+		select {
+		case <-freed:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		t.mu.Lock()
+	}
+	t.inFlight++
+	delay := t.delay
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.inFlight--
+		t.wake()
+		t.mu.Unlock()
+	}()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		// Uploads take as long as their data needs, only small requests tell how busy Drive is
+		small := req.ContentLength >= 0 && req.ContentLength < 1<<20
+		t.observe(resp.StatusCode, pushedBack(resp), small, time.Since(start))
+	}
+	return resp, err
+}
+
+// pushedBack reports whether |resp| is Drive pushing back, as the responses Retryable retries are,
+// including a 403 whose reason is rate limiting.  The body of an error response is read to tell
+// and put back for the caller.
+func pushedBack(resp *http.Response) bool {
+	if resp.StatusCode < 400 {
+		return false
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	return Retryable(googleapi.CheckResponse(&http.Response{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       io.NopCloser(bytes.NewReader(data)),
+	}))
+}
+
+// observe adjusts the pace after a response with |status|, which is |busy| if Drive pushed back,
+// that took |latency|.
+func (t *niceTransport) observe(status int, busy, small bool, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if small && !busy {
+		if t.baseline == 0 {
+			t.baseline = latency
+		}
+		// Allow for jitter, which matters most while the baseline is small
+		busy = latency > 3*t.baseline+250*time.Millisecond
+		if !busy {
+			t.baseline = (9*t.baseline + latency) / 10
+		}
+	}
+
+	if busy {
+		t.healthy = 0
+		if t.limit > 1 {
+			t.limit /= 2
+		}
+		t.delay *= 2
+		if t.delay < niceMinDelay {
+			t.delay = niceMinDelay
+		} else if t.delay > niceMaxDelay {
+			t.delay = niceMaxDelay
+		}
+		slog.Debug("--nice: Drive looks busy, slowing down", "status", status, "latency", latency, "limit", t.limit, "delay", t.delay)
+		return
+	}
+	if t.healthy++; t.healthy < 20 {
+		return
+	}
+	t.healthy = 0
+	switch {
+	case t.delay > 0:
+		if t.delay /= 2; t.delay < niceMinDelay {
+			t.delay = 0
+		}
+	case t.limit < t.maxLimit:
+		t.limit++
+		t.wake()
+	}
+}
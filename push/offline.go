@@ -0,0 +1,99 @@
+package push
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+// offlineListing serves the listing of |parentID| from the listings saved in the sync state, for
+// --offline plans.  It returns an error if the folder was never listed.
+func (p *Pusher) offlineListing(parentID string) ([]*drive.File, error) {
+	entries, ok := p.st.Remote[parentID]
+	if !ok {
+		return nil, fmt.Errorf("GDrive folder %q is not in the saved listings, run the snapshot command while online", parentID)
+	}
+	return remoteFiles(entries), nil
+}
+
+// remoteFiles turns the saved listing |entries| back into GDrive items.
+func remoteFiles(entries []*state.RemoteEntry) []*drive.File {
+	files := make([]*drive.File, 0, len(entries))
+	for _, e := range entries {
+		f := &drive.File{
+			Id:          e.ID,
+			Title:       e.Title,
+			MimeType:    e.MimeType,
+			FileSize:    e.Size,
+			Md5Checksum: e.MD5,
+		}
+		if e.Origin != "" {
+			f.Properties = []*drive.Property{{Key: originProperty, Value: e.Origin}}
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// remoteEntry returns how the GDrive item |f| is saved in a listing.
+func remoteEntry(f *drive.File) *state.RemoteEntry {
+	return &state.RemoteEntry{
+		ID:       f.Id,
+		Title:    f.Title,
+		MimeType: f.MimeType,
+		Size:     f.FileSize,
+		MD5:      f.Md5Checksum,
+		Origin:   originOf(f),
+	}
+}
+
+// offlineRootID returns the folder ID to plan against with --offline.
+func (p *Pusher) offlineRootID() string {
+	if p.st.ResolvedRootID != "" {
+		return p.st.ResolvedRootID
+	}
+	return p.opts.RootID
+}
+
+// Snapshot implements "snapshot", which lists the whole remote tree under Options.RootID into
+// the sync state so that later offline plans (possibly on another machine, see "state export")
+// have every folder available.  The sync state is saved.
+func (p *Pusher) Snapshot(ctx context.Context) error {
+	if err := p.connect(ctx); err != nil {
+		return err
+	}
+	rootID, err := p.resolveRoot(ctx)
+	if err != nil {
+		return fmt.Errorf("Problem with --gdrive_root_id: %v", err)
+	}
+	st := p.st
+	st.ResolvedRootID = rootID
+	st.Remote = make(map[string][]*state.RemoteEntry)
+	st.Listed = make(map[string]time.Time)
+
+	var items int
+	pending := []string{rootID}
+	for len(pending) > 0 {
+		folderID := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		children, err := p.listFolder(ctx, folderID)
+		if err != nil {
+			return err
+		}
+		for _, c := range children {
+			items++
+			if c.MimeType == folderMimeType {
+				pending = append(pending, c.Id)
+			}
+		}
+	}
+	if err := st.Save(); err != nil {
+		return err
+	}
+	p.printf("Saved %d folder listings with %d items\n", len(st.Remote), items)
+	return nil
+}
@@ -0,0 +1,91 @@
+package push
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// oldFilesRule sends the GDrive files replaced or removed under the local subtree |prefix| to the
+// GDrive folder |folderID| instead of --old_files_dir.
+type oldFilesRule struct {
+	prefix   string
+	folderID string
+}
+
+// OldFilesTable collects the repeatable --old_files_dir_for flag.  The rule with the longest
+// matching prefix decides.
+type OldFilesTable []oldFilesRule
+
+func (t *OldFilesTable) String() string {
+	rules := make([]string, len(*t))
+	for i, rule := range *t {
+		rules[i] = rule.prefix + "=" + rule.folderID
+	}
+	return strings.Join(rules, ",")
+}
+
+func (t *OldFilesTable) Set(value string) error {
+	eq := strings.LastIndex(value, "=")
+	if eq <= 0 || strings.TrimSpace(value[eq+1:]) == "" {
+		return fmt.Errorf("Invalid old files rule %q, expected PREFIX=FOLDER_ID", value)
+	}
+	prefix := path.Clean(filepath.ToSlash(value[:eq]))
+	if path.IsAbs(prefix) || prefix == ".." || strings.HasPrefix(prefix, "../") {
+		return fmt.Errorf("Invalid old files prefix %q, expected a path relative to --local_dir_to_push", value[:eq])
+	}
+	for _, rule := range *t {
+		if rule.prefix == prefix {
+			return fmt.Errorf("Duplicate old files prefix %q", value[:eq])
+		}
+	}
+	*t = append(*t, oldFilesRule{prefix: prefix, folderID: strings.TrimSpace(value[eq+1:])})
+	return nil
+}
+
+// oldFilesDirFor returns the GDrive folder that the file found at |relName| goes to when it is
+// replaced or removed: that of the --old_files_dir_for rule with the longest prefix covering it,
+// else --old_files_dir.
+func (p *Pusher) oldFilesDirFor(relName string) string {
+	name := path.Clean(filepath.ToSlash(relName))
+	folderID, longest := p.opts.OldFilesDir, -1
+	for _, rule := range p.opts.OldFilesDirFor {
+		if rule.prefix == "." {
+			// Covers the whole tree, as the least specific rule
+			if longest < 0 {
+				folderID, longest = rule.folderID, 0
+			}
+			continue
+		}
+		covered := name == rule.prefix || strings.HasPrefix(name, rule.prefix+"/")
+		if covered && len(rule.prefix) > longest {
+			folderID, longest = rule.folderID, len(rule.prefix)
+		}
+	}
+	return folderID
+}
+
+// oldFilesDirs returns every GDrive folder files are moved to when replaced or removed:
+// --old_files_dir and those of the --old_files_dir_for rules.
+func (p *Pusher) oldFilesDirs() []string {
+	ids := []string{p.opts.OldFilesDir}
+	seen := map[string]bool{p.opts.OldFilesDir: true}
+	for _, rule := range p.opts.OldFilesDirFor {
+		if !seen[rule.folderID] {
+			seen[rule.folderID] = true
+			ids = append(ids, rule.folderID)
+		}
+	}
+	return ids
+}
+
+// isOldFilesDir reports whether |id| is one of the folders of oldFilesDirs.
+func (p *Pusher) isOldFilesDir(id string) bool {
+	for _, dir := range p.oldFilesDirs() {
+		if id == dir {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package push
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"path/filepath"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// originProperty holds the local path, relative to --local_dir_to_push, that a GDrive item was
+// pushed from.
+const originProperty = "gdrive_dir_push_origin"
+
+// maxPropertyBytes is the limit GDrive puts on the key and value of a property combined.
+const maxPropertyBytes = 124
+
+// originValue encodes |relName| for originProperty.  Paths too long for a property are replaced
+// by their SHA-1.
+func originValue(relName string) string {
+	v := filepath.ToSlash(EscapeName(relName))
+	if len(originProperty)+len(v) <= maxPropertyBytes {
+		return v
+	}
+	sum := sha1.Sum([]byte(v))
+	return "sha1:" + hex.EncodeToString(sum[:])
+}
+
+// originProperties returns the properties that tag a new GDrive item as pushed from |relName|.
+func originProperties(relName string) []*drive.Property {
+	return []*drive.Property{
+		{Key: originProperty, Value: originValue(relName), Visibility: "PRIVATE"},
+	}
+}
+
+// originOf returns the originProperty of |f|, or "" if it has none.
+func originOf(f *drive.File) string {
+	for _, prop := range f.Properties {
+		if prop.Key == originProperty {
+			return prop.Value
+		}
+	}
+	return ""
+}
+
+// managed reports whether |f| may be relocated, replaced or deleted.  With --only_manage_own that
+// is only so for items this tool pushed, which carry originProperty; being private, the property
+// can't be set by other apps or people.
+func (p *Pusher) managed(f *drive.File) bool {
+	return !p.opts.OnlyManageOwn || originOf(f) != ""
+}
+
+// match finds the GDrive item in the index that corresponds to |localItem|.  With |byOrigin|
+// (--match_by=origin) items are matched on originProperty first, so that items renamed on the
+// GDrive side are still recognized, falling back to matching on the title.
+func (idx *remoteIndex) match(localItem *directory_tree.Node, relName string, byOrigin bool) *drive.File {
+	if byOrigin {
+		if item, ok := idx.byOrigin[originValue(relName)]; ok {
+			return item
+		}
+	}
+	return idx.named(driveName(localItem))
+}
@@ -0,0 +1,51 @@
+package push
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+)
+
+// partialProperty marks files uploaded under their --partial_name, its value is the
+// --gdrive_root_id they were pushed to so that cleanup stays scoped to the managed root.
+const partialProperty = "gdrive_dir_push_partial"
+
+// partialTitle returns the name |title| is uploaded under until it is complete.
+func (p *Pusher) partialTitle(title string) string {
+	return fmt.Sprintf(p.opts.PartialName, title)
+}
+
+// isPartialTitle reports whether |title| has the --partial_name form.
+func (p *Pusher) isPartialTitle(title string) bool {
+	i := strings.Index(p.opts.PartialName, "%s")
+	prefix, suffix := (p.opts.PartialName)[:i], (p.opts.PartialName)[i+2:]
+	return len(title) > len(prefix)+len(suffix) && strings.HasPrefix(title, prefix) && strings.HasSuffix(title, suffix)
+}
+
+// partialProperties returns the properties that mark a file as still being uploaded.
+func (p *Pusher) partialProperties() []*drive.Property {
+	return []*drive.Property{{Key: partialProperty, Value: p.opts.RootID, Visibility: "PRIVATE"}}
+}
+
+// cleanPartials trashes files that a crashed run left under their --partial_name.  Files that were
+// renamed once complete keep the property but no longer have the partial form.
+func (p *Pusher) cleanPartials(ctx context.Context) error {
+	query := fmt.Sprintf("trashed=false and properties has { key='%s' and value='%s' and visibility='PRIVATE' }",
+		partialProperty, p.opts.RootID)
+	files, err := p.listQuery(ctx, query)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !p.isPartialTitle(f.Title) {
+			continue
+		}
+		p.printf("- stale %s (%s)\n", f.Title, f.Id)
+		if err := p.trashFile(ctx, f.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package push
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// OpKind is what an Op does.
+type OpKind string
+
+// The kinds of write operations a push makes.
+const (
+	CreateFolder OpKind = "create folder"
+	Upload       OpKind = "upload"
+	// Replace moves the GDrive file to its old files folder and uploads the local one in its
+	// place.  Plans list it as a Relocate and an Upload.
+	Replace  OpKind = "replace"
+	Relocate OpKind = "relocate"
+	// Copy creates a file as a copy of one already in GDrive, with --dedup_dirs.
+	Copy OpKind = "copy"
+)
+
+// Op is one write operation of a push.
+type Op struct {
+	Kind OpKind
+	// Path is the path of the item from the pushed directory, with forward slashes and bytes
+	// that aren't valid UTF-8 escaped as %XX, the way status lines show it.
+	Path string
+	// Size is the size of the local file, 0 for folders.
+	Size int64
+	// ID is the GDrive item the operation created or moved, set once it is done.
+	ID string
+	// Parent is the GDrive folder the item went in, set once it is done.
+	Parent string
+}
+
+// fileOp returns the Op that uploading |localItem|, found at |relName|, is reported to the
+// listener as.
+func fileOp(localItem *directory_tree.Node, relName string, replace bool) Op {
+	op := Op{Kind: Upload, Path: filepath.ToSlash(EscapeName(relName)), Size: localItem.Info.Size}
+	if localItem.Info.IsDir {
+		op.Kind, op.Size = CreateFolder, 0
+	} else if replace {
+		op.Kind = Replace
+	}
+	return op
+}
+
+// Plan is what a push would do, in the order it would do it.
+type Plan struct {
+	Ops []Op
+	// Unchanged counts the files GDrive already has the content of.
+	Unchanged int
+
+	mu sync.Mutex
+}
+
+// Bytes returns how many bytes the plan uploads.
+func (pl *Plan) Bytes() int64 {
+	var n int64
+	for _, op := range pl.Ops {
+		if op.Kind == Upload {
+			n += op.Size
+		}
+	}
+	return n
+}
+
+// planned records that |kind| would have been done to |relName|, of |size| bytes, unless this isn't
+// a dry run.
+func (p *Pusher) planned(kind OpKind, relName string, size int64) {
+	if p.opts.DryRun {
+		p.plan.mu.Lock()
+		p.plan.Ops = append(p.plan.Ops, Op{Kind: kind, Path: filepath.ToSlash(EscapeName(relName)), Size: size})
+		p.plan.mu.Unlock()
+	}
+}
+
+// print writes the plan, followed by its totals, to |w|.
+func (pl *Plan) print(w io.Writer) {
+	counts := make(map[OpKind]int)
+	fmt.Fprintf(w, "Plan:\n")
+	for _, op := range pl.Ops {
+		counts[op.Kind]++
+		switch op.Kind {
+		case CreateFolder:
+			fmt.Fprintf(w, "  %-13s /%s/\n", op.Kind, op.Path)
+		case Upload:
+			fmt.Fprintf(w, "  %-13s /%s (%s)\n", op.Kind, op.Path, humanize.Bytes(uint64(op.Size)))
+		case Copy:
+			fmt.Fprintf(w, "  %-13s /%s (%s, in GDrive)\n", op.Kind, op.Path, humanize.Bytes(uint64(op.Size)))
+		case Relocate:
+			fmt.Fprintf(w, "  %-13s /%s to --old_files_dir\n", op.Kind, op.Path)
+		}
+	}
+	if len(pl.Ops) == 0 {
+		fmt.Fprintf(w, "  nothing to do\n")
+	}
+	fmt.Fprintf(w, "%d folder(s) to create, %d file(s) to upload (%s), %d file(s) to copy, %d file(s) to relocate\n",
+		counts[CreateFolder], counts[Upload], humanize.Bytes(uint64(pl.Bytes())), counts[Copy], counts[Relocate])
+}
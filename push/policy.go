@@ -0,0 +1,95 @@
+package push
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// Actions a --policy rule can give files.
+const (
+	PolicySkip     = "skip"      // never pushed
+	PolicySizeOnly = "size_only" // compared by size alone, never hashed
+	PolicyConvert  = "convert"   // converted to the matching Google Docs format
+	PolicyCompress = "compress"  // pushed gzip compressed as "name.gz"
+)
+
+// policyRule gives the files whose names match |glob| the action |action|.
+type policyRule struct {
+	glob   string
+	action string
+}
+
+// PolicyTable collects the repeatable --policy flag.  The first rule that matches a file decides.
+type PolicyTable []policyRule
+
+func (t *PolicyTable) String() string {
+	rules := make([]string, len(*t))
+	for i, rule := range *t {
+		rules[i] = rule.glob + "=" + rule.action
+	}
+	return strings.Join(rules, ",")
+}
+
+func (t *PolicyTable) Set(value string) error {
+	eq := strings.LastIndex(value, "=")
+	if eq <= 0 {
+		return fmt.Errorf("Invalid policy %q, expected GLOB=ACTION", value)
+	}
+	rule := policyRule{glob: value[:eq], action: strings.TrimSpace(value[eq+1:])}
+	if _, err := path.Match(rule.glob, ""); err != nil {
+		return fmt.Errorf("Invalid glob %q: %v", rule.glob, err)
+	}
+	switch rule.action {
+	case PolicySkip, PolicySizeOnly, PolicyConvert, PolicyCompress:
+	default:
+		return fmt.Errorf("Invalid policy action %q, expected %s, %s, %s or %s", rule.action, PolicySkip, PolicySizeOnly, PolicyConvert, PolicyCompress)
+	}
+	*t = append(*t, rule)
+	return nil
+}
+
+// policyFor returns the --policy action for the file |node|, "" when no rule matches.  Globs are
+// matched against the file name, ignoring case so that "*.raw" also covers "IMG_01.RAW".
+func (p *Pusher) policyFor(node *directory_tree.Node) string {
+	if node.Info.IsDir {
+		return ""
+	}
+	name := strings.ToLower(node.Info.Name)
+	for _, rule := range p.opts.Policies {
+		if ok, _ := path.Match(strings.ToLower(rule.glob), name); ok {
+			return rule.action
+		}
+	}
+	return ""
+}
+
+// applyPolicies gives the files of |tree| that --policy compresses their "name.gz" title, so that
+// they are matched against what earlier pushes stored.  It must run before checkNameCollisions.
+func (p *Pusher) applyPolicies(tree *directory_tree.Node) {
+	for _, child := range tree.Children {
+		if child.Info.IsDir {
+			p.applyPolicies(child)
+		} else if p.policyFor(child) == PolicyCompress {
+			child.Title = child.Info.Name + ".gz"
+		}
+	}
+}
+
+// gzipReader returns a reader of |r| compressed with gzip.  Closing it stops the compression.
+func gzipReader(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
@@ -0,0 +1,258 @@
+package push
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// uploadClass queues the uploads of files of one size class, which run on up to |slots| workers
+// of their own.  Reserving workers for each class keeps a few huge files from holding up hundreds
+// of small ones, and a stream of small files from holding up the huge ones.
+type uploadClass struct {
+	slots   int
+	running int
+	queue   []func() error
+}
+
+// workPool runs jobs on up to |size|-1 worker goroutines besides the one submitting them.  A job
+// submitted while every worker is busy runs on the submitting goroutine instead, so jobs that
+// submit more jobs, like folders processing their subfolders, can never deadlock waiting for a
+// free worker.  Uploads are queued by size class instead, each with workers of their own.
+type workPool struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+	// stop stops the pool once closed, and large is the size from which uploads are large.
+	stop  <-chan struct{}
+	large uint64
+
+	mu   sync.Mutex
+	errs []error
+	// smallFiles and largeFiles queue the uploads, they are nil for a pool of one that runs
+	// everything on the submitting goroutine.
+	smallFiles, largeFiles *uploadClass
+}
+
+// newWorkPool returns a pool of --parallel workers, split between small and large uploads as
+// --large_file_size and --large_file_slots say, which stops with the push.
+func (p *Pusher) newWorkPool() *workPool {
+	size := p.opts.Parallel
+	w := &workPool{slots: make(chan struct{}, size-1), stop: p.opts.Stop, large: p.opts.LargeFileSize}
+	if size > 1 {
+		large := p.opts.LargeFileSlots
+		if large == 0 {
+			large = size / 2
+		}
+		w.smallFiles, w.largeFiles = &uploadClass{slots: size - large}, &uploadClass{slots: large}
+	}
+	return w
+}
+
+// runUpload queues |job|, the upload of a file of |size| bytes, to run on a worker of its size
+// class once one is free.
+func (w *workPool) runUpload(size int64, job func() error) {
+	c := w.smallFiles
+	if uint64(size) >= w.large {
+		c = w.largeFiles
+	}
+	if c == nil {
+		w.run(job)
+		return
+	}
+	if w.stopped() {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	c.queue = append(c.queue, job)
+	if c.running < c.slots {
+		c.running++
+		w.wg.Add(1)
+		go w.drain(c)
+	}
+}
+
+// drain runs the queued uploads of |c| until there are none left.  Once a job has failed, or the
+// run was interrupted, those still queued are dropped.
+func (w *workPool) drain(c *uploadClass) {
+	defer w.wg.Done()
+	for {
+		w.mu.Lock()
+		if len(w.errs) > 0 || w.stopping() {
+			c.queue = nil
+		}
+		if len(c.queue) == 0 {
+			c.running--
+			w.mu.Unlock()
+			return
+		}
+		job := c.queue[0]
+		c.queue = c.queue[1:]
+		w.mu.Unlock()
+		w.fail(job())
+	}
+}
+
+// run runs |job|, on a worker if one is free.  Once a job has failed, or the run was interrupted,
+// no new jobs are started, while those already running are left to finish so that their uploads
+// aren't wasted.
+func (w *workPool) run(job func() error) {
+	if w.stopped() {
+		return
+	}
+	select {
+	case w.slots <- struct{}{}:
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			w.fail(job())
+			<-w.slots
+		}()
+	default:
+		w.fail(job())
+	}
+}
+
+// fail records |err|, if any.
+func (w *workPool) fail(err error) {
+	if err == nil {
+		return
+	}
+	w.mu.Lock()
+	w.errs = append(w.errs, err)
+	w.mu.Unlock()
+}
+
+// stopped reports whether a job has failed, or the run was interrupted.
+func (w *workPool) stopped() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.errs) > 0 || w.stopping()
+}
+
+// stopping reports whether the push was asked to stop.
+func (w *workPool) stopping() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait waits for the running jobs to finish and returns every error they failed with.
+func (w *workPool) wait() error {
+	w.wg.Wait()
+	switch len(w.errs) {
+	case 0:
+		return nil
+	case 1:
+		return w.errs[0]
+	}
+	msgs := make([]string, len(w.errs))
+	for i, err := range w.errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Errorf("%d operations failed:\n  %s", len(w.errs), strings.Join(msgs, "\n  "))
+}
+
+// statusLine is a line of status output, followed by the lines for the contents of the folder it
+// introduces.  Lines are printed in the order they were added, however the workers happen to
+// finish them, so that output with --parallel reads the same as a serial run.
+type statusLine struct {
+	out *statusOutput
+
+	text    string
+	ready   bool // text is final
+	printed bool
+	ended   bool // no more lines will be added below it
+	lines   []*statusLine
+}
+
+// statusOutput guards a tree of status lines, which are written to |w|.
+type statusOutput struct {
+	w    io.Writer
+	mu   sync.Mutex
+	root *statusLine
+}
+
+// newStatusOutput returns the empty top line that the status lines of a walk are added below.
+func (p *Pusher) newStatusOutput() *statusLine {
+	out := &statusOutput{w: p.opts.Output}
+	out.root = &statusLine{out: out, ready: true, printed: true}
+	return out.root
+}
+
+// add reserves the next line below |l| for a file.
+func (l *statusLine) add() *statusLine {
+	return l.addLine(true)
+}
+
+// addFolder reserves the next line below |l| for a folder, whose contents are added below it
+// until end is called.
+func (l *statusLine) addFolder() *statusLine {
+	return l.addLine(false)
+}
+
+func (l *statusLine) addLine(ended bool) *statusLine {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	line := &statusLine{out: l.out, ended: ended}
+	l.lines = append(l.lines, line)
+	return line
+}
+
+// print sets the text of |l| and prints whatever output is now complete.
+func (l *statusLine) print(format string, a ...interface{}) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.text = fmt.Sprintf(format, a...)
+	l.ready = true
+	l.out.root.emit()
+}
+
+// end notes that no more lines will be added below |l|.
+func (l *statusLine) end() {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.ended = true
+	l.out.root.emit()
+}
+
+// emit prints the lines of |l| that are due and returns whether all of them have been printed.
+func (l *statusLine) emit() bool {
+	if !l.ready {
+		return false
+	}
+	if !l.printed {
+		io.WriteString(l.out.w, l.text)
+		l.printed = true
+	}
+	for len(l.lines) > 0 {
+		if !l.lines[0].emit() {
+			return false
+		}
+		l.lines = l.lines[1:]
+	}
+	return l.ended
+}
+
+// drain prints every line that is still held back by one that will never be finished, such as
+// after a failure.
+func (l *statusLine) drain() {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.root.flushAll()
+}
+
+func (l *statusLine) flushAll() {
+	if l.ready && !l.printed {
+		io.WriteString(l.out.w, l.text)
+		l.printed = true
+	}
+	for _, line := range l.lines {
+		line.flushAll()
+	}
+	l.lines = nil
+}
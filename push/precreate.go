@@ -0,0 +1,100 @@
+package push
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// precreateFolders creates the GDrive folders missing for |tree| before any file is uploaded.
+// Each folder can only be created once its parent's ID is known, which makes folder creation the
+// bottleneck for brand new deep trees when done during the walk.  Here independent chains are
+// created concurrently by up to --precreate_folders workers, parents always before their children.
+// The IDs are filled into the tree so that processNode finds the folders in place.
+func (p *Pusher) precreateFolders(ctx context.Context, tree *directory_tree.Node) error {
+	if p.precreated == nil {
+		p.precreated = make(map[string]*remoteIndex)
+	}
+	sem := make(chan struct{}, p.opts.PrecreateFolders)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+	}
+
+	// visit makes sure the subfolders of |node|, whose folder already exists, exist too.  |fresh|
+	// tells that the folder was just created and so holds nothing yet.
+	var visit func(node *directory_tree.Node, relDir string, fresh bool)
+	visit = func(node *directory_tree.Node, relDir string, fresh bool) {
+		defer wg.Done()
+		if ctx.Err() != nil {
+			return
+		}
+		sem <- struct{}{}
+		remoteItems := newRemoteIndex(nil)
+		if !fresh {
+			var err error
+			if remoteItems, err = p.indexFolder(ctx, node.DriveID); err != nil {
+				<-sem
+				fail(fmt.Errorf("Problem listing GDrive folder %q: %v", relDir, err))
+				return
+			}
+		}
+		var created []*drive.File
+		freshChildren := make(map[*directory_tree.Node]bool)
+		for _, child := range node.Children {
+			if !child.Info.IsDir {
+				continue
+			}
+			relName := filepath.Join(relDir, child.Info.Name)
+			if remote := remoteItems.match(child, relName, p.opts.MatchBy == "origin"); remote != nil {
+				child.DriveID = remote.Id
+				continue
+			}
+			id, err := p.createFolder(ctx, driveName(child), relName, node.DriveID, child.Info.ModTime)
+			if err != nil {
+				<-sem
+				fail(fmt.Errorf("Problem creating GDrive folder %q: %v", relName, err))
+				return
+			}
+			child.DriveID = id
+			p.resumeLog.record(&resumeEntry{Op: resumeMkdir, Path: relName, ID: id, Parent: node.DriveID, Title: EscapeName(driveName(child))})
+			freshChildren[child] = true
+			created = append(created, &drive.File{
+				Id:         id,
+				Title:      EscapeName(driveName(child)),
+				MimeType:   folderMimeType,
+				Properties: originProperties(relName),
+			})
+			p.printf("+ /%s/\n", EscapeName(relName))
+		}
+		<-sem
+
+		p.mu.Lock()
+		p.stats.foldersCreated += len(created)
+		if fresh {
+			p.precreated[node.DriveID] = newRemoteIndex(created)
+		}
+		p.mu.Unlock()
+		for _, child := range node.Children {
+			if child.Info.IsDir && child.DriveID != "" {
+				wg.Add(1)
+				go visit(child, filepath.Join(relDir, child.Info.Name), freshChildren[child])
+			}
+		}
+	}
+
+	wg.Add(1)
+	visit(tree, ".", false)
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
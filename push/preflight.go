@@ -0,0 +1,69 @@
+package push
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+
+	"github.com/hatchling/gdrive-dir-push/oauth"
+)
+
+// driveEndpoint is the URL used to tell which proxy, if any, Drive requests go through.
+const driveEndpoint = "https://www.googleapis.com/drive/v2/"
+
+// preflight makes one cheap authorized request before the push starts, which refreshes the token
+// and checks that Drive can be reached, so that a broken network or revoked authorization is
+// reported up front instead of from deep inside the first folder listing.  Requests go through the
+// proxy given by the standard HTTPS_PROXY and NO_PROXY environment variables.
+//
+// Unlike other Drive calls this isn't retried: the point is to fail fast.
+func (p *Pusher) preflight(ctx context.Context) error {
+	proxy := proxyFor(driveEndpoint)
+	slog.Debug("preflight", "proxy", proxy)
+
+	p.countCall(ctx, callAbout)
+	about, err := p.drv.About.Get().Fields("user,quotaBytesTotal,quotaBytesUsed").Context(ctx).Do()
+	if err == nil {
+		p.quota = about
+		if about.User != nil {
+			slog.Debug("Authorized", "user", about.User.EmailAddress)
+		}
+		return nil
+	}
+
+	var retrieveErr *oauth2.RetrieveError
+	var apiErr *googleapi.Error
+	var netErr net.Error
+	switch {
+	case errors.As(err, &retrieveErr) || oauth.AuthFailed():
+		return fmt.Errorf("Authorization failed, the saved token was probably revoked or has expired (run init to authorize again): %v", err)
+	case errors.As(err, &apiErr) && (apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden):
+		return fmt.Errorf("Drive refused the authorization, check that the Drive API is enabled for the OAuth client: %v", err)
+	case errors.As(err, &netErr):
+		if proxy != "" {
+			return fmt.Errorf("Could not reach Drive through proxy %s: %v", proxy, err)
+		}
+		return fmt.Errorf("Could not reach Drive, check the network (or set HTTPS_PROXY): %v", err)
+	}
+	return fmt.Errorf("Preflight check failed: %v", err)
+}
+
+// proxyFor returns the proxy the environment configures for |rawURL|, or "" for a direct
+// connection.
+func proxyFor(rawURL string) string {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return ""
+	}
+	proxy, err := http.ProxyFromEnvironment(req)
+	if err != nil || proxy == nil {
+		return ""
+	}
+	return proxy.Host
+}
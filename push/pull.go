@@ -0,0 +1,185 @@
+package push
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/try"
+)
+
+// pullStats counts what a pull did.
+type pullStats struct {
+	downloaded, unchanged, skipped int
+	bytes                          int64
+}
+
+// downloadFile writes the content of the GDrive file |f| to |path|, going through a temporary
+// file so that an interrupted download never leaves a truncated file behind.  It returns an error
+// if the operation fails.
+func (p *Pusher) downloadFile(ctx context.Context, f *drive.File, path string) error {
+	slog.Debug("downloadFile", "id", f.Id, "path", path)
+	tmp := path + ".gdrive-dir-push.tmp"
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	if err := try.Do(func(attempt int) (bool, error) {
+		p.countCall(ctx, callDownload)
+		resp, err := p.drv.Files.Get(f.Id).Context(ctx).Download()
+		if err == nil {
+			var out *os.File
+			if out, err = os.Create(tmp); err == nil {
+				_, err = io.Copy(out, resp.Body)
+				if cerr := out.Close(); err == nil {
+					err = cerr
+				}
+			}
+			resp.Body.Close()
+		}
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("A Download() error occurred: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if t, err := time.Parse(time.RFC3339, f.ModifiedDate); err == nil {
+		os.Chtimes(path, t, t)
+	}
+	return nil
+}
+
+// localTitle returns the local name of a GDrive item titled |title|, or false if it can't have
+// one.  GDrive allows characters in titles that local filesystems don't: path separators become
+// "_".  Empty titles, "." and ".." would name the directory the item is in or one above it, so
+// anyone able to write to the GDrive folder could have files written outside the local dir.
+func localTitle(title string) (string, bool) {
+	name := strings.NewReplacer("/", "_", string(filepath.Separator), "_").Replace(title)
+	if name == "" || name == "." || name == ".." {
+		return "", false
+	}
+	return name, true
+}
+
+// insideLocalDir reports whether |path| is --local_dir_to_push or below it.
+func (p *Pusher) insideLocalDir(path string) bool {
+	rel, err := filepath.Rel(p.opts.LocalDir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// pullFolder recreates the GDrive folder |folderID| as the local directory |localDir|, which is
+// |relDir| below --local_dir_to_push.  Files that already match in size and MD5 are left alone,
+// and files and directories written get the modification time they have in GDrive.
+func (p *Pusher) pullFolder(ctx context.Context, folderID, localDir, relDir string, stats *pullStats) error {
+	if !p.opts.DryRun {
+		if err := os.MkdirAll(localDir, 0755); err != nil {
+			return err
+		}
+	}
+	items, err := p.listFolder(ctx, folderID)
+	if err != nil {
+		return fmt.Errorf("Problem listing GDrive folder: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name, ok := localTitle(item.Title)
+		if !ok {
+			stats.skipped++
+			p.printf("? %s/%q (title can't be a local name, skipped)\n", EscapeName(filepath.ToSlash(relDir)), item.Title)
+			continue
+		}
+		relName := filepath.Join(relDir, name)
+		if seen[name] {
+			stats.skipped++
+			p.printf("? /%s (duplicate title in GDrive, skipped)\n", EscapeName(relName))
+			continue
+		}
+		seen[name] = true
+		path := filepath.Join(localDir, name)
+		if !p.insideLocalDir(path) {
+			return fmt.Errorf("GDrive item %q would be pulled to %q, outside --local_dir_to_push", relName, path)
+		}
+
+		if item.MimeType == folderMimeType {
+			p.printf("  /%s/\n", EscapeName(relName))
+			if err := p.pullFolder(ctx, item.Id, path, relName, stats); err != nil {
+				return err
+			}
+			// Writing the children touched the directory, it gets the time of the folder back
+			if t, err := time.Parse(time.RFC3339, item.ModifiedDate); err == nil && !p.opts.DryRun {
+				os.Chtimes(path, t, t)
+			}
+			continue
+		}
+		if strings.HasPrefix(item.MimeType, "application/vnd.google-apps.") {
+			// Docs, Sheets and the like have no content to download, only exports
+			stats.skipped++
+			p.printf("? /%s (%s, skipped)\n", EscapeName(relName), item.MimeType)
+			continue
+		}
+
+		statusPrefix := "+"
+		if fi, err := os.Stat(path); err == nil {
+			statusPrefix = "M"
+			if fi.Size() == item.FileSize {
+				if sum, err := localMD5(path); err == nil && sum == item.Md5Checksum {
+					stats.unchanged++
+					continue
+				}
+			}
+		}
+		if !p.opts.DryRun {
+			if err := p.downloadFile(ctx, item, path); err != nil {
+				return fmt.Errorf("Problem downloading %q: %v", relName, err)
+			}
+		}
+		stats.downloaded++
+		stats.bytes += item.FileSize
+		p.printf("%s /%s (%s)\n", statusPrefix, EscapeName(relName), humanize.Bytes(uint64(item.FileSize)))
+	}
+	return nil
+}
+
+// Pull implements "pull", the reverse of a push: it recreates the GDrive folder Options.RootID in
+// Options.LocalDir, downloading only files that are missing or differ.  Nothing is ever deleted
+// locally, and with Options.DryRun nothing is written.  The sync state is saved.
+func (p *Pusher) Pull(ctx context.Context) error {
+	if err := p.connect(ctx); err != nil {
+		return err
+	}
+	rootID, err := p.resolveRoot(ctx)
+	if err != nil {
+		return fmt.Errorf("Problem with --gdrive_root_id: %v", err)
+	}
+
+	start := time.Now()
+	p.printf("Pulling GDrive folder %q into %q\n\n", p.opts.RootID, p.opts.LocalDir)
+	var stats pullStats
+	err = p.pullFolder(ctx, rootID, p.opts.LocalDir, ".", &stats)
+	// The listings are worth keeping even when the pull failed part way
+	if serr := p.st.Save(); serr != nil {
+		log.Printf("Problem saving sync state: %v", serr)
+	}
+	if err != nil {
+		return err
+	}
+	p.printf("\nDownloaded %d file(s) (%s), %d unchanged, %d skipped\n", stats.downloaded,
+		humanize.Bytes(uint64(stats.bytes)), stats.unchanged, stats.skipped)
+	p.printf("Took %v\n", time.Since(start))
+	return nil
+}
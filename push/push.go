@@ -0,0 +1,1145 @@
+// Package push pushes a local directory to a GDrive folder, for Go programs that want to embed
+// pushes instead of running gdrive-dir-push, which is itself a client of it.  Folders missing in
+// GDrive are created, files missing or differing are uploaded, and the GDrive files they replace
+// are moved to a folder of old files rather than deleted.  What a push did is remembered in a
+// state.State, so that the next one only looks at what changed.
+//
+// A Pusher is made for one sync relationship and is then either planned, which only reads, or
+// applied:
+//
+//	st, err := state.Load(state.Path(dir, rootID, localDir), rootID)
+//	p := push.New(drv, st, push.Options{RootID: rootID, LocalDir: localDir, OldFilesDir: oldID, MaxOps: 1000})
+//	plan, err := p.Plan(ctx)
+//	fmt.Printf("%d operation(s), %d bytes to upload\n", len(plan.Ops), plan.Bytes())
+//	err = p.Apply(ctx)
+//	err = st.Save()
+//
+// Options.Listener is told how a push goes, to show progress or gather metrics, and the status
+// lines go to Options.Output.  The other exported methods are the commands of gdrive-dir-push
+// that work on the same sync relationship, such as Verify and Pull.
+//
+// Drive requests are counted per process, against --max_ops_per_day as LimitDailyOps sets it up,
+// as the quotas this guards are those of the account rather than of a push.
+package push
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"math"
+	"os"
+
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+	"google.golang.org/api/googleapi"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+	"github.com/hatchling/gdrive-dir-push/state"
+	"github.com/hatchling/try"
+)
+
+// Options describes a push.  Most fields are the gdrive-dir-push flag named in their comment,
+// which has the details; the zero value of a field leaves the feature off.
+type Options struct {
+	// RootID is the ID of the GDrive folder to push to, or "root" for the top level of My Drive.
+	RootID string
+	// LocalDir is the absolute path of the local directory to push.
+	LocalDir string
+	// Source, if set, is the file system pushed from in place of LocalDir, such as an archive.
+	Source fs.FS
+	// StateDir holds the run history and the ops log shared by the sync relationships.
+	StateDir string
+	// OldFilesDir is the ID of the GDrive folder that files replaced by newer versions are moved
+	// to, OldFilesDirFor that of the subtrees with a folder of their own.
+	OldFilesDir    string
+	OldFilesDirFor OldFilesTable
+	// Filter, if not nil, selects what is pushed.
+	Filter *directory_tree.Filter
+	// Scope, if set, holds Drive query terms, e.g. "starred=false", that GDrive items must match
+	// to be compared with local ones.  The rest are left alone as if they weren't there.
+	Scope string
+
+	// Connect, if set, returns the Drive client of a Pusher made without one the first time it
+	// needs one, so that commands that may do without GDrive don't authorize needlessly.
+	Connect func(ctx context.Context) (*drive.Service, error)
+	// Listener, if not nil, is told how the push goes.
+	Listener Listener
+	// Output receives the status lines and reports, one Write per line or group of lines.  It is
+	// os.Stdout if nil.
+	Output io.Writer
+	// Stop, once closed, stops the push gracefully: no new uploads or folders are started, while
+	// those under way finish.
+	Stop <-chan struct{}
+
+	DryRun  bool // --dry_run
+	Offline bool // --offline, which implies DryRun
+	// MaxOps is the most write operations a push may make (--max_gdrive_ops), 0 for no limit.
+	MaxOps int
+
+	// How files are uploaded.
+	ChunkSize      int    // --chunk_size in bytes, googleapi.DefaultUploadChunkSize if 0
+	MultipartLimit int64  // --multipart_limit
+	ReadAhead      int    // --read_ahead
+	BWLimit        uint64 // --bwlimit in bytes per second
+	Parallel       int    // --parallel, 1 if 0
+	LargeFileSize  uint64 // --large_file_size in bytes, 64 MiB if 0
+	LargeFileSlots int    // --large_file_slots
+	// Description renders the GDrive description of uploaded files (--description_template).
+	Description *template.Template
+	Labels      LabelList     // --label
+	MimeTypes   MimeOverrides // --mime_type
+	Policies    PolicyTable   // --policy
+	PartialName string        // --partial_name
+	Sidecar     bool          // --sidecar
+	FolderColor string        // --folder_color
+
+	// How local items are matched and compared to GDrive ones.
+	MatchBy               string        // --match_by, "name" if empty
+	Immutable             bool          // --immutable
+	OnlyManageOwn         bool          // --only_manage_own
+	ListingTTL            time.Duration // --listing_ttl
+	SkipUnchangedListings bool          // --skip_unchanged_listings
+	RemoteChanges         bool          // --remote_changes
+	WarmStart             bool          // --warm_start, which needs Manifest and implies SkipUnchangedListings
+	Drift                 string        // --drift, DriftOff if empty
+	AcceptDrift           bool          // --accept_drift
+	DedupDirs             bool          // --dedup_dirs
+
+	// What is pushed and how.
+	Journal            string // --journal
+	DirsOnly           bool   // --dirs_only
+	FilesOnly          string // --files_only
+	Staged             bool   // --staged
+	StagedName         string // --staged_name
+	PrecreateFolders   int    // --precreate_folders
+	Resume             bool   // --resume
+	QuarantineFailures bool   // --quarantine_failures
+	SentinelFile       string // --sentinel_file
+	AllowEmpty         bool   // --allow_empty
+	SnapshotCmd        string // --snapshot_cmd
+	SnapshotReleaseCmd string // --snapshot_release_cmd
+	LongPaths          string // --long_paths
+	MaxDepth           int    // --max_depth
+	MaxNameLength      int    // --max_name_length
+	MaxPathLength      int    // --max_path_length
+	NameCollisions     string // --name_collisions
+
+	// What happens to GDrive items missing locally.
+	DeleteExtraneous  bool          // --delete_extraneous
+	DeleteAction      string        // --delete_action
+	DeleteGraceRuns   int           // --delete_grace_runs
+	DeleteGracePeriod time.Duration // --delete_grace_period
+
+	// What is done once the push succeeded.
+	StarRoot       bool   // --star_root
+	Manifest       string // --manifest
+	UploadManifest bool   // --upload_manifest
+	Sign           string // --sign
+	SignKey        string // --sign_key
+	Annotate       string // --annotate
+	// Report is the --report file the caller writes whatever the outcome, kept in the run history.
+	Report string
+	// WatchDelay is how long Watch waits for changes to settle (--watch_delay).
+	WatchDelay time.Duration
+
+	// How a dry run estimates the time pushing takes.
+	EstimateBandwidth uint64        // --estimate_bandwidth in bytes per second
+	EstimateOpLatency time.Duration // --estimate_op_latency
+	MaxQPS            float64       // --max_qps
+
+	// The other commands.
+	VerifySample        float64       // --verify_sample
+	VerifySeed          int64         // --verify_seed
+	VerifyRepair        bool          // --repair
+	VerifyCheckpoint    time.Duration // --verify_checkpoint
+	AuditAllowedDomains string        // --audit_allowed_domains
+	AuditAllowAnyone    bool          // --audit_allow_anyone
+	TrashMinAge         time.Duration // --trash_min_age
+}
+
+// ErrInterrupted is what a push that Options.Stop stopped fails with.
+var ErrInterrupted = errors.New("interrupted")
+
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// What --files_only does about missing GDrive folders.
+const (
+	FilesOnlyFail = "fail"
+	FilesOnlySkip = "skip"
+)
+
+// Pusher pushes one local directory to one GDrive folder, as Options describe, and runs the other
+// commands on that sync relationship.  Its methods are meant to be called one at a time.
+type Pusher struct {
+	drv  *drive.Service
+	st   *state.State
+	opts Options
+
+	// mu guards st and the bookkeeping below while workers run concurrently.
+	mu sync.Mutex
+
+	// snapshot collects what this run synced, it replaces st.Snapshot once the run succeeds.
+	snapshot map[string]*state.SnapshotEntry
+
+	stats runStats
+	// start is when the last push started and result its summary, nil unless it got as far as
+	// walking the local tree.
+	start  time.Time
+	result *Summary
+
+	// ops, plan, estimated, storage and uploadTypes account for what the push did, or would have
+	// done in a dry run.
+	ops         *opBudget
+	plan        *Plan
+	estimated   *estimate
+	storage     *storageUse
+	uploadTypes *typeStats
+	// quota is the storage quota of the account as preflight found it, nil if unknown.
+	quota *drive.About
+	// uploadBucket paces uploads for Options.BWLimit, it is nil when there is no limit.
+	uploadBucket *tokenBucket
+
+	// rootID is the real ID of Options.RootID and tree the local tree of the last push, which
+	// Watch and Annotate go on from.
+	rootID string
+	tree   *directory_tree.Node
+
+	// resumeLog records the write operations of the push, it is nil when they aren't recorded.
+	resumeLog *resumeLog
+
+	// violations holds the relative paths of files that changed locally while --immutable is set.
+	violations []string
+	// failures holds the uploads that failed without ending the push, for the report.
+	failures []Failure
+
+	// remapped holds the relative paths whose GDrive titles --long_paths shortened.  It is filled
+	// in before the walk starts and only read from then on.
+	remapped map[string]bool
+
+	// precreated indexes the items of the folders that --precreate_folders or the push being
+	// resumed created, which is all such folders contain, so they need not be listed again.
+	precreated map[string]*remoteIndex
+
+	// followed holds the GDrive folders whose saved listings --remote_changes brought up to date.
+	followed map[string]bool
+	// served holds the GDrive folders whose saved listings were used in place of listing them.
+	served map[string]bool
+
+	// digests caches the content digests of local directories for --dedup_dirs, and copies holds
+	// the directories left to create as copies of their siblings once the walk is done.
+	digests map[*directory_tree.Node]dirDigest
+	copies  []dirCopy
+}
+
+// New returns a Pusher that makes its requests through |drv|, an authorized Drive client, and
+// keeps what it learns in |st|, the sync state of the relationship |opts| describe.  |drv| may be
+// nil for Options.Offline, |st| for the commands that don't need it.  Saving |st| is up to the
+// caller.
+func New(drv *drive.Service, st *state.State, opts Options) *Pusher {
+	if opts.Listener == nil {
+		opts.Listener = NopListener{}
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = googleapi.DefaultUploadChunkSize
+	}
+	if opts.Parallel < 1 {
+		opts.Parallel = 1
+	}
+	if opts.LargeFileSize == 0 {
+		opts.LargeFileSize = 64 << 20
+	}
+	if opts.MatchBy == "" {
+		opts.MatchBy = "name"
+	}
+	if opts.Drift == "" {
+		opts.Drift = DriftOff
+	}
+	if opts.Offline {
+		opts.DryRun = true
+	}
+	if opts.WarmStart {
+		opts.SkipUnchangedListings = true
+	}
+	p := &Pusher{drv: drv, st: st, opts: opts, ops: &opBudget{max: opts.MaxOps}}
+	if opts.BWLimit > 0 {
+		// A burst of a quarter second keeps uploads smooth without reads getting too small
+		p.uploadBucket = newTokenBucket(float64(opts.BWLimit), math.Max(float64(opts.BWLimit)/4, 32<<10))
+	}
+	p.reset()
+	return p
+}
+
+// folderColorRE matches the --folder_color values Drive accepts.
+var folderColorRE = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Check returns what is wrong with the options of a push, nil if they can be applied.
+func (o *Options) Check() error {
+	switch {
+	case o.OldFilesDir == "":
+		return fmt.Errorf("--old_files_dir must be provided")
+	case o.MatchBy != "" && o.MatchBy != "name" && o.MatchBy != "origin":
+		return fmt.Errorf("--match_by must be \"name\" or \"origin\"")
+	case o.FolderColor != "" && !folderColorRE.MatchString(o.FolderColor):
+		return fmt.Errorf("--folder_color must look like #rrggbb")
+	case o.LargeFileSlots < 0 || o.Parallel > 1 && o.LargeFileSlots >= o.Parallel:
+		return fmt.Errorf("--large_file_slots must leave at least one of the --parallel workers to small files")
+	case o.FilesOnly != "" && o.FilesOnly != FilesOnlyFail && o.FilesOnly != FilesOnlySkip:
+		return fmt.Errorf("--files_only must be %q or %q", FilesOnlyFail, FilesOnlySkip)
+	case o.FilesOnly != "" && (o.DirsOnly || o.Staged || o.PrecreateFolders > 0):
+		return fmt.Errorf("--files_only can't be combined with --dirs_only, --staged or --precreate_folders, which create folders")
+	case o.LongPaths != "" && o.LongPaths != LongPathsFail && o.LongPaths != LongPathsRemap:
+		return fmt.Errorf("--long_paths must be %q or %q", LongPathsFail, LongPathsRemap)
+	case o.Drift != "" && o.Drift != DriftOff && o.Drift != DriftReport && o.Drift != DriftFail:
+		return fmt.Errorf("--drift must be %q, %q or %q", DriftReport, DriftFail, DriftOff)
+	case o.DeleteAction != "" && o.DeleteAction != DeleteRelocate && o.DeleteAction != DeleteTrash:
+		return fmt.Errorf("--delete_action must be %q or %q", DeleteRelocate, DeleteTrash)
+	case o.DeleteGraceRuns < 0 || o.DeleteGracePeriod < 0:
+		return fmt.Errorf("--delete_grace_runs and --delete_grace_period can't be negative")
+	case o.DeleteExtraneous && (o.Journal != "" || o.DirsOnly || o.Staged):
+		return fmt.Errorf("--delete_extraneous needs to see the whole local dir once per run and can't be combined with --journal, --dirs_only or --staged")
+	case o.NameCollisions != "" && o.NameCollisions != CollisionFail && o.NameCollisions != CollisionSuffix:
+		return fmt.Errorf("--name_collisions must be %q or %q", CollisionFail, CollisionSuffix)
+	case o.Journal != "" && (o.Staged || o.Source != nil || o.SnapshotCmd != ""):
+		return fmt.Errorf("--journal replays changes to the local dir and can't be combined with --staged, --source_archive or --snapshot_cmd")
+	case o.Source != nil && o.SnapshotCmd != "":
+		return fmt.Errorf("--snapshot_cmd can't be combined with --source_archive")
+	case o.UploadManifest && o.Manifest == "":
+		return fmt.Errorf("--upload_manifest needs --manifest")
+	case o.Annotate != "" && o.Annotate != "comment" && o.Annotate != "status_file":
+		return fmt.Errorf("--annotate must be \"comment\" or \"status_file\"")
+	case o.Sign != "" && o.Sign != "gpg" && o.Sign != "minisign":
+		return fmt.Errorf("--sign must be \"gpg\" or \"minisign\"")
+	case o.Sign != "" && o.Manifest == "":
+		return fmt.Errorf("--sign needs --manifest")
+	case o.Sign == "minisign" && o.SignKey == "":
+		return fmt.Errorf("--sign=minisign needs --sign_key")
+	case o.PartialName != "" && (strings.Count(o.PartialName, "%s") != 1 || strings.Count(o.PartialName, "%") != 1):
+		return fmt.Errorf("--partial_name must contain %%s exactly once and no other %%")
+	case o.WarmStart && o.Manifest == "":
+		return fmt.Errorf("--warm_start needs the --manifest of previous pushes")
+	case o.Resume && o.Staged:
+		return fmt.Errorf("--staged pushes everything afresh into a new folder and can't --resume")
+	case o.OnlyManageOwn && o.Staged:
+		return fmt.Errorf("--only_manage_own can't be combined with --staged, which replaces the whole folder")
+	case o.Staged && (o.SkipUnchangedListings || o.WarmStart):
+		return fmt.Errorf("--staged pushes everything afresh and can't be combined with --skip_unchanged_listings")
+	case o.RemoteChanges && o.Scope != "":
+		return fmt.Errorf("--remote_changes can't be combined with --remote_scope, the change feed isn't limited to it")
+	}
+	return nil
+}
+
+// reset forgets what the last push did, for the next one.
+func (p *Pusher) reset() {
+	p.snapshot = make(map[string]*state.SnapshotEntry)
+	p.stats = runStats{}
+	p.plan = &Plan{}
+	p.estimated = &estimate{ops: make(map[string]int)}
+	p.storage = &storageUse{}
+	p.uploadTypes = &typeStats{byExt: make(map[string]*typeStat)}
+	p.violations, p.failures = nil, nil
+	p.remapped = make(map[string]bool)
+	p.precreated, p.followed, p.served = nil, nil, nil
+	p.digests, p.copies = nil, nil
+	p.ops.reset()
+}
+
+// connect makes sure that the Pusher has a Drive client, from Options.Connect if needed, in which
+// case it is checked with a preflight request.
+func (p *Pusher) connect(ctx context.Context) error {
+	if p.drv != nil {
+		return nil
+	}
+	if p.opts.Connect == nil {
+		return fmt.Errorf("No Drive client")
+	}
+	drv, err := p.opts.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	p.drv = drv
+	return p.preflight(ctx)
+}
+
+// printf writes to Options.Output.
+func (p *Pusher) printf(format string, a ...interface{}) {
+	fmt.Fprintf(p.opts.Output, format, a...)
+}
+
+// printStatus writes |text|, one or more whole lines, to Options.Output.
+func (p *Pusher) printStatus(text string) {
+	io.WriteString(p.opts.Output, text)
+}
+
+// stopping reports whether Options.Stop asked the push to stop.
+func (p *Pusher) stopping() bool {
+	select {
+	case <-p.opts.Stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// localMD5 returns the hex encoded MD5 checksum of the local file at |path|, which is comparable to
+// the Md5Checksum GDrive reports for uploaded files.
+func localMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readMD5(f)
+}
+
+// nodeMD5 returns the hex encoded MD5 checksum of the file |localFile| was created from.
+func nodeMD5(localFile *directory_tree.Node) (string, error) {
+	f, err := localFile.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readMD5(f)
+}
+
+// readMD5 returns the hex encoded MD5 checksum of everything read from |r|.
+func readMD5(r io.Reader) (string, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sourceFS returns the file system pushed from.
+func (p *Pusher) sourceFS() fs.FS {
+	if p.opts.Source == nil {
+		return os.DirFS(p.opts.LocalDir)
+	}
+	return p.opts.Source
+}
+
+// hashFile returns the MD5 of |localFile|, consulting and updating the hash cache so that files
+// that haven't changed since the last run aren't read again.  Workers call it concurrently, the
+// cache is only touched under p.mu while the file is read outside of it.
+func (p *Pusher) hashFile(localFile *directory_tree.Node, relName string) (string, error) {
+	p.mu.Lock()
+	sum, ok := p.st.CachedMD5(relName, localFile.Info.Size, localFile.Info.ModTime)
+	p.mu.Unlock()
+	if ok {
+		return sum, nil
+	}
+	sum, err := nodeMD5(localFile)
+	if err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.st.Hashes[relName] = &state.HashEntry{
+		Size:    localFile.Info.Size,
+		ModTime: localFile.Info.ModTime,
+		MD5:     sum,
+	}
+	return sum, nil
+}
+
+// unchanged reports whether the GDrive file |remote| has the same content as |localFile|,
+// comparing sizes first so that only files that might match are hashed.  Files --policy stores
+// transformed can't be compared, they count as unchanged while they are as the last push left them.
+func (p *Pusher) unchanged(localFile *directory_tree.Node, relName string, remote *drive.File) (bool, error) {
+	switch p.policyFor(localFile) {
+	case PolicySizeOnly:
+		return remote.FileSize == localFile.Info.Size, nil
+	case PolicyConvert, PolicyCompress:
+		e, ok := p.st.Snapshot[relName]
+		return ok && e.DriveID == remote.Id && e.Size == localFile.Info.Size && e.ModTime.Equal(localFile.Info.ModTime), nil
+	}
+	if remote.Md5Checksum == "" || remote.FileSize != localFile.Info.Size {
+		return false, nil
+	}
+	sum, err := p.hashFile(localFile, relName)
+	if err != nil {
+		return false, err
+	}
+	return sum == remote.Md5Checksum, nil
+}
+
+// recordSynced notes that |localItem| is now in sync with the GDrive item |driveID|.
+func (p *Pusher) recordSynced(localItem *directory_tree.Node, relName, driveID string) {
+	e := &state.SnapshotEntry{
+		Size:    localItem.Info.Size,
+		ModTime: localItem.Info.ModTime,
+		IsDir:   localItem.Info.IsDir,
+		DriveID: driveID,
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if sum, ok := p.st.CachedMD5(relName, e.Size, e.ModTime); ok {
+		e.MD5 = sum
+	}
+	p.snapshot[relName] = e
+}
+
+// listFields limits listings to the fields this tool looks at, which keeps the pages of very large
+// folders small.
+const listFields = "nextPageToken,items(id,title,mimeType,fileSize,md5Checksum,modifiedDate,parents(id),properties,labels(trashed))"
+
+// listFolder returns all files and folders directly under the GDrive parent folder |parentID|.  An
+// error is returned if the operation fails.
+func (p *Pusher) listFolder(ctx context.Context, parentID string) ([]*drive.File, error) {
+	files := []*drive.File{}
+	err := p.listFolderPages(ctx, parentID, func(page []*drive.File) {
+		files = append(files, page...)
+	})
+	return files, err
+}
+
+// indexFolder lists the GDrive folder |parentID| into an index, a page at a time.  An error is
+// returned if the operation fails.
+func (p *Pusher) indexFolder(ctx context.Context, parentID string) (*remoteIndex, error) {
+	idx := newRemoteIndex(nil)
+	if err := p.listFolderPages(ctx, parentID, idx.add); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// listFolderPages passes the files and folders directly under the GDrive parent folder |parentID|
+// to |fn| a page at a time, and remembers the listing in the sync state.  An error is returned if
+// the operation fails.
+func (p *Pusher) listFolderPages(ctx context.Context, parentID string, fn func([]*drive.File)) error {
+	slog.Debug("listFolder", "id", parentID)
+	if p.opts.Offline {
+		files, err := p.offlineListing(parentID)
+		if err != nil {
+			return err
+		}
+		fn(files)
+		return nil
+	}
+	if files, ok := p.savedListing(parentID); ok {
+		fn(files)
+		return nil
+	}
+
+	listed := time.Now()
+	cached := []*state.RemoteEntry{}
+	err := p.listPages(ctx, p.folderQuery(parentID), func(page []*drive.File) {
+		for _, f := range page {
+			cached = append(cached, remoteEntry(f))
+		}
+		fn(page)
+	})
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.st.Remote[parentID] = cached
+	p.st.Listed[parentID] = listed
+	p.mu.Unlock()
+	return nil
+}
+
+// folderQuery returns the Drive query for the items directly under the GDrive folder |parentID|
+// that --remote_scope leaves in.
+func (p *Pusher) folderQuery(parentID string) string {
+	query := fmt.Sprintf("'%s' in parents and trashed=false", parentID)
+	if p.opts.Scope != "" {
+		query += " and (" + p.opts.Scope + ")"
+	}
+	return query
+}
+
+// listQuery returns all GDrive items matching the search |query|, following pagination.  An error
+// is returned if the operation fails.
+func (p *Pusher) listQuery(ctx context.Context, query string) ([]*drive.File, error) {
+	files := []*drive.File{}
+	err := p.listPages(ctx, query, func(page []*drive.File) {
+		files = append(files, page...)
+	})
+	return files, err
+}
+
+// listPages passes the GDrive items matching the search |query| to |fn| a page at a time.  An error
+// is returned if the operation fails.
+func (p *Pusher) listPages(ctx context.Context, query string, fn func([]*drive.File)) error {
+	call := p.drv.Files.List().Q(query).MaxResults(1000).Fields(listFields)
+	pageToken := ""
+	for {
+		if pageToken != "" {
+			call.PageToken(pageToken)
+		}
+
+		// Wrap in a simple retry loop since Drive can be unreliable.
+		var r *drive.FileList
+		if err := try.Do(func(attempt int) (bool, error) {
+			var err error
+			p.countCall(ctx, callList)
+			r, err = call.Context(ctx).Do()
+			if err != nil {
+				log.Print(err)
+			}
+			return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+		}); err != nil {
+			return fmt.Errorf("Unable to list files: %v", err)
+		}
+
+		fn(r.Items)
+		pageToken = r.NextPageToken
+		if pageToken == "" {
+			break
+		}
+	}
+	return nil
+}
+
+// createFolder creates a new GDrive folder for the local directory |relName| with |title| under the
+// GDrive parent folder |parentID|, carrying over the local directory's |modTime|.  It returns the
+// ID of the created folder or an error if the operation fails.
+func (p *Pusher) createFolder(ctx context.Context, title, relName, parentID string, modTime time.Time) (string, error) {
+	if p.opts.DryRun {
+		p.estimated.add(callInsert, 0)
+		return "", nil
+	}
+	if err := p.ops.take(callInsert); err != nil {
+		return "", err
+	}
+	slog.Debug("createFolder", "path", relName, "title", title, "parent", parentID)
+	newFolder := &drive.File{
+		Title:          EscapeName(title),
+		MimeType:       folderMimeType,
+		ModifiedDate:   modTime.UTC().Format(time.RFC3339Nano),
+		Properties:     append(append(originProperties(relName), rawNameProperties(title)...), p.longNameProperties(relName)...),
+		FolderColorRgb: p.opts.FolderColor,
+		Parents: []*drive.ParentReference{
+			&drive.ParentReference{Id: parentID},
+		},
+	}
+	p.forgetListings(parentID)
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	var r *drive.File
+	if err := try.Do(func(attempt int) (bool, error) {
+		var err error
+		p.countCall(ctx, callInsert)
+		r, err = p.drv.Files.Insert(newFolder).Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return "", fmt.Errorf("Problem creating new GDrive folder: %v", err)
+	}
+	return r.Id, nil
+}
+
+// starFolder stars the GDrive folder |folderID|.  It returns an error if the operation fails.
+func (p *Pusher) starFolder(ctx context.Context, folderID string) error {
+	if p.opts.DryRun {
+		p.estimated.add(callPatch, 0)
+		return nil
+	}
+	if err := p.ops.take(callPatch); err != nil {
+		return err
+	}
+	slog.Debug("starFolder", "id", folderID)
+	starred := &drive.File{Labels: &drive.FileLabels{Starred: true}}
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	if err := try.Do(func(attempt int) (bool, error) {
+		p.countCall(ctx, callPatch)
+		_, err := p.drv.Files.Patch(folderID, starred).Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return fmt.Errorf("A Patch() error occurred: %v", err)
+	}
+	return nil
+}
+
+// relocateFile moves |fileID|, found at |relName|, from the |oldParentID| folder to the
+// --old_files_dir folder, or that of the --old_files_dir_for rule covering |relName|.  It returns
+// an error if the operation fails.
+func (p *Pusher) relocateFile(ctx context.Context, relName, fileID, oldParentID string) error {
+	return p.moveFile(ctx, fileID, oldParentID, p.oldFilesDirFor(relName))
+}
+
+// relocated counts the GDrive file |fileID|, of |size| bytes and found at |relName|, that a push
+// moved to its old files folder.
+func (p *Pusher) relocated(relName, fileID string, size int64) {
+	p.mu.Lock()
+	p.stats.filesRelocated++
+	p.mu.Unlock()
+	p.opts.Listener.OnFileDone(Op{Kind: Relocate, Path: filepath.ToSlash(EscapeName(relName)), Size: size, ID: fileID, Parent: p.oldFilesDirFor(relName)})
+}
+
+// moveFile moves |fileID| from the |oldParentID| folder to the |newParentID| folder.  It returns an
+// error if the operation fails.
+func (p *Pusher) moveFile(ctx context.Context, fileID, oldParentID, newParentID string) error {
+	if p.opts.DryRun {
+		p.estimated.add(callParentInsert, 0)
+		p.estimated.add(callParentDelete, 0)
+		return nil
+	}
+	if err := p.ops.take(callParentInsert); err != nil {
+		return err
+	}
+	slog.Debug("moveFile", "id", fileID, "from", oldParentID, "to", newParentID)
+	parentRef := &drive.ParentReference{Id: newParentID}
+	p.forgetListings(newParentID)
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	if err := try.Do(func(attempt int) (bool, error) {
+		p.countCall(ctx, callParentInsert)
+		_, err := p.drv.Parents.Insert(fileID, parentRef).Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return fmt.Errorf("An Insert() error occurred: %v", err)
+	}
+
+	return p.removeParent(ctx, fileID, oldParentID)
+}
+
+// removeParent detaches |fileID| from the folder |parentID|.  It returns an error if the operation
+// fails.
+func (p *Pusher) removeParent(ctx context.Context, fileID, parentID string) error {
+	p.forgetListings(parentID)
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	if err := try.Do(func(attempt int) (bool, error) {
+		p.countCall(ctx, callParentDelete)
+		err := p.drv.Parents.Delete(fileID, parentID).Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return fmt.Errorf("A Delete() error occurred: %v", err)
+	}
+
+	return nil
+}
+
+// createFile uploads |localfile|, found at |relName|, to the GDrive folder |parentID|.  How far the
+// upload got is reported to the listener as |op|, unless its Kind is empty.  It retries until |ctx|
+// is cancelled.  It returns the ID of the created file or an error if the operation fails.
+func (p *Pusher) createFile(ctx context.Context, localFile *directory_tree.Node, relName, parentID string, op Op) (string, error) {
+	// Small files go up in one multipart request, a resumable session costs extra round trips that
+	// only pay off for larger files.
+	method, chunkSize := callUpload, p.opts.ChunkSize
+	if localFile.Info.Size <= p.opts.MultipartLimit {
+		method, chunkSize = callMultipart, 0
+	}
+	if p.opts.DryRun {
+		p.estimated.add(method, localFile.Info.Size)
+		if p.opts.PartialName != "" {
+			p.estimated.add(callPatch, 0)
+		}
+		return "", p.applyLabels(ctx, "")
+	}
+	if err := p.ops.take(method); err != nil {
+		return "", err
+	}
+	slog.Debug("createFile", "path", relName, "parent", parentID)
+	name := driveName(localFile)
+	title := EscapeName(name)
+	policy := p.policyFor(localFile)
+	mimeType := p.mimeTypeFor(localFile, title)
+	description, err := p.describe(localFile)
+	if err != nil {
+		return "", fmt.Errorf("Problem rendering --description_template: %v", err)
+	}
+
+	// File instance
+	f := &drive.File{
+		Title:       title,
+		MimeType:    mimeType,
+		Description: description,
+		Properties:  append(append(originProperties(relName), rawNameProperties(name)...), p.longNameProperties(relName)...),
+		Parents: []*drive.ParentReference{
+			&drive.ParentReference{Id: parentID},
+		},
+	}
+	// Keep consumers watching the folder from picking up the file before it is complete
+	if p.opts.PartialName != "" {
+		f.Title = p.partialTitle(title)
+		f.Properties = append(f.Properties, p.partialProperties()...)
+	}
+	p.forgetListings(parentID)
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	var r *drive.File
+	attempts := newUploadAttempts(relName, localFile.Info.Size, chunkSize)
+	if err := try.Do(func(attempt int) (bool, error) {
+		var err error
+
+		file, err := localFile.Open()
+		if err != nil {
+			return false, err
+		}
+		defer file.Close()
+		before, err := file.Stat()
+		if err != nil {
+			return false, err
+		}
+
+		// Large files are read ahead into pooled buffers so concurrent uploads share memory
+		var media io.Reader = file
+		if method == callUpload {
+			ra := newReadAheadReader(file, p.opts.ReadAhead)
+			defer ra.Close()
+			media = ra
+		}
+		if policy == PolicyCompress {
+			zr := gzipReader(media)
+			defer zr.Close()
+			media = zr
+		}
+		// Hash what is actually sent so the stored file can be checked against it
+		sent := md5.New()
+		read := &countingReader{r: p.limitUpload(ctx, io.TeeReader(media, sent))}
+
+		p.countCall(ctx, method)
+		done := attempts.begin()
+		call := p.drv.Files.Insert(f).Media(read, googleapi.ChunkSize(attempts.chunkSize)).Convert(policy == PolicyConvert)
+		if op.Kind != "" {
+			// Reading only fills buffers, what Drive acknowledged is what was sent
+			listener := p.opts.Listener
+			call = call.ProgressUpdater(func(current, total int64) { listener.OnFileProgress(op, current) })
+		}
+		r, err = call.Context(ctx).Do()
+		done()
+		if err != nil && method == callUpload {
+			attempts.failed(read.n, err)
+		}
+		if err == nil {
+			err = p.checkUpload(ctx, r, localFile, before, hex.EncodeToString(sent.Sum(nil)))
+		}
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return "", fmt.Errorf("An error occurred uploading the file: %v\n", attempts.diagnose(err))
+	}
+	usage.mu.Lock()
+	usage.BytesUploaded += localFile.Info.Size
+	usage.mu.Unlock()
+	p.mu.Lock()
+	p.stats.bytesUploaded += localFile.Info.Size
+	p.mu.Unlock()
+
+	if err := p.applyLabels(ctx, r.Id); err != nil {
+		return "", err
+	}
+	if p.opts.PartialName != "" {
+		if err := p.renameFile(ctx, r.Id, title); err != nil {
+			return "", err
+		}
+	}
+	return r.Id, nil
+}
+
+// processNode recursively makes write operations to sync the local file structure described by
+// |node| with GDrive, uploading up to --parallel files, split between small and large ones by
+// --large_file_slots, and processing up to as many folders at once.  It will retry until |ctx| is
+// cancelled.  It returns an error if any operation fails.
+func (p *Pusher) processNode(ctx context.Context, node *directory_tree.Node) error {
+	pool := p.newWorkPool()
+	out := p.newStatusOutput()
+	pool.run(func() error {
+		return p.processFolder(ctx, pool, node, out)
+	})
+	err := pool.wait()
+	out.drain()
+	if err == nil {
+		err = p.copyDuplicates(ctx)
+	}
+	return err
+}
+
+// processFolder syncs the children of |node|, whose status lines are added below |out|, handing
+// uploads and subfolders to |pool|.
+func (p *Pusher) processFolder(ctx context.Context, pool *workPool, node *directory_tree.Node, out *statusLine) error {
+	defer out.end()
+	slog.Debug("processNode", "path", node.FullPath)
+	relDir, err := filepath.Rel(p.opts.LocalDir, node.FullPath)
+	if err != nil {
+		return fmt.Errorf("Could not determine relative path: %v", err)
+	}
+	list := func() (*remoteIndex, error) {
+		if p.opts.DryRun {
+			p.estimated.add(callList, 0)
+		}
+		// Folders that a --dry_run would have created have no ID and nothing in them yet
+		if node.DriveID == "" {
+			return newRemoteIndex(nil), nil
+		}
+		if idx, ok := p.precreated[node.DriveID]; ok {
+			return idx, nil
+		}
+		idx, err := p.indexFolder(ctx, node.DriveID)
+		if err != nil {
+			p.invalidateFolder(relDir)
+			return nil, fmt.Errorf("Problem listing GDrive folder: %v", err)
+		}
+		return idx, nil
+	}
+	var remoteItems *remoteIndex
+	cachedItems, cached := p.cachedListing(node, relDir)
+	if cached {
+		remoteItems = newRemoteIndex(cachedItems)
+	} else if remoteItems, err = list(); err != nil {
+		return err
+	}
+	// TODO: Handle case where remote type != local type
+	for _, localItem := range node.Children {
+		// Stop promptly once the run is cancelled or out of budget, or another operation failed
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if pool.stopped() {
+			return nil
+		}
+		var found bool
+		var remote *drive.File
+		relName, err := filepath.Rel(p.opts.LocalDir, localItem.FullPath)
+		if err != nil {
+			return fmt.Errorf("Could not determine relative path: %v", err)
+		}
+		p.mu.Lock()
+		skip, skipped := p.st.Skip[relName]
+		p.mu.Unlock()
+		if skipped {
+			out.add().print("S /%s (skip list: %s)\n", EscapeName(relName), skip.Reason)
+			continue
+		}
+		if p.opts.DirsOnly && !localItem.Info.IsDir {
+			continue
+		}
+		if p.policyFor(localItem) == PolicySkip {
+			out.add().print("S /%s (--policy %s)\n", EscapeName(relName), PolicySkip)
+			continue
+		}
+		remote = remoteItems.match(localItem, relName, p.opts.MatchBy == "origin")
+		touch := remote == nil
+		if !touch && !localItem.Info.IsDir && !p.opts.Immutable {
+			same, err := p.unchanged(localItem, relName, remote)
+			if err != nil {
+				return fmt.Errorf("Problem hashing local file %q: %v", relName, err)
+			}
+			touch = !same
+		}
+		if cached && touch {
+			// About to write into a folder known only from the snapshot, make sure it is real
+			if remoteItems, err = list(); err != nil {
+				return err
+			}
+			cached = false
+			remote = remoteItems.match(localItem, relName, p.opts.MatchBy == "origin")
+		}
+		if remote != nil {
+			localItem.DriveID = remote.Id
+			found = true
+		}
+		statusPrefix := " "
+		if localItem.Info.IsDir {
+			// Handle folders
+			line := out.addFolder()
+			if !found && p.opts.FilesOnly == FilesOnlySkip {
+				line.print("S /%s/ (missing from GDrive, --files_only)\n", EscapeName(relName))
+				line.end()
+				continue
+			}
+			if !found && p.opts.FilesOnly != "" {
+				return fmt.Errorf("GDrive folder %q is missing and --files_only doesn't create folders", relName)
+			}
+			if !found {
+				src, err := p.duplicateOf(node, localItem, relName)
+				if err != nil {
+					return err
+				}
+				if src != nil {
+					// Copied in GDrive once the walk is done, which is when src is pushed
+					p.mu.Lock()
+					srcRel := filepath.Join(relDir, src.Info.Name)
+					p.copies = append(p.copies, dirCopy{src: src, dst: localItem, srcRel: srcRel, dstRel: relName, parentID: node.DriveID})
+					p.mu.Unlock()
+					line.print("= /%s/ (same as /%s/, copied from it once pushed)\n", EscapeName(relName), EscapeName(srcRel))
+					line.end()
+					continue
+				}
+				statusPrefix = "+"
+				// No GDrive folder exists, create it under the current parent
+				op := fileOp(localItem, relName, false)
+				p.opts.Listener.OnFileStart(op)
+				newID, err := p.createFolder(ctx, driveName(localItem), relName, node.DriveID, localItem.Info.ModTime)
+				if err != nil {
+					p.opts.Listener.OnError(op, err)
+					return fmt.Errorf("Problem creating GDrive folder %q: %v", relName, err)
+				}
+				op.ID = newID
+				p.opts.Listener.OnFileDone(op)
+				localItem.DriveID = newID
+				if !p.opts.DryRun {
+					p.resumeLog.record(&resumeEntry{Op: resumeMkdir, Path: relName, ID: newID, Parent: node.DriveID, Title: EscapeName(driveName(localItem))})
+				}
+				p.mu.Lock()
+				p.stats.foldersCreated++
+				p.mu.Unlock()
+				p.planned(CreateFolder, relName, 0)
+			}
+			p.recordSynced(localItem, relName, localItem.DriveID)
+			line.print("%s /%s/\n", statusPrefix, EscapeName(relName))
+
+			// Recursively handle directories, next to their siblings when workers are free
+			folder := localItem
+			pool.run(func() error {
+				return p.processFolder(ctx, pool, folder, line)
+			})
+			continue
+		}
+
+		// Handle files
+		line := out.add()
+		if found && p.opts.Immutable {
+			// Existing files are never replaced, local edits are reported instead
+			sum, err := p.hashFile(localItem, relName)
+			if err != nil {
+				return fmt.Errorf("Problem hashing local file %q: %v", relName, err)
+			}
+			if sum != remote.Md5Checksum {
+				statusPrefix = "!"
+				p.mu.Lock()
+				p.violations = append(p.violations, relName)
+				p.mu.Unlock()
+			} else {
+				p.recordSynced(localItem, relName, remote.Id)
+			}
+			line.print("%s /%s (%s)\n", statusPrefix, EscapeName(relName), humanize.Bytes(uint64(localItem.Info.Size)))
+			continue
+		}
+		if found {
+			// Files whose content GDrive already has are left alone
+			same, err := p.unchanged(localItem, relName, remote)
+			if err != nil {
+				return fmt.Errorf("Problem hashing local file %q: %v", relName, err)
+			}
+			if same {
+				p.mu.Lock()
+				p.stats.filesUnchanged++
+				p.mu.Unlock()
+				p.recordSynced(localItem, relName, remote.Id)
+				line.print("%s /%s (%s)\n", statusPrefix, EscapeName(relName), humanize.Bytes(uint64(localItem.Info.Size)))
+				continue
+			}
+			if !p.managed(remote) {
+				line.print("S /%s (GDrive file not pushed by this tool, --only_manage_own)\n", EscapeName(relName))
+				continue
+			}
+		}
+		file, siblings := localItem, remoteItems
+		p.opts.Listener.OnFileQueued(fileOp(file, relName, remote != nil))
+		pool.runUpload(file.Info.Size, func() error {
+			return p.uploadFile(ctx, node, file, relName, remote, siblings, line)
+		})
+	}
+	if p.opts.DeleteExtraneous && node.DriveID != "" {
+		if cached {
+			// A listing from the snapshot doesn't show what else is in GDrive
+			if remoteItems, err = list(); err != nil {
+				return err
+			}
+		}
+		return p.pruneExtraneous(ctx, node, relDir, remoteItems, out)
+	}
+	return nil
+}
+
+// uploadFile pushes |localItem| into the GDrive folder of |node|, first moving |remote|, the
+// GDrive file it replaces if any, aside.  |remoteItems| is the listing of the folder and the
+// outcome is reported on |line|.
+func (p *Pusher) uploadFile(ctx context.Context, node, localItem *directory_tree.Node, relName string, remote *drive.File, remoteItems *remoteIndex, line *statusLine) error {
+	found := remote != nil
+	op := fileOp(localItem, relName, found)
+	p.opts.Listener.OnFileStart(op)
+	statusPrefix := "+"
+	if found {
+		statusPrefix = "M"
+		if err := p.relocateFile(ctx, relName, localItem.DriveID, node.DriveID); err != nil {
+			p.opts.Listener.OnError(op, err)
+			return fmt.Errorf("Problem relocating GDrive file %q: %v", relName, err)
+		}
+		if !p.opts.DryRun {
+			p.resumeLog.record(&resumeEntry{Op: resumeRelocate, Path: relName, ID: localItem.DriveID, Parent: node.DriveID})
+			p.storage.relocate(remote.FileSize)
+		}
+		p.planned(Relocate, relName, remote.FileSize)
+		p.relocated(relName, localItem.DriveID, remote.FileSize)
+	}
+	began := time.Now()
+	newID, err := p.createFile(ctx, localItem, relName, node.DriveID, op)
+	if err != nil {
+		p.opts.Listener.OnError(op, err)
+		if ctx.Err() == nil && p.quarantine(relName, err, line) {
+			return nil
+		}
+		return fmt.Errorf("Problem creating Gdrive file %q: %v", relName, err)
+	}
+	localItem.DriveID = newID
+	if !p.opts.DryRun {
+		p.uploadTypes.add(localItem.Info.Name, localItem.Info.Size, time.Since(began))
+		p.storage.add(localItem.Info.Size)
+		if err := p.logUpload(localItem, relName, node.DriveID, newID); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	p.stats.filesUploaded++
+	if found {
+		p.stats.filesReplaced++
+	}
+	p.mu.Unlock()
+	p.planned(Upload, relName, localItem.Info.Size)
+	if p.opts.Sidecar {
+		if old := findSidecar(remoteItems, driveName(localItem)); old != nil {
+			if err := p.relocateFile(ctx, relName, old.Id, node.DriveID); err != nil {
+				return fmt.Errorf("Problem relocating sidecar of %q: %v", relName, err)
+			}
+			if !p.opts.DryRun {
+				p.storage.relocate(old.FileSize)
+			}
+			p.planned(Relocate, relName+SidecarSuffix, old.FileSize)
+			p.relocated(relName+SidecarSuffix, old.Id, old.FileSize)
+		}
+		if err := p.createSidecar(ctx, localItem, relName, node.DriveID); err != nil {
+			return fmt.Errorf("Problem creating sidecar for %q: %v", relName, err)
+		}
+		p.planned(Upload, relName+SidecarSuffix, 0)
+	}
+	p.recordSynced(localItem, relName, newID)
+	op.ID = newID
+	p.opts.Listener.OnFileDone(op)
+	line.print("%s /%s (%s)\n", statusPrefix, EscapeName(relName), humanize.Bytes(uint64(localItem.Info.Size)))
+	return nil
+}
@@ -0,0 +1,133 @@
+package push
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+// errDailyOpsExhausted is the error given once --max_ops_per_day requests were made in the last
+// 24 hours without --quota_wait.
+var errDailyOpsExhausted = errors.New("--max_ops_per_day reached")
+
+// opsLogSaveInterval is how often the ops log is saved while requests are made, besides at the
+// end of a run.
+const opsLogSaveInterval = time.Minute
+
+var (
+	// opsLog tracks API requests across runs for --max_ops_per_day, nil when there is no limit.
+	opsLog *state.OpsLog
+	// maxOpsPerDay and quotaWait are --max_ops_per_day and --quota_wait.
+	maxOpsPerDay int
+	quotaWait    bool
+
+	// opsMu guards opsLog and the two below.
+	opsMu sync.Mutex
+	// opsLogSaved is when opsLog was last saved.
+	opsLogSaved time.Time
+	// dailyOpsErr is set once the budget ran out, from then on every request fails.
+	dailyOpsErr error
+)
+
+// LimitDailyOps makes the Pushers of the process make no more than |max| Drive API requests in
+// any 24 hours, counted across runs in the ops log under |stateDir| (--max_ops_per_day).  Once
+// they are used up, requests wait for the budget to free up if |wait| is set (--quota_wait) and
+// the push stops otherwise.
+func LimitDailyOps(stateDir string, max int, wait bool) error {
+	if max <= 0 || opsLog != nil {
+		return nil
+	}
+	l, err := state.LoadOpsLog(stateDir)
+	if err != nil {
+		return fmt.Errorf("Problem loading ops log: %v", err)
+	}
+	opsMu.Lock()
+	opsLog, opsLogSaved = l, time.Now()
+	maxOpsPerDay, quotaWait = max, wait
+	opsMu.Unlock()
+	return nil
+}
+
+// paceDailyOps accounts for one more API request against --max_ops_per_day, which must not be
+// made if an error is returned.  Once the last 24 hours used up the budget it either waits until
+// enough of it frees up (--quota_wait), saying so on |w|, or fails so that the caller stops the
+// run, so that a migration spread over several days never trips the per-user limit.  The wait
+// ends early with the error of |ctx| once it is done.
+func paceDailyOps(ctx context.Context, w io.Writer) error {
+	for {
+		until, err := takeDailyOp()
+		if err != nil || until.IsZero() {
+			return err
+		}
+		fmt.Fprintf(w, "--max_ops_per_day reached, waiting until %v\n", until.Local().Format("2006-01-02 15:04"))
+		// Other requests go on accounting, or waiting, meanwhile
+		timer := time.NewTimer(time.Until(until))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// takeDailyOp accounts for one request if the budget allows it.  Otherwise it returns when
+// enough of the budget frees up to wait for with --quota_wait, and fails without it.
+func takeDailyOp() (time.Time, error) {
+	opsMu.Lock()
+	defer opsMu.Unlock()
+	if opsLog == nil {
+		return time.Time{}, nil
+	}
+	if dailyOpsErr != nil {
+		return time.Time{}, dailyOpsErr
+	}
+	now := time.Now()
+	if opsLog.LastDay(now) >= maxOpsPerDay {
+		if !quotaWait {
+			dailyOpsErr = fmt.Errorf("Oops, %w (%d in the last 24 hours), stopping", errDailyOpsExhausted, opsLog.LastDay(now))
+			return time.Time{}, dailyOpsErr
+		}
+		// What was used so far is worth keeping in case the wait is cut short
+		saveOpsLogLocked()
+		return opsLog.FreesAt(now), nil
+	}
+	opsLog.Add(now)
+	if now.Sub(opsLogSaved) >= opsLogSaveInterval {
+		saveOpsLogLocked()
+	}
+	return time.Time{}, nil
+}
+
+// DailyOpsExhausted returns the error requests failed with once --max_ops_per_day ran out, nil
+// if it didn't.
+func DailyOpsExhausted() error {
+	opsMu.Lock()
+	defer opsMu.Unlock()
+	return dailyOpsErr
+}
+
+// SaveOpsLog writes the requests accounted for so far to the state dir, as runs do when they end.
+func SaveOpsLog() {
+	opsMu.Lock()
+	defer opsMu.Unlock()
+	saveOpsLogLocked()
+}
+
+// saveOpsLogLocked is saveOpsLog for callers holding opsMu.
+func saveOpsLogLocked() {
+	if opsLog == nil {
+		return
+	}
+	if err := opsLog.Save(); err != nil {
+		log.Printf("Problem saving ops log: %v", err)
+	}
+	opsLogSaved = time.Now()
+}
@@ -0,0 +1,114 @@
+package push
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// tokenBucket paces a stream of work: tokens accrue at |rate| per second up to |burst|, and work
+// waits for the tokens it takes.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time // when tokens was last brought up to date
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes |n| tokens and returns how long to wait before they may be used.  Tokens may go
+// negative, which queues later work behind what is already waiting.
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel gives back |n| tokens taken by reserve for work that was never done.
+func (b *tokenBucket) cancel(n float64) {
+	b.mu.Lock()
+	b.tokens += n
+	b.mu.Unlock()
+}
+
+// wait takes |n| tokens, waiting until they may be used or |ctx| is done.
+func (b *tokenBucket) wait(ctx context.Context, n float64) error {
+	if d := b.reserve(n); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			b.cancel(n)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// qpsTransport wraps the HTTP transport of the Drive client for --max_qps.  Each request waits for
+// a token, so that concurrent workers together stay under the quota instead of running into
+// rateLimitExceeded and backing off one by one.
+type qpsTransport struct {
+	base   http.RoundTripper
+	bucket *tokenBucket
+}
+
+// NewQPSTransport returns an HTTP transport for Drive clients that sends the requests of |base|
+// at no more than |rate| per second (--max_qps).
+func NewQPSTransport(base http.RoundTripper, rate float64) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &qpsTransport{base: base, bucket: newTokenBucket(rate, math.Max(1, math.Ceil(rate)))}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *qpsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.bucket.wait(req.Context(), 1); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// limitedReader reads at most as fast as |bucket| allows.
+type limitedReader struct {
+	ctx    context.Context
+	r      io.Reader
+	bucket *tokenBucket
+}
+
+// limitUpload returns |r|, the content of an upload, paced by --bwlimit if set.
+func (p *Pusher) limitUpload(ctx context.Context, r io.Reader) io.Reader {
+	if p.uploadBucket == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, bucket: p.uploadBucket}
+}
+
+func (l *limitedReader) Read(b []byte) (int, error) {
+	if max := int(l.bucket.burst); len(b) > max {
+		b = b[:max]
+	}
+	n, err := l.r.Read(b)
+	if n > 0 {
+		if werr := l.bucket.wait(l.ctx, float64(n)); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
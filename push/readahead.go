@@ -0,0 +1,109 @@
+package push
+
+import (
+	"io"
+	"sync"
+)
+
+// readAheadChunkSize is the size of the buffers shared by all large uploads through chunkPool.
+const readAheadChunkSize = 1 << 20
+
+var chunkPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, readAheadChunkSize)
+		return &b
+	},
+}
+
+// chunk is a filled buffer borrowed from chunkPool.
+type chunk struct {
+	buf *[]byte
+	n   int
+	off int
+	err error
+}
+
+// readAheadReader reads from an underlying reader in the background, keeping up to --read_ahead
+// pooled chunks ready so that disk reads overlap with network writes.  Close must be called to
+// return the buffers to the pool.
+type readAheadReader struct {
+	chunks chan *chunk
+	done   chan struct{}
+	cur    *chunk
+	err    error
+	once   sync.Once
+}
+
+// newReadAheadReader starts reading |r| ahead of the consumer.
+func newReadAheadReader(r io.Reader, ahead int) *readAheadReader {
+	if ahead < 1 {
+		ahead = 1
+	}
+	ra := &readAheadReader{
+		chunks: make(chan *chunk, ahead),
+		done:   make(chan struct{}),
+	}
+	go ra.fill(r)
+	return ra
+}
+
+// fill runs in its own goroutine until |r| is exhausted or the reader is closed.
+func (ra *readAheadReader) fill(r io.Reader) {
+	defer close(ra.chunks)
+	for {
+		buf := chunkPool.Get().(*[]byte)
+		n, err := io.ReadFull(r, *buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		select {
+		case ra.chunks <- &chunk{buf: buf, n: n, err: err}:
+		case <-ra.done:
+			chunkPool.Put(buf)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read implements io.Reader.
+func (ra *readAheadReader) Read(p []byte) (int, error) {
+	for ra.cur == nil || ra.cur.off == ra.cur.n {
+		if ra.cur != nil {
+			if ra.cur.err != nil {
+				ra.err = ra.cur.err
+			}
+			chunkPool.Put(ra.cur.buf)
+			ra.cur = nil
+		}
+		if ra.err != nil {
+			return 0, ra.err
+		}
+		c, ok := <-ra.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		ra.cur = c
+	}
+	n := copy(p, (*ra.cur.buf)[ra.cur.off:ra.cur.n])
+	ra.cur.off += n
+	return n, nil
+}
+
+// Close stops the read-ahead and returns all buffers to the pool.  It does not close the
+// underlying reader.
+func (ra *readAheadReader) Close() error {
+	ra.once.Do(func() {
+		close(ra.done)
+		if ra.cur != nil {
+			chunkPool.Put(ra.cur.buf)
+			ra.cur = nil
+		}
+		for c := range ra.chunks {
+			chunkPool.Put(c.buf)
+		}
+	})
+	return nil
+}
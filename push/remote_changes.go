@@ -0,0 +1,90 @@
+package push
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+	"google.golang.org/api/googleapi"
+
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+// followChanges brings the folder listings saved in the sync state up to date with what changed in
+// GDrive since the last run, for --remote_changes.  listFolderPages then serves them as saved, see
+// savedListing.  The feed position is taken before reading the feed, so that the changes made
+// meanwhile are read again next time rather than missed.
+func (p *Pusher) followChanges(ctx context.Context) error {
+	token, err := p.startChangeToken(ctx)
+	if err != nil {
+		return err
+	}
+	if p.st.ChangesToken == "" {
+		// Listings saved before the feed was followed may be older than |token|, and would
+		// never learn of the changes in between
+		p.st.Remote = make(map[string][]*state.RemoteEntry)
+		p.st.Listed = make(map[string]time.Time)
+		p.st.ChangesToken = token
+		return nil
+	}
+	changes, err := p.changesSince(ctx, p.st.ChangesToken)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code >= 400 && apiErr.Code < 500 {
+		// The token expired, start over
+		log.Printf("Problem reading the GDrive change feed, listing everything again: %v", err)
+		p.st.Remote = make(map[string][]*state.RemoteEntry)
+		p.st.Listed = make(map[string]time.Time)
+		p.st.ChangesToken = token
+		return nil
+	} else if err != nil {
+		return err
+	}
+	folders := applyChanges(p.st.Remote, changes)
+	p.followed = make(map[string]bool, len(p.st.Remote))
+	for id := range p.st.Remote {
+		p.followed[id] = true
+	}
+	p.st.ChangesToken = token
+	p.printf("%d change(s) in GDrive since the last run touched %d of the %d saved folder listings, none will be listed again\n\n",
+		len(changes), folders, len(p.st.Remote))
+	return nil
+}
+
+// applyChanges updates the saved folder listings |remote| with the latest |changes| to each item,
+// and returns how many listings changed.  Changes to items outside of the saved folders don't
+// matter, nothing was pushed there.
+func applyChanges(remote map[string][]*state.RemoteEntry, changes []*drive.Change) int {
+	byID := make(map[string][]string)
+	for folderID, entries := range remote {
+		for _, e := range entries {
+			byID[e.ID] = append(byID[e.ID], folderID)
+		}
+	}
+	touched := make(map[string]bool)
+	for _, c := range changes {
+		// Take the item out of where it was, then put it back where it is now
+		for _, folderID := range byID[c.FileId] {
+			entries := remote[folderID]
+			for i, e := range entries {
+				if e.ID == c.FileId {
+					remote[folderID] = append(entries[:i], entries[i+1:]...)
+					touched[folderID] = true
+					break
+				}
+			}
+		}
+		f := c.File
+		if c.Deleted || f == nil || (f.Labels != nil && f.Labels.Trashed) {
+			continue
+		}
+		for _, parent := range f.Parents {
+			if _, ok := remote[parent.Id]; ok {
+				remote[parent.Id] = append(remote[parent.Id], remoteEntry(f))
+				touched[parent.Id] = true
+			}
+		}
+	}
+	return len(touched)
+}
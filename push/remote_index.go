@@ -0,0 +1,52 @@
+package push
+
+import (
+	"golang.org/x/text/unicode/norm"
+	drive "google.golang.org/api/drive/v2"
+)
+
+// normalizeName returns the form titles are compared in.  Some filesystems (notably macOS) hand
+// out decomposed Unicode names while GDrive keeps whatever was uploaded, so both sides are
+// compared in NFC.  Local names that aren't valid UTF-8 are compared in their escaped form, which
+// is what they are titled in GDrive.
+func normalizeName(name string) string {
+	return norm.NFC.String(EscapeName(name))
+}
+
+// remoteIndex indexes the items of one GDrive folder so that matching local items against very
+// large folders stays linear.
+type remoteIndex struct {
+	byName   map[string][]*drive.File
+	byOrigin map[string]*drive.File
+}
+
+// newRemoteIndex returns an index holding |items|.
+func newRemoteIndex(items []*drive.File) *remoteIndex {
+	idx := &remoteIndex{
+		byName:   make(map[string][]*drive.File),
+		byOrigin: make(map[string]*drive.File),
+	}
+	idx.add(items)
+	return idx
+}
+
+// add indexes another page of |items|.
+func (idx *remoteIndex) add(items []*drive.File) {
+	for _, item := range items {
+		name := normalizeName(item.Title)
+		idx.byName[name] = append(idx.byName[name], item)
+		if origin := originOf(item); origin != "" {
+			if _, dup := idx.byOrigin[origin]; !dup {
+				idx.byOrigin[origin] = item
+			}
+		}
+	}
+}
+
+// named returns the first item titled |title|, or nil.
+func (idx *remoteIndex) named(title string) *drive.File {
+	if items := idx.byName[normalizeName(title)]; len(items) > 0 {
+		return items[0]
+	}
+	return nil
+}
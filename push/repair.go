@@ -0,0 +1,210 @@
+package push
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// repairIssue is an inconsistency under the managed root, typically left behind by an interrupted
+// run.
+type repairIssue struct {
+	relName string
+	problem string
+	// fix resolves the issue, it is nil for issues that only need reporting.
+	fix func() error
+}
+
+// repairer walks the managed root looking for inconsistencies.
+type repairer struct {
+	p       *Pusher
+	issues  []*repairIssue
+	folders map[string]string // managed folder ID -> relative path
+	// journaled holds the IDs of the items the resume log of an interrupted push says it made.
+	journaled map[string]bool
+}
+
+// ours reports whether |item| was pushed by this tool, which is what repairs may touch: items
+// other people or apps put under the root are left alone.  Older pushes didn't tag items with
+// originProperty, the resume log still vouches for those of the last interrupted one.
+func (r *repairer) ours(item *drive.File) bool {
+	return originOf(item) != "" || r.journaled[item.Id]
+}
+
+// walk inspects the GDrive folder |folderID| (at |relDir|) against its local counterpart |local|,
+// which is nil when the folder no longer exists locally.  It returns how many items the folder has.
+func (r *repairer) walk(ctx context.Context, folderID, relDir string, local *directory_tree.Node) (int, error) {
+	r.folders[folderID] = relDir
+	items, err := r.p.listFolder(ctx, folderID)
+	if err != nil {
+		return 0, fmt.Errorf("Problem listing %q: %v", relDir, err)
+	}
+
+	byTitle := make(map[string][]*drive.File)
+	for _, item := range items {
+		if item.MimeType != folderMimeType && r.ours(item) {
+			byTitle[item.Title] = append(byTitle[item.Title], item)
+		}
+	}
+	for title, dups := range byTitle {
+		if len(dups) < 2 {
+			continue
+		}
+		// Keep the copy the resume log recorded, or else the newest: a retried upload that
+		// actually succeeded the first time leaves older duplicates behind.
+		sort.Slice(dups, func(i, j int) bool {
+			if r.journaled[dups[i].Id] != r.journaled[dups[j].Id] {
+				return r.journaled[dups[i].Id]
+			}
+			return dups[i].ModifiedDate > dups[j].ModifiedDate
+		})
+		stale := dups[1:]
+		r.issues = append(r.issues, &repairIssue{
+			relName: path.Join(relDir, title),
+			problem: fmt.Sprintf("%d duplicate copies, older ones will be moved to --old_files_dir", len(stale)),
+			fix: func() error {
+				for _, f := range stale {
+					if err := r.p.relocateFile(ctx, path.Join(relDir, title), f.Id, folderID); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		})
+	}
+
+	for _, item := range items {
+		if item.MimeType != folderMimeType {
+			continue
+		}
+		var localChild *directory_tree.Node
+		if local != nil {
+			for _, c := range local.Children {
+				if c.Info.Name == item.Title && c.Info.IsDir {
+					localChild = c
+					break
+				}
+			}
+		}
+		relName := path.Join(relDir, item.Title)
+		n, err := r.walk(ctx, item.Id, relName, localChild)
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			continue
+		}
+		switch {
+		case localChild == nil && r.ours(item):
+			folder := item
+			r.issues = append(r.issues, &repairIssue{
+				relName: relName + "/",
+				problem: "empty folder with no local counterpart, will be trashed",
+				fix:     func() error { return r.p.trashFile(ctx, folder.Id) },
+			})
+		case localChild != nil && len(localChild.Children) > 0:
+			r.issues = append(r.issues, &repairIssue{
+				relName: relName + "/",
+				problem: "folder was created but never populated, the next push will fill it",
+			})
+		}
+	}
+	return len(items), nil
+}
+
+// checkOldFiles finds files that were moved into --old_files_dir, or an --old_files_dir_for folder,
+// by an interrupted relocation and still have a managed folder as a parent.
+func (r *repairer) checkOldFiles(ctx context.Context) error {
+	var items []*drive.File
+	for _, dir := range r.p.oldFilesDirs() {
+		dirItems, err := r.p.listFolder(ctx, dir)
+		if err != nil {
+			return fmt.Errorf("Problem listing old files folder %q: %v", dir, err)
+		}
+		items = append(items, dirItems...)
+	}
+	for _, item := range items {
+		if !r.p.managed(item) {
+			continue
+		}
+		for _, parent := range item.Parents {
+			relDir, ok := r.folders[parent.Id]
+			if !ok {
+				continue
+			}
+			fileID, parentID := item.Id, parent.Id
+			r.issues = append(r.issues, &repairIssue{
+				relName: path.Join(relDir, item.Title),
+				problem: "relocation to --old_files_dir was interrupted, it will be completed",
+				fix: func() error {
+					if err := r.p.ops.take(callParentDelete); err != nil {
+						return err
+					}
+					return r.p.removeParent(ctx, fileID, parentID)
+				},
+			})
+		}
+	}
+	return nil
+}
+
+// Repair implements "repair", which reports inconsistencies under Options.RootID, and "repair
+// apply", which also fixes them if |apply| is set.
+func (p *Pusher) Repair(ctx context.Context, apply bool) error {
+	if p.opts.OldFilesDir == "" {
+		return fmt.Errorf("--old_files_dir must be provided")
+	}
+
+	tree, err := directory_tree.NewTreeFS(p.sourceFS(), ".", p.opts.LocalDir, p.opts.Filter)
+	if err != nil {
+		return fmt.Errorf("Problem creating directory_tree: %v", err)
+	}
+	if err := p.connect(ctx); err != nil {
+		return err
+	}
+	entries, err := readResumeLog(resumeLogPath(p.st.Path()))
+	if err != nil {
+		return fmt.Errorf("Problem reading resume log: %v", err)
+	}
+	r := &repairer{
+		p:         p,
+		folders:   make(map[string]string),
+		journaled: make(map[string]bool),
+	}
+	for _, e := range entries {
+		if e.Op != resumeRelocate {
+			r.journaled[e.ID] = true
+		}
+	}
+	rootID, err := r.p.resolveRoot(ctx)
+	if err != nil {
+		return fmt.Errorf("Problem with --gdrive_root_id: %v", err)
+	}
+	if _, err := r.walk(ctx, rootID, "", tree); err != nil {
+		return err
+	}
+	if err := r.checkOldFiles(ctx); err != nil {
+		return err
+	}
+
+	sort.Slice(r.issues, func(i, j int) bool { return r.issues[i].relName < r.issues[j].relName })
+	for _, issue := range r.issues {
+		p.printf("! /%s: %s\n", EscapeName(issue.relName), issue.problem)
+		if !apply || issue.fix == nil {
+			continue
+		}
+		if err := issue.fix(); err != nil {
+			return fmt.Errorf("Problem repairing %q: %v", issue.relName, err)
+		}
+	}
+	p.printf("%d issue(s) found\n", len(r.issues))
+	if !apply && len(r.issues) > 0 {
+		p.printf("Run \"repair apply\" to fix them\n")
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package push
+
+import (
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+// TestRepairForeignFolder checks that repair leaves alone a folder someone else put under the root,
+// which has nothing local to match.
+func TestRepairForeignFolder(t *testing.T) {
+	st := state.New(filepath.Join(t.TempDir(), "state"), "root")
+	st.Remote = map[string][]*state.RemoteEntry{
+		"root":    {{ID: "foreign", Title: "theirs", MimeType: folderMimeType}},
+		"foreign": {},
+	}
+	p := New(nil, st, Options{RootID: "root", OldFilesDir: "old", Offline: true})
+	r := &repairer{p: p, folders: make(map[string]string), journaled: make(map[string]bool)}
+	local := &directory_tree.Node{Info: &directory_tree.FileInfo{Name: "local", IsDir: true}}
+
+	n, err := r.walk(context.Background(), "root", "", local)
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("walk found %d item(s), want 1", n)
+	}
+	if len(r.issues) != 0 {
+		t.Errorf("walk found %d issue(s) with a foreign folder, want none", len(r.issues))
+	}
+}
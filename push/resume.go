@@ -0,0 +1,175 @@
+package push
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// Operations in a resume log.
+const (
+	resumeMkdir    = "mkdir"
+	resumeUpload   = "upload"
+	resumeRelocate = "relocate"
+)
+
+// resumeEntry is one completed write operation in a resume log.
+type resumeEntry struct {
+	Op string `json:"op"`
+	// Path is the local path of the item relative to --local_dir_to_push.
+	Path string `json:"path"`
+	// ID is the GDrive item created, or relocated.
+	ID string `json:"id"`
+	// Parent is the GDrive folder the item was created in, or relocated from.
+	Parent string `json:"parent"`
+	Title  string `json:"title,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	MD5    string `json:"md5,omitempty"`
+}
+
+// resumeLog records each write operation of a push as it completes, next to the sync state, so
+// that a push that didn't complete can be picked up with --resume.  It is removed once a push
+// completes.
+type resumeLog struct {
+	path string
+
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// resumeLogPath returns where the resume log of the sync state at |statePath| is kept.
+func resumeLogPath(statePath string) string {
+	return statePath + ".resume"
+}
+
+// openResumeLog starts the resume log at |path|, adding to the one there with |keep| set and
+// replacing it otherwise.
+func openResumeLog(path string, keep bool) (*resumeLog, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if keep {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &resumeLog{path: path, f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// readResumeLog returns the entries of the resume log at |path|, none if there is no log.  A last
+// line cut short by a crash is ignored.
+func readResumeLog(path string) ([]*resumeEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []*resumeEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := &resumeEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// record appends |e| to the log.  Failing to is only worth a warning, the log saves time but the
+// push is right without it.
+func (l *resumeLog) record(e *resumeEntry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(e); err != nil {
+		fmt.Fprintf(os.Stderr, "Problem writing resume log: %v\n", err)
+	}
+}
+
+// finish closes the log, removing it if the push completed.
+func (l *resumeLog) finish(completed bool) {
+	if l == nil {
+		return
+	}
+	l.f.Close()
+	if completed {
+		os.Remove(l.path)
+	}
+}
+
+// logUpload records the upload of |localItem|, found at |relName|, as |id| in the GDrive folder
+// |parentID|.
+func (p *Pusher) logUpload(localItem *directory_tree.Node, relName, parentID, id string) error {
+	if p.resumeLog == nil {
+		return nil
+	}
+	sum, err := p.hashFile(localItem, relName)
+	if err != nil {
+		return fmt.Errorf("Problem hashing local file %q: %v", relName, err)
+	}
+	p.resumeLog.record(&resumeEntry{
+		Op:     resumeUpload,
+		Path:   relName,
+		ID:     id,
+		Parent: parentID,
+		Title:  EscapeName(driveName(localItem)),
+		Size:   localItem.Info.Size,
+		MD5:    sum,
+	})
+	return nil
+}
+
+// seedResume takes in the |entries| of the resume log of the push being resumed.  The folders it
+// created hold only what it put there, so their contents are known without listing them.
+func (p *Pusher) seedResume(entries []*resumeEntry) {
+	items := make(map[string][]*drive.File)
+	fresh := make(map[string]bool)
+	relocated := make(map[string]bool)
+	for _, e := range entries {
+		switch e.Op {
+		case resumeMkdir:
+			fresh[e.ID] = true
+			items[e.Parent] = append(items[e.Parent], &drive.File{
+				Id:         e.ID,
+				Title:      e.Title,
+				MimeType:   folderMimeType,
+				Properties: originProperties(e.Path),
+			})
+		case resumeUpload:
+			items[e.Parent] = append(items[e.Parent], &drive.File{
+				Id:          e.ID,
+				Title:       e.Title,
+				FileSize:    e.Size,
+				Md5Checksum: e.MD5,
+				Properties:  originProperties(e.Path),
+			})
+		case resumeRelocate:
+			relocated[e.ID] = true
+		}
+	}
+	if p.precreated == nil {
+		p.precreated = make(map[string]*remoteIndex)
+	}
+	for id := range fresh {
+		var kept []*drive.File
+		for _, item := range items[id] {
+			if !relocated[item.Id] {
+				kept = append(kept, item)
+			}
+		}
+		p.precreated[id] = newRemoteIndex(kept)
+	}
+	p.printf("Resuming after %d operation(s), the %d folder(s) created before won't be listed\n\n", len(entries), len(fresh))
+}
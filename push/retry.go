@@ -0,0 +1,65 @@
+package push
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// The wait before the first retry of a Drive call, which doubles with every attempt up to
+// backoffMax.
+const (
+	backoffBase = time.Second
+	backoffMax  = 32 * time.Second
+)
+
+// Retryable reports whether a Drive call that failed with |err| may succeed when retried.  Server
+// errors, rate limiting and network trouble are transient, while requests Drive rejected as wrong,
+// with any other 4xx status, would only fail again.
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	switch {
+	case apiErr.Code >= 500, apiErr.Code == 429, apiErr.Code == 408:
+		return true
+	case apiErr.Code == 403:
+		for _, e := range apiErr.Errors {
+			if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Backoff is what the retry loops around Drive calls do after attempt |attempt|, counting from 1,
+// failed with |err|.  It reports whether to retry, waiting first if so: exponentially longer with
+// every attempt, with jitter so that concurrent workers don't retry in lockstep.  It doesn't wait
+// past |ctx|.
+func Backoff(ctx context.Context, attempt int, err error) bool {
+	if !Retryable(err) || ctx.Err() != nil {
+		return false
+	}
+	wait := backoffMax
+	if attempt < 6 {
+		wait = backoffBase << uint(attempt-1)
+	}
+	// Full jitter over the upper half keeps the growth while spreading the retries out
+	wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
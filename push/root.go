@@ -0,0 +1,52 @@
+package push
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/try"
+)
+
+// MyDriveAlias is the --gdrive_root_id that refers to the top level of My Drive.
+const MyDriveAlias = "root"
+
+// getFile fetches the metadata of |fileID|.  It returns an error if the operation fails.
+func (p *Pusher) getFile(ctx context.Context, fileID string) (*drive.File, error) {
+	slog.Debug("getFile", "id", fileID)
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	var r *drive.File
+	if err := try.Do(func(attempt int) (bool, error) {
+		var err error
+		p.countCall(ctx, callGet)
+		r, err = p.drv.Files.Get(fileID).Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return nil, fmt.Errorf("A Get() error occurred: %v", err)
+	}
+	return r, nil
+}
+
+// resolveRoot checks that --gdrive_root_id is a folder that can be pushed to and returns its real
+// ID.  For the "root" alias Drive reports items at the top level of My Drive with the folder's real
+// ID as parent, so the alias must be resolved before any IDs are compared.
+func (p *Pusher) resolveRoot(ctx context.Context) (string, error) {
+	f, err := p.getFile(ctx, p.opts.RootID)
+	if err != nil {
+		return "", err
+	}
+	if f.MimeType != folderMimeType {
+		return "", fmt.Errorf("%q is a %s, not a folder", f.Title, f.MimeType)
+	}
+	if f.Labels != nil && f.Labels.Trashed {
+		return "", fmt.Errorf("%q is in the trash", f.Title)
+	}
+	return f.Id, nil
+}
@@ -0,0 +1,93 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+	"google.golang.org/api/googleapi"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+	"github.com/hatchling/try"
+)
+
+// SidecarSuffix is appended to a file's title to name its --sidecar metadata file.
+const SidecarSuffix = ".meta.json"
+
+// sidecarMeta is the local metadata written to a --sidecar file.
+type sidecarMeta struct {
+	Path       string    `json:"path"`
+	SourceHost string    `json:"source_host"`
+	SourcePath string    `json:"source_path"`
+	Size       int64     `json:"size"`
+	Mode       string    `json:"mode"`
+	ModeBits   uint32    `json:"mode_bits"`
+	ModTime    time.Time `json:"mod_time"`
+	MD5        string    `json:"md5"`
+	PushedAt   time.Time `json:"pushed_at"`
+}
+
+// createSidecar uploads a metadata file describing |localFile| next to it in the GDrive folder
+// |parentID|.  It returns an error if the operation fails.
+func (p *Pusher) createSidecar(ctx context.Context, localFile *directory_tree.Node, relName, parentID string) error {
+	if p.opts.DryRun {
+		p.estimated.add(callMultipart, 0)
+		return nil
+	}
+	if err := p.ops.take(callMultipart); err != nil {
+		return err
+	}
+	slog.Debug("createSidecar", "path", relName, "parent", parentID)
+	sum, err := p.hashFile(localFile, relName)
+	if err != nil {
+		return fmt.Errorf("Problem hashing local file: %v", err)
+	}
+	host, _ := os.Hostname()
+	meta := &sidecarMeta{
+		Path:       relName,
+		SourceHost: host,
+		SourcePath: localFile.FullPath,
+		Size:       localFile.Info.Size,
+		Mode:       localFile.Info.Mode.String(),
+		ModeBits:   uint32(localFile.Info.Mode),
+		ModTime:    localFile.Info.ModTime,
+		MD5:        sum,
+		PushedAt:   time.Now(),
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	f := &drive.File{
+		Title:    EscapeName(driveName(localFile)) + SidecarSuffix,
+		MimeType: "application/json",
+		Parents: []*drive.ParentReference{
+			&drive.ParentReference{Id: parentID},
+		},
+	}
+	p.forgetListings(parentID)
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	if err := try.Do(func(attempt int) (bool, error) {
+		p.countCall(ctx, callMultipart)
+		_, err := p.drv.Files.Insert(f).Media(bytes.NewReader(data), googleapi.ChunkSize(0)).Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return fmt.Errorf("An error occurred uploading the sidecar: %v", err)
+	}
+	return nil
+}
+
+// findSidecar returns the existing sidecar for the file titled |title| in |remote|, if any.
+func findSidecar(remote *remoteIndex, title string) *drive.File {
+	return remote.named(title + SidecarSuffix)
+}
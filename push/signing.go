@@ -0,0 +1,35 @@
+package push
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+)
+
+// signFile makes a detached signature of |path| with the tool chosen by --sign, so that consumers
+// can check the file both for integrity and for who published it.  It returns the path of the
+// signature.
+func (p *Pusher) signFile(path string) (string, error) {
+	var sigPath string
+	var cmd *exec.Cmd
+	switch p.opts.Sign {
+	case "gpg":
+		sigPath = path + ".asc"
+		args := []string{"--batch", "--yes", "--armor", "--detach-sign", "--output", sigPath}
+		if p.opts.SignKey != "" {
+			args = append(args, "--local-user", p.opts.SignKey)
+		}
+		cmd = exec.Command("gpg", append(args, path)...)
+	case "minisign":
+		sigPath = path + ".minisig"
+		cmd = exec.Command("minisign", "-S", "-s", p.opts.SignKey, "-x", sigPath, "-m", path)
+	}
+	slog.Debug("signFile", "path", path, "command", cmd.Args)
+	// Either tool may need to ask for the key's passphrase
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Problem signing %q with %s: %v", path, p.opts.Sign, err)
+	}
+	return sigPath, nil
+}
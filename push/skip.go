@@ -0,0 +1,23 @@
+package push
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+// quarantine adds |relName| to the skip list because pushing it failed with |err|, so that one bad
+// file doesn't fail every future run, and reports it on |line|.  It returns whether the failure was quarantined, which is
+// only done with --quarantine_failures.
+func (p *Pusher) quarantine(relName string, err error, line *statusLine) bool {
+	if !p.opts.QuarantineFailures {
+		return false
+	}
+	p.mu.Lock()
+	p.st.Skip[relName] = &state.SkipEntry{Reason: err.Error(), Added: time.Now()}
+	p.failures = append(p.failures, Failure{Path: filepath.ToSlash(EscapeName(relName)), Error: err.Error()})
+	p.mu.Unlock()
+	line.print("Q /%s (%v)\n", EscapeName(relName), err)
+	return true
+}
@@ -0,0 +1,38 @@
+package push
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// countFiles returns how many files there are below |node|.
+func countFiles(node *directory_tree.Node) int {
+	var n int
+	for _, child := range node.Children {
+		if child.Info.IsDir {
+			n += countFiles(child)
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// checkSource refuses |tree|, the local dir about to be synced, if it looks like a volume that
+// isn't mounted: --sentinel_file is missing from it, or it holds no files at all.  A mirror pushed
+// from an empty mount point would otherwise have everything relocated or deleted.  |partial| trees,
+// which only hold what a --journal names, may well be empty and are only checked for the sentinel.
+func (p *Pusher) checkSource(tree *directory_tree.Node, partial bool) error {
+	if p.opts.SentinelFile != "" {
+		if _, err := fs.Stat(p.sourceFS(), path.Clean(p.opts.SentinelFile)); err != nil {
+			return fmt.Errorf("--sentinel_file %q is missing from %q, is it mounted? (%v)", p.opts.SentinelFile, p.opts.LocalDir, err)
+		}
+	}
+	if !partial && !p.opts.AllowEmpty && countFiles(tree) == 0 {
+		return fmt.Errorf("%q holds no files to push, is it mounted? Pass --allow_empty if it really is empty", p.opts.LocalDir)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package push
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+	"github.com/hatchling/try"
+)
+
+// renameFile changes the title of |fileID| to |title|.  It returns an error if the operation fails.
+func (p *Pusher) renameFile(ctx context.Context, fileID, title string) error {
+	if p.opts.DryRun {
+		p.estimated.add(callPatch, 0)
+		return nil
+	}
+	if err := p.ops.take(callPatch); err != nil {
+		return err
+	}
+	slog.Debug("renameFile", "id", fileID, "title", title)
+	renamed := &drive.File{Title: title}
+	p.forgetItem(fileID)
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	if err := try.Do(func(attempt int) (bool, error) {
+		p.countCall(ctx, callPatch)
+		_, err := p.drv.Files.Patch(fileID, renamed).Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return fmt.Errorf("A Patch() error occurred: %v", err)
+	}
+	return nil
+}
+
+// pushStaged publishes |tree| as a folder inside the GDrive folder |rootID| without anyone ever
+// seeing it half pushed: everything is uploaded into a fresh staging folder first, and only once
+// that fully succeeded is the previous version moved to --old_files_dir and the staging folder
+// renamed into its place.
+func (p *Pusher) pushStaged(ctx context.Context, tree *directory_tree.Node, rootID string) error {
+	name := p.opts.StagedName
+	if name == "" {
+		name = filepath.Base(p.opts.LocalDir)
+	}
+	stagingTitle := fmt.Sprintf(".staging-%s-%s", name, time.Now().Format("20060102-150405"))
+	stagingID, err := p.createFolder(ctx, stagingTitle, ".", rootID, tree.Info.ModTime)
+	if err != nil {
+		return fmt.Errorf("Problem creating staging folder: %v", err)
+	}
+	p.printf("+ staging into %q\n", stagingTitle)
+
+	tree.DriveID = stagingID
+	if err := p.processNode(ctx, tree); err != nil {
+		return fmt.Errorf("%v (the incomplete staging folder %q was left in place)", err, stagingTitle)
+	}
+
+	if !p.opts.DryRun {
+		current, err := p.indexFolder(ctx, rootID)
+		if err != nil {
+			return fmt.Errorf("Problem listing GDrive folder: %v", err)
+		}
+		if previous := current.named(name); previous != nil {
+			if err := p.relocateFile(ctx, ".", previous.Id, rootID); err != nil {
+				return fmt.Errorf("Problem relocating previous version of %q: %v", name, err)
+			}
+			p.printf("M %q moved to --old_files_dir\n", name)
+		}
+	}
+	if err := p.renameFile(ctx, stagingID, name); err != nil {
+		return fmt.Errorf("Problem publishing staging folder %q: %v", stagingTitle, err)
+	}
+	p.printf("+ published %q\n", name)
+	return nil
+}
@@ -0,0 +1,99 @@
+package push
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+// forecastWindow is how far back the history is looked at to tell how fast storage grows.
+const forecastWindow = 30 * 24 * time.Hour
+
+// storageUse accounts for the Drive storage a push takes up.  Pushes never free any: files they
+// replace are moved to an old files folder and extraneous ones to it or the trash, where they keep
+// counting against the quota until they are deleted for good.
+type storageUse struct {
+	mu sync.Mutex
+	// added is the size of the files uploaded or copied.
+	added int64
+	// relocated and trashed are the sizes of the files moved to old files folders and the trash.
+	relocated int64
+	trashed   int64
+}
+
+func (s *storageUse) add(size int64) {
+	s.mu.Lock()
+	s.added += size
+	s.mu.Unlock()
+}
+
+func (s *storageUse) relocate(size int64) {
+	s.mu.Lock()
+	s.relocated += size
+	s.mu.Unlock()
+}
+
+func (s *storageUse) trash(size int64) {
+	s.mu.Lock()
+	s.trashed += size
+	s.mu.Unlock()
+}
+
+// print writes the storage this run took up to |w| and, given the |runs| in the history and the
+// |quota| of the account if known, when the quota will run out at the rate storage has grown
+// lately.
+func (s *storageUse) print(w io.Writer, runs []*state.Run, quota *drive.About) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(w, "Drive storage: %s added", humanize.Bytes(uint64(s.added)))
+	if s.relocated > 0 || s.trashed > 0 {
+		fmt.Fprintf(w, ", replaced and removed files still take up %s in old files folders and %s in the trash",
+			humanize.Bytes(uint64(s.relocated)), humanize.Bytes(uint64(s.trashed)))
+	}
+	fmt.Fprintf(w, "\n")
+	if quota == nil || quota.QuotaBytesTotal <= 0 {
+		return
+	}
+	fmt.Fprintf(w, "  %s of %s used\n", humanize.Bytes(uint64(quota.QuotaBytesUsed)), humanize.Bytes(uint64(quota.QuotaBytesTotal)))
+	if rate, full, ok := forecastFull(runs, quota.QuotaBytesUsed, quota.QuotaBytesTotal, time.Now()); ok {
+		fmt.Fprintf(w, "  Pushes added %s a day lately, at that rate the quota runs out around %s\n",
+			humanize.Bytes(uint64(rate)), full.Local().Format("2006-01-02"))
+	}
+}
+
+// forecastFull returns how many bytes a day the pushes in |runs| added over the last
+// forecastWindow before |now|, and when |used| of |total| bytes reaches |total| at that rate.  It
+// returns false if the history spans less than a day, storage didn't grow or won't fill up for a
+// century.
+func forecastFull(runs []*state.Run, used, total int64, now time.Time) (float64, time.Time, bool) {
+	var added int64
+	oldest := now
+	for _, r := range runs {
+		if r.Kind != "push" || r.DryRun || now.Sub(r.Start) > forecastWindow {
+			continue
+		}
+		added += r.StorageAdded
+		if r.Start.Before(oldest) {
+			oldest = r.Start
+		}
+	}
+	days := now.Sub(oldest).Hours() / 24
+	if days < 1 || added <= 0 {
+		return 0, time.Time{}, false
+	}
+	rate := float64(added) / days
+	left := float64(total-used) / rate
+	if left < 0 {
+		left = 0
+	} else if left > 100*365 {
+		// Not worth forecasting, and past what a time.Duration holds
+		return rate, time.Time{}, false
+	}
+	return rate, now.Add(time.Duration(left * float64(24*time.Hour))), true
+}
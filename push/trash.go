@@ -0,0 +1,154 @@
+package push
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/try"
+)
+
+const (
+	// trashedProperty marks items this tool trashed, its value is the --gdrive_root_id they were
+	// trashed from so that trash commands stay scoped to the managed root.
+	trashedProperty = "gdrive_dir_push_trashed"
+	// trashedAtProperty records when the item was trashed (RFC 3339).
+	trashedAtProperty = "gdrive_dir_push_trashed_at"
+)
+
+// trashFile tags |fileID| as trashed by this tool and moves it to the GDrive trash.  It returns an
+// error if the operation fails.
+func (p *Pusher) trashFile(ctx context.Context, fileID string) error {
+	if err := p.ops.take(callTrash); err != nil {
+		return err
+	}
+	slog.Debug("trashFile", "id", fileID)
+	p.forgetItem(fileID)
+	tags := &drive.File{
+		Properties: []*drive.Property{
+			{Key: trashedProperty, Value: p.opts.RootID, Visibility: "PRIVATE"},
+			{Key: trashedAtProperty, Value: time.Now().UTC().Format(time.RFC3339), Visibility: "PRIVATE"},
+		},
+	}
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	if err := try.Do(func(attempt int) (bool, error) {
+		p.countCall(ctx, callPatch)
+		_, err := p.drv.Files.Patch(fileID, tags).Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return fmt.Errorf("A Patch() error occurred: %v", err)
+	}
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	if err := try.Do(func(attempt int) (bool, error) {
+		p.countCall(ctx, callTrash)
+		_, err := p.drv.Files.Trash(fileID).Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return fmt.Errorf("A Trash() error occurred: %v", err)
+	}
+	return nil
+}
+
+// deleteFile permanently deletes |fileID|.  It returns an error if the operation fails.
+func (p *Pusher) deleteFile(ctx context.Context, fileID string) error {
+	if err := p.ops.take(callDelete); err != nil {
+		return err
+	}
+	slog.Debug("deleteFile", "id", fileID)
+	p.forgetItem(fileID)
+
+	// Wrap in a simple retry loop since Drive can be unreliable.
+	if err := try.Do(func(attempt int) (bool, error) {
+		p.countCall(ctx, callDelete)
+		err := p.drv.Files.Delete(fileID).Context(ctx).Do()
+		if err != nil {
+			log.Print(err)
+		}
+		return attempt < try.MaxRetries && Backoff(ctx, attempt, err), err
+	}); err != nil {
+		return fmt.Errorf("A Delete() error occurred: %v", err)
+	}
+	return nil
+}
+
+// trashedAt returns when |f| was trashed by this tool, or the zero time if that wasn't recorded.
+func trashedAt(f *drive.File) time.Time {
+	for _, prop := range f.Properties {
+		if prop.Key == trashedAtProperty {
+			t, err := time.Parse(time.RFC3339, prop.Value)
+			if err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// listTrashed returns the items this tool trashed from the managed root at least |minAge| ago.
+func (p *Pusher) listTrashed(ctx context.Context, minAge time.Duration) ([]*drive.File, error) {
+	query := fmt.Sprintf("trashed=true and properties has { key='%s' and value='%s' and visibility='PRIVATE' }",
+		trashedProperty, p.opts.RootID)
+	files, err := p.listQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-minAge)
+	var old []*drive.File
+	for _, f := range files {
+		if trashedAt(f).Before(cutoff) {
+			old = append(old, f)
+		}
+	}
+	return old, nil
+}
+
+// Trash implements "trash list" and "trash empty", which operate only on items this tool trashed
+// from Options.RootID and that have been in the trash for at least Options.TrashMinAge.
+func (p *Pusher) Trash(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: trash list|empty")
+	}
+	if err := p.connect(ctx); err != nil {
+		return err
+	}
+	files, err := p.listTrashed(ctx, p.opts.TrashMinAge)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		var total int64
+		for _, f := range files {
+			total += f.FileSize
+			p.printf("%s  %8s  %s  (%s)\n", trashedAt(f).Local().Format("2006-01-02 15:04"),
+				humanize.Bytes(uint64(f.FileSize)), f.Title, f.Id)
+		}
+		p.printf("%d item(s), %s\n", len(files), humanize.Bytes(uint64(total)))
+		return nil
+	case "empty":
+		for _, f := range files {
+			if err := p.deleteFile(ctx, f.Id); err != nil {
+				return fmt.Errorf("Problem deleting %q: %v", f.Title, err)
+			}
+			p.printf("- %s (%s)\n", f.Title, f.Id)
+		}
+		p.printf("Permanently deleted %d item(s)\n", len(files))
+		return nil
+	default:
+		return fmt.Errorf("Unknown trash command %q", args[0])
+	}
+}
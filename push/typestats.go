@@ -0,0 +1,96 @@
+package push
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// typeStatsShown is how many file types the report lists before lumping the rest together.
+const typeStatsShown = 10
+
+// typeStat totals the uploads of one file type.
+type typeStat struct {
+	ext   string
+	files int
+	bytes int64
+	took  time.Duration
+}
+
+// typeStats breaks the uploads of a run down by file extension, so that it shows which kinds of
+// files the time goes to.
+type typeStats struct {
+	mu    sync.Mutex
+	byExt map[string]*typeStat
+}
+
+// add counts the upload of the file |name|, of |size| bytes, which took |took|.
+func (s *typeStats) add(name string, size int64, took time.Duration) {
+	ext := strings.ToLower(filepath.Ext(name))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.byExt[ext]
+	if !ok {
+		t = &typeStat{ext: ext}
+		s.byExt[ext] = t
+	}
+	t.files++
+	t.bytes += size
+	t.took += took
+}
+
+// print writes the breakdown to |w|, the types that took longest first.  Times are summed over
+// uploads, which overlap with --parallel.
+func (s *typeStats) print(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.byExt) == 0 {
+		return
+	}
+	stats := make([]*typeStat, 0, len(s.byExt))
+	var total time.Duration
+	for _, t := range s.byExt {
+		stats = append(stats, t)
+		total += t.took
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].took != stats[j].took {
+			return stats[i].took > stats[j].took
+		}
+		return stats[i].ext < stats[j].ext
+	})
+	if len(stats) > typeStatsShown {
+		other := &typeStat{ext: "other"}
+		for _, t := range stats[typeStatsShown-1:] {
+			other.files += t.files
+			other.bytes += t.bytes
+			other.took += t.took
+		}
+		stats = append(stats[:typeStatsShown-1], other)
+	}
+	fmt.Fprintf(w, "Uploads by file type:\n")
+	for _, t := range stats {
+		name := t.ext
+		switch {
+		case name == "":
+			name = "(none)"
+		case name != "other":
+			if mimeType := mime.TypeByExtension(name); mimeType != "" {
+				name += " (" + strings.SplitN(mimeType, ";", 2)[0] + ")"
+			}
+		}
+		share := 0.0
+		if total > 0 {
+			share = float64(t.took) / float64(total) * 100
+		}
+		fmt.Fprintf(w, "  %-32s %6d file(s) %10s %10v %5.1f%%\n", name, t.files, humanize.Bytes(uint64(t.bytes)),
+			t.took.Round(time.Second), share)
+	}
+}
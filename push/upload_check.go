@@ -0,0 +1,33 @@
+package push
+
+import (
+	"fmt"
+	"io/fs"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+)
+
+// checkUpload makes sure the file GDrive stored as |r| is what was read from |localFile|: the MD5 of
+// the bytes sent, |sentMD5|, must match what GDrive reports, and the local file must not have
+// changed since |before| was taken.  The client library resumes interrupted sessions internally
+// without exposing the offset it continued from, so a local change mid-upload would otherwise
+// produce a file stitched together from two versions.  A bad upload is deleted again.
+func (p *Pusher) checkUpload(ctx context.Context, r *drive.File, localFile *directory_tree.Node, before fs.FileInfo, sentMD5 string) error {
+	var problem string
+	if after, err := localFile.Stat(); err != nil {
+		problem = err.Error()
+	} else if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		problem = "the local file changed while it was being uploaded"
+	} else if r.Md5Checksum != "" && r.Md5Checksum != sentMD5 {
+		problem = fmt.Sprintf("GDrive stored MD5 %s but %s was sent", r.Md5Checksum, sentMD5)
+	}
+	if problem == "" {
+		return nil
+	}
+	if err := p.deleteFile(ctx, r.Id); err != nil {
+		return fmt.Errorf("%s, and the bad upload could not be deleted: %v", problem, err)
+	}
+	return fmt.Errorf("%s", problem)
+}
@@ -0,0 +1,105 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	humanize "github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+)
+
+// Drive API methods tracked by countCall.
+const (
+	callList           = "files.list"
+	callGet            = "files.get"
+	callInsert         = "files.insert"
+	callUpload         = "files.insert (resumable)"
+	callMultipart      = "files.insert (multipart)"
+	callPatch          = "files.patch"
+	callTrash          = "files.trash"
+	callDelete         = "files.delete"
+	callParentInsert   = "parents.insert"
+	callParentDelete   = "parents.delete"
+	callAbout          = "about.get"
+	callModifyLabels   = "files.modifyLabels"
+	callUpdate         = "files.update"
+	callComment        = "comments.insert"
+	callDownload       = "files.get (media)"
+	callPermissions    = "permissions.list"
+	callChanges        = "changes.list"
+	callStartToken     = "changes.getStartPageToken"
+	callPropertyDelete = "properties.delete"
+	callCopy           = "files.copy"
+)
+
+// apiUsage accounts for the Drive API requests made during a run, every attempt counts since each
+// one consumes quota.
+type apiUsage struct {
+	Calls         map[string]int `json:"calls"`
+	BytesUploaded int64          `json:"bytes_uploaded"`
+
+	mu sync.Mutex
+}
+
+// usage is shared by the Pushers of the process, like the quota it is counted against.
+var usage = &apiUsage{Calls: make(map[string]int)}
+
+// countCall records one request to the Drive API |method|, to be made with |ctx|.  Should
+// --max_ops_per_day run out, the context of the run is cancelled, which fails the request about
+// to be made.
+func (p *Pusher) countCall(ctx context.Context, method string) {
+	usage.mu.Lock()
+	usage.Calls[method]++
+	usage.mu.Unlock()
+	if err := paceDailyOps(ctx, p.opts.Output); err != nil {
+		p.ops.stop()
+	}
+}
+
+// total returns the number of requests made across all methods.
+func (u *apiUsage) total() int {
+	var n int
+	for _, c := range u.Calls {
+		n += c
+	}
+	return n
+}
+
+// print writes a human readable breakdown of the API usage to |w|.
+func (u *apiUsage) print(w io.Writer) {
+	methods := make([]string, 0, len(u.Calls))
+	for m := range u.Calls {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	fmt.Fprintf(w, "API calls: %d, uploaded %s\n", u.total(), humanize.Bytes(uint64(u.BytesUploaded)))
+	for _, m := range methods {
+		fmt.Fprintf(w, "  %-22s %d\n", m, u.Calls[m])
+	}
+}
+
+// SaveUsage writes a JSON breakdown of the Drive API requests made so far to |path|.
+func SaveUsage(path string) error {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	return usage.save(path)
+}
+
+// save writes the API usage as JSON to |path|.
+func (u *apiUsage) save(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(u); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
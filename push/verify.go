@@ -0,0 +1,374 @@
+package push
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+// verifyOrder returns the synced files in |st| in the order verify checks them: those verified
+// longest ago (or never) first so that repeated sampled runs rotate through the whole mirror, ties
+// broken randomly using |seed|.  Unless |since| is zero, files verified since then and those in
+// |failed| are left out, which leaves what an interrupted pass started at |since| still has to do.
+func verifyOrder(st *state.State, seed int64, since time.Time, failed map[string]bool) []string {
+	var files []string
+	for relName, e := range st.Snapshot {
+		if e.IsDir || failed[relName] {
+			continue
+		}
+		if !since.IsZero() && !st.Verified[relName].Before(since) {
+			continue
+		}
+		files = append(files, relName)
+	}
+	sort.Strings(files)
+	rnd := rand.New(rand.NewSource(seed))
+	rnd.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+	sort.SliceStable(files, func(i, j int) bool {
+		return st.Verified[files[i]].Before(st.Verified[files[j]])
+	})
+	return files
+}
+
+// verifySample picks |percent| of the synced files in |st| to verify, in verifyOrder.
+func verifySample(st *state.State, percent float64, seed int64) []string {
+	files := verifyOrder(st, seed, time.Time{}, nil)
+	n := int(float64(len(files))*percent/100 + 0.999)
+	if n > len(files) {
+		n = len(files)
+	}
+	return files[:n]
+}
+
+// resumeSample returns what is left of the unfinished verify pass |pass| in |st|.  The files the
+// pass picked that haven't been checked yet are still the first in verifyOrder.
+func resumeSample(st *state.State, pass *state.VerifyPass) []string {
+	failed := make(map[string]bool, len(pass.Failed))
+	for _, relName := range pass.Failed {
+		failed[relName] = true
+	}
+	n := pass.Files - len(pass.Failed)
+	for relName, t := range st.Verified {
+		if _, ok := st.Snapshot[relName]; ok && !t.Before(pass.Started) {
+			n--
+		}
+	}
+	files := verifyOrder(st, pass.Seed, pass.Started, failed)
+	if n < 0 {
+		n = 0
+	} else if n > len(files) {
+		n = len(files)
+	}
+	return files[:n]
+}
+
+// verifyFailure is a synced file that doesn't match its GDrive copy.
+type verifyFailure struct {
+	// status is the line reporting the problem.
+	status string
+	// remote is the GDrive copy, nil if it is missing.
+	remote *drive.File
+	// local is the file as it is now, nil if it can't be read.
+	local *directory_tree.Node
+}
+
+// checkFile compares the synced file |relName|, recorded as |e|, with its GDrive copy.  It returns
+// nil if they match, and an error only if |ctx| ended.  Files that --policy stores transformed are
+// only checked for being there, and size_only ones for their size.
+func (p *Pusher) checkFile(ctx context.Context, relName string, e *state.SnapshotEntry) (*verifyFailure, error) {
+	failure := &verifyFailure{}
+	remote, err := p.getFile(ctx, e.DriveID)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		failure.status = fmt.Sprintf("? /%s (missing from GDrive: %v)\n", EscapeName(relName), err)
+	} else {
+		failure.remote = remote
+	}
+	local, err := directory_tree.NewTreeFS(p.sourceFS(), filepath.ToSlash(relName), p.opts.LocalDir, nil)
+	if err != nil {
+		failure.status = fmt.Sprintf("? /%s (unreadable locally: %v)\n", EscapeName(relName), err)
+		return failure, nil
+	}
+	failure.local = local
+	if failure.remote == nil {
+		return failure, nil
+	}
+	switch p.policyFor(local) {
+	case PolicyConvert, PolicyCompress:
+		return nil, nil
+	case PolicySizeOnly:
+		if remote.FileSize == local.Info.Size {
+			return nil, nil
+		}
+		failure.status = fmt.Sprintf("! /%s (local %d bytes, GDrive %d)\n", EscapeName(relName), local.Info.Size, remote.FileSize)
+		return failure, nil
+	}
+	sum, err := nodeMD5(local)
+	if err != nil {
+		failure.local = nil
+		failure.status = fmt.Sprintf("? /%s (unreadable locally: %v)\n", EscapeName(relName), err)
+		return failure, nil
+	}
+	if sum != remote.Md5Checksum {
+		failure.status = fmt.Sprintf("! /%s (local %s, GDrive %s)\n", EscapeName(relName), sum, remote.Md5Checksum)
+		return failure, nil
+	}
+	return nil, nil
+}
+
+// repairFile uploads the local file of |failure| again in place of the synced file |relName|,
+// moving the bad GDrive copy, if any, to --old_files_dir like a push replacing it would.
+func (p *Pusher) repairFile(ctx context.Context, relName string, failure *verifyFailure) error {
+	var parentID string
+	if failure.remote != nil && len(failure.remote.Parents) > 0 {
+		parentID = failure.remote.Parents[0].Id
+	} else if relDir := filepath.Dir(relName); relDir != "." {
+		e, ok := p.st.Snapshot[relDir]
+		if !ok {
+			return fmt.Errorf("Its GDrive folder isn't known, push it instead")
+		}
+		parentID = e.DriveID
+	} else {
+		var err error
+		if parentID, err = p.resolveRoot(ctx); err != nil {
+			return err
+		}
+	}
+	remoteItems, err := p.listFolder(ctx, parentID)
+	if err != nil {
+		return err
+	}
+
+	local := failure.local
+	if failure.remote != nil {
+		local.DriveID = failure.remote.Id
+		// Keep the title the file was pushed under, such as a --name_collisions suffix
+		if failure.remote.Title != EscapeName(local.Info.Name) {
+			local.Title = failure.remote.Title
+		}
+	}
+	out := p.newStatusOutput()
+	defer out.drain()
+	folder := &directory_tree.Node{DriveID: parentID}
+	return p.uploadFile(ctx, folder, local, relName, failure.remote, newRemoteIndex(remoteItems), out.add())
+}
+
+// repairFailed checks the files |relNames| that failed verification again and uploads those that
+// still don't match their GDrive copy, returning how many match now.  It only fails if |ctx| ends,
+// files that can't be repaired are reported and left as they are.
+func (p *Pusher) repairFailed(ctx context.Context, relNames []string) (int, error) {
+	p.snapshot = make(map[string]*state.SnapshotEntry)
+	defer func() {
+		// Repaired files are synced, and verified by the upload check
+		for relName, e := range p.snapshot {
+			p.st.Snapshot[relName] = e
+			p.st.Verified[relName] = time.Now()
+		}
+	}()
+
+	var fixed int
+	for _, relName := range relNames {
+		failure, err := p.checkFile(ctx, relName, p.st.Snapshot[relName])
+		if err != nil {
+			return fixed + len(p.snapshot), err
+		}
+		if failure == nil {
+			fixed++ // Fixed since it was checked
+			p.st.Verified[relName] = time.Now()
+			continue
+		}
+		if failure.local == nil {
+			p.printf("? /%s (unreadable locally, can't repair it)\n", EscapeName(relName))
+			continue
+		}
+		if err := p.repairFile(ctx, relName, failure); err != nil {
+			if ctx.Err() != nil {
+				return fixed + len(p.snapshot), ctx.Err()
+			}
+			log.Printf("Problem repairing %q: %v", relName, err)
+		}
+	}
+	return fixed + len(p.snapshot), nil
+}
+
+// verifyCoverage returns the share of synced files that have been verified at least once.
+func verifyCoverage(st *state.State) float64 {
+	var files, verified int
+	for relName, e := range st.Snapshot {
+		if e.IsDir {
+			continue
+		}
+		files++
+		if _, ok := st.Verified[relName]; ok {
+			verified++
+		}
+	}
+	if files == 0 {
+		return 1
+	}
+	return float64(verified) / float64(files)
+}
+
+// Verify implements "verify", which checks that the files synced by the last push still match
+// their GDrive copies by comparing MD5 checksums, Options.Parallel files at a time.  With
+// Options.VerifySample only part of the mirror is checked per run.  Progress is reported and saved
+// every Options.VerifyCheckpoint, and a pass that is stopped through Options.Stop is resumed by
+// the next Verify unless |restart| is set.
+func (p *Pusher) Verify(ctx context.Context, restart bool) error {
+	if p.opts.VerifySample <= 0 || p.opts.VerifySample > 100 {
+		return fmt.Errorf("--verify_sample must be in (0, 100]")
+	}
+	if p.opts.VerifyCheckpoint <= 0 {
+		return fmt.Errorf("--verify_checkpoint must be positive")
+	}
+	if p.opts.VerifyRepair && p.opts.OldFilesDir == "" {
+		return fmt.Errorf("--repair needs --old_files_dir for the bad copies")
+	}
+	if err := p.connect(ctx); err != nil {
+		return err
+	}
+	st := p.st
+
+	start := time.Now()
+	var sample []string
+	pass := st.VerifyPass
+	if pass != nil && !restart {
+		sample = resumeSample(st, pass)
+		p.printf("Resuming the verify pass started %s: %d of %d file(s) left (seed %d)\n",
+			pass.Started.Format(time.RFC3339), len(sample), pass.Files, pass.Seed)
+	} else {
+		seed := p.opts.VerifySeed
+		if seed == 0 {
+			seed = start.UnixNano()
+		}
+		sample = verifySample(st, p.opts.VerifySample, seed)
+		pass = &state.VerifyPass{Started: start, Seed: seed, Files: len(sample)}
+		st.VerifyPass = pass
+		p.printf("Verifying %d synced file(s) (seed %d)\n", len(sample), seed)
+	}
+	var totalBytes int64
+	for _, relName := range sample {
+		totalBytes += st.Snapshot[relName].Size
+	}
+
+	// Stop cleanly when asked to so that the progress so far is saved
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-p.opts.Stop:
+			p.printf("Interrupted, saving progress\n")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// mu guards st, the counters and the output while files are checked in parallel
+	var mu sync.Mutex
+	var checked int
+	var checkedBytes int64
+	checkpoint := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		eta := "unknown"
+		if elapsed := time.Since(start); checkedBytes > 0 {
+			eta = time.Duration(float64(elapsed) * float64(totalBytes-checkedBytes) / float64(checkedBytes)).Round(time.Second).String()
+		} else if checked > 0 {
+			eta = time.Duration(float64(elapsed) * float64(len(sample)-checked) / float64(checked)).Round(time.Second).String()
+		}
+		p.printf("Verified %d of %d file(s), %s of %s, ETA %s\n", checked, len(sample),
+			humanize.Bytes(uint64(checkedBytes)), humanize.Bytes(uint64(totalBytes)), eta)
+		return st.Save()
+	}
+	finished := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(p.opts.VerifyCheckpoint)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := checkpoint(); err != nil {
+					log.Printf("Problem saving verify progress: %v", err)
+				}
+			case <-finished:
+				return
+			}
+		}
+	}()
+
+	pool := p.newWorkPool()
+	for _, relName := range sample {
+		relName := relName
+		pool.run(func() error {
+			e := st.Snapshot[relName]
+			failure, err := p.checkFile(ctx, relName, e)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			checked++
+			checkedBytes += e.Size
+			if failure != nil {
+				pass.Failed = append(pass.Failed, relName)
+				p.printStatus(failure.status)
+			} else {
+				st.Verified[relName] = time.Now()
+			}
+			return nil
+		})
+	}
+	err := pool.wait()
+	close(finished)
+	if err != nil {
+		if err := checkpoint(); err != nil {
+			return err
+		}
+		return fmt.Errorf("Verify stopped after %d of %d file(s), run it again to resume: %v", checked, len(sample), err)
+	}
+
+	mismatches := len(pass.Failed)
+	var repaired int
+	if p.opts.VerifyRepair && mismatches > 0 {
+		p.printf("\nUploading %d file(s) that failed verification again\n", mismatches)
+		if repaired, err = p.repairFailed(ctx, pass.Failed); err != nil {
+			if err := st.Save(); err != nil {
+				return err
+			}
+			return fmt.Errorf("Repair stopped, run verify again to resume: %v", err)
+		}
+	}
+	st.VerifyPass = nil
+	if err := st.Save(); err != nil {
+		return err
+	}
+
+	coverage := verifyCoverage(st)
+	p.printf("%d mismatch(es), %d repaired, %.1f%% of synced files verified at least once\n", mismatches, repaired, coverage*100)
+	result := "ok"
+	if mismatches > repaired {
+		result = fmt.Sprintf("%d mismatch(es)", mismatches-repaired)
+	}
+	r := p.newRun("verify", start, result)
+	r.FilesVerified = checked
+	r.VerifyMismatches = mismatches
+	r.VerifyCoverage = coverage
+	p.appendRun(r)
+	if mismatches > repaired {
+		return fmt.Errorf("%d file(s) failed verification", mismatches-repaired)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+// readLastManifest returns the manifest of the last push: the local --manifest file if there is
+// one, else the copy --upload_manifest put in the GDrive folder |rootID|.  It returns nil if there
+// is neither.
+func (p *Pusher) readLastManifest(ctx context.Context, rootID string) (*manifest, error) {
+	data, err := os.ReadFile(p.opts.Manifest)
+	if os.IsNotExist(err) && !p.opts.Offline {
+		var idx *remoteIndex
+		if idx, err = p.indexFolder(ctx, rootID); err != nil {
+			return nil, fmt.Errorf("Problem listing GDrive folder: %v", err)
+		}
+		f := idx.named(filepath.Base(p.opts.Manifest))
+		if f == nil {
+			return nil, nil
+		}
+		dir, err := os.MkdirTemp("", "gdrive-dir-push")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "manifest.json")
+		if err := p.downloadFile(ctx, f, path); err != nil {
+			return nil, err
+		}
+		data, err = os.ReadFile(path)
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Problem parsing manifest: %v", err)
+	}
+	return m, nil
+}
+
+// seedSnapshot fills the empty snapshot of the sync state from the manifest of the last push, for
+// --warm_start.  Only what is provably as that push left it goes in: directories not modified
+// locally since, and files whose SHA-256 still matches the manifest.  cachedListing then skips
+// listing the directories whose items are all there, and lists the rest as usual.  |tree| is the
+// local tree and |rootID| the GDrive folder it is pushed to.
+func (p *Pusher) seedSnapshot(ctx context.Context, tree *directory_tree.Node, rootID string) error {
+	if len(p.st.Snapshot) > 0 {
+		return nil
+	}
+	m, err := p.readLastManifest(ctx, rootID)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		p.printf("No --manifest of a previous push found, listing everything\n\n")
+		return nil
+	}
+	created, err := time.Parse(time.RFC3339, m.CreationInfo.Created)
+	if err != nil {
+		return fmt.Errorf("Problem parsing manifest creation time: %v", err)
+	}
+	folders := map[string]string{manifestName("."): rootID}
+	for _, f := range m.Folders {
+		folders[f.FileName] = f.DriveID
+	}
+	files := make(map[string]*manifestFileInfo, len(m.Files))
+	for _, f := range m.Files {
+		files[f.FileName] = f
+	}
+
+	var dirs, seeded int
+	var seed func(node *directory_tree.Node, relName string) error
+	seed = func(node *directory_tree.Node, relName string) error {
+		name := manifestName(relName)
+		changed := !node.Info.ModTime.Before(created)
+		if node.Info.IsDir {
+			id, ok := folders[name]
+			if !ok {
+				return nil
+			}
+			// A directory changed since gets listed, which needn't hold up those below it
+			if !changed {
+				p.st.Snapshot[relName] = &state.SnapshotEntry{ModTime: node.Info.ModTime, IsDir: true, DriveID: id}
+				dirs++
+			}
+			for _, child := range node.Children {
+				if err := seed(child, filepath.Join(relName, child.Info.Name)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		f, ok := files[name]
+		if changed || !ok || f.FileSize != node.Info.Size || len(f.Checksums) == 0 {
+			return nil
+		}
+		sum, err := localSHA256(p.sourceFS(), filepath.ToSlash(relName))
+		if err != nil {
+			return fmt.Errorf("Problem hashing %q: %v", relName, err)
+		}
+		if sum != f.Checksums[0].Value {
+			return nil
+		}
+		if sum, err = p.hashFile(node, relName); err != nil {
+			return fmt.Errorf("Problem hashing local file %q: %v", relName, err)
+		}
+		p.st.Snapshot[relName] = &state.SnapshotEntry{
+			Size:    node.Info.Size,
+			ModTime: node.Info.ModTime,
+			MD5:     sum,
+			DriveID: f.DriveID,
+		}
+		seeded++
+		return nil
+	}
+	if err := seed(tree, "."); err != nil {
+		return err
+	}
+	p.printf("Seeded %d folder(s) and %d file(s) from the manifest of %v\n\n", dirs, seeded, created)
+	return nil
+}
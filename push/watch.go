@@ -0,0 +1,193 @@
+package push
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/net/context"
+
+	"github.com/hatchling/gdrive-dir-push/directory_tree"
+)
+
+// watchDirs adds every directory of |node| to |watcher|, which doesn't watch recursively.
+func watchDirs(watcher *fsnotify.Watcher, node *directory_tree.Node) error {
+	if !node.Info.IsDir {
+		return nil
+	}
+	if err := watcher.Add(node.FullPath); err != nil {
+		return fmt.Errorf("Problem watching %q: %v", node.FullPath, err)
+	}
+	for _, child := range node.Children {
+		if err := watchDirs(watcher, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findNode returns the node at |relName| below |tree|, or nil.
+func findNode(tree *directory_tree.Node, relName string) *directory_tree.Node {
+	if relName == "." {
+		return tree
+	}
+	node := tree
+	for _, name := range strings.Split(relName, string(filepath.Separator)) {
+		var next *directory_tree.Node
+		for _, child := range node.Children {
+			if child.Info.Name == name {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		node = next
+	}
+	return node
+}
+
+// topmost drops the directories of |relDirs| that are below another one, as pushing a directory
+// pushes everything in it.
+func topmost(relDirs map[string]bool) []string {
+	var result []string
+	for relDir := range relDirs {
+		covered := false
+		for parent := relDir; parent != "." && !covered; {
+			parent = filepath.Dir(parent)
+			covered = relDirs[parent]
+		}
+		if !covered {
+			result = append(result, relDir)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// pushChanged pushes the directories |relDirs| of --local_dir_to_push again, from a fresh tree
+// rooted in GDrive at |rootID|.  It returns the tree so that new directories can be watched.
+func (p *Pusher) pushChanged(ctx context.Context, relDirs map[string]bool, rootID string) (*directory_tree.Node, error) {
+	tree, err := directory_tree.NewTreeFS(p.sourceFS(), ".", p.opts.LocalDir, p.opts.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("Problem creating directory_tree: %v", err)
+	}
+	tree.DriveID = rootID
+	if err := p.checkSource(tree, false); err != nil {
+		return nil, err
+	}
+	p.applyPolicies(tree)
+	if err := p.checkPathLimits(tree); err != nil {
+		return nil, err
+	}
+	if err := p.checkNameCollisions(tree); err != nil {
+		return nil, err
+	}
+
+	// Each push gets the full --max_gdrive_ops again
+	p.ops.reset()
+	ctx, cancel := p.ops.watch(ctx)
+	defer cancel()
+	for _, relDir := range topmost(relDirs) {
+		// A new directory is pushed from the closest parent that is already in GDrive
+		for relDir != "." {
+			p.mu.Lock()
+			e, ok := p.snapshot[relDir]
+			p.mu.Unlock()
+			if ok && e.IsDir {
+				break
+			}
+			relDir = filepath.Dir(relDir)
+		}
+		node := findNode(tree, relDir)
+		if node == nil || !node.Info.IsDir {
+			continue // Removed or filtered out since
+		}
+		if relDir != "." {
+			p.mu.Lock()
+			node.DriveID = p.snapshot[relDir].DriveID
+			p.mu.Unlock()
+		}
+		if err := p.processNode(ctx, node); err != nil {
+			return tree, err
+		}
+	}
+	return tree, nil
+}
+
+// Watch keeps Options.LocalDir in sync after a successful Apply, for --watch.  It watches the
+// directories of the tree Apply pushed and, once changes have settled for Options.WatchDelay,
+// pushes the directories they happened in, saving the sync state after each push.  Local
+// deletions are left alone like in any push.  It only returns if watching fails, or with
+// ErrInterrupted once Options.Stop is closed.
+func (p *Pusher) Watch(ctx context.Context) error {
+	tree := p.tree
+	if tree == nil {
+		return fmt.Errorf("Nothing was pushed to watch")
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watchDirs(watcher, tree); err != nil {
+		return err
+	}
+	p.printf("\nWatching %q for changes\n", p.opts.LocalDir)
+
+	changed := make(map[string]bool)
+	settled := time.NewTimer(p.opts.WatchDelay)
+	settled.Stop()
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+			relDir, err := filepath.Rel(p.opts.LocalDir, filepath.Dir(ev.Name))
+			if err != nil || strings.HasPrefix(relDir, "..") {
+				continue
+			}
+			changed[relDir] = true
+			settled.Reset(p.opts.WatchDelay)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Problem watching for changes: %v", err)
+
+		case <-settled.C:
+			p.printf("\n%v: pushing changes in %d folder(s)\n", time.Now().Format(time.RFC3339), len(changed))
+			newTree, err := p.pushChanged(ctx, changed, tree.DriveID)
+			changed = make(map[string]bool)
+			if err != nil {
+				log.Printf("Problem pushing changes, retrying with the next change: %v", err)
+			}
+			p.markDrift(ctx)
+			if err := p.st.Save(); err != nil {
+				log.Printf("Problem saving sync state: %v", err)
+			}
+			SaveOpsLog()
+			if newTree != nil {
+				if err := watchDirs(watcher, newTree); err != nil {
+					return err
+				}
+			}
+			usage.print(p.opts.Output)
+
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.opts.Stop:
+			return ErrInterrupted
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+var rcloneConfig = flag.String("rclone_config", "", "rclone config file that init offers to import a Drive remote from, by default $RCLONE_CONFIG or ~/.config/rclone/rclone.conf")
+
+// rcloneEncrypted starts rclone config files encrypted with a password, which can't be imported.
+const rcloneEncrypted = "RCLONE_ENCRYPT_V0:"
+
+// rcloneRemote is a Drive remote of an rclone config file.
+type rcloneRemote struct {
+	name         string
+	clientID     string
+	clientSecret string
+	scope        string
+	rootFolderID string
+	token        *oauth2.Token
+}
+
+// rcloneConfigPath returns the rclone config file to look for Drive remotes in.
+func rcloneConfigPath() (string, error) {
+	if *rcloneConfig != "" {
+		return *rcloneConfig, nil
+	}
+	if path := os.Getenv("RCLONE_CONFIG"); path != "" {
+		return path, nil
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, ".config", "rclone", "rclone.conf"), nil
+}
+
+// readRcloneRemotes returns the Drive remotes of the rclone config file at |path|, in the order
+// they appear.
+func readRcloneRemotes(path string) ([]*rcloneRemote, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var remotes []*rcloneRemote
+	var current *rcloneRemote
+	var isDrive bool
+	var tokenJSON string
+	end := func() error {
+		if current == nil || !isDrive {
+			return nil
+		}
+		if tokenJSON != "" {
+			current.token = &oauth2.Token{}
+			if err := json.Unmarshal([]byte(tokenJSON), current.token); err != nil {
+				return fmt.Errorf("Problem parsing the token of rclone remote %q: %v", current.name, err)
+			}
+		}
+		remotes = append(remotes, current)
+		return nil
+	}
+	scanner := bufio.NewScanner(f)
+	for first := true; scanner.Scan(); first = false {
+		line := strings.TrimSpace(scanner.Text())
+		if first && strings.HasPrefix(line, rcloneEncrypted) {
+			return nil, fmt.Errorf("%s is encrypted, decrypt it with \"rclone config encryption remove\" to import from it", path)
+		}
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			if err := end(); err != nil {
+				return nil, err
+			}
+			current, isDrive, tokenJSON = &rcloneRemote{name: line[1 : len(line)-1]}, false, ""
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if current == nil || eq < 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[eq+1:])
+		switch strings.TrimSpace(line[:eq]) {
+		case "type":
+			isDrive = value == "drive"
+		case "client_id":
+			current.clientID = value
+		case "client_secret":
+			current.clientSecret = value
+		case "scope":
+			current.scope = value
+		case "root_folder_id":
+			current.rootFolderID = value
+		case "token":
+			tokenJSON = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := end(); err != nil {
+		return nil, err
+	}
+	return remotes, nil
+}
+
+// importable returns why |r| can't be used by this tool, or "" if it can.  Tokens rclone obtained
+// with its own OAuth client are only good with that client, and those of narrower scopes can't
+// push.
+func (r *rcloneRemote) importable() string {
+	switch {
+	case r.clientID == "" || r.clientSecret == "":
+		return "it uses rclone's own OAuth client"
+	case r.scope != "" && r.scope != "drive":
+		return fmt.Sprintf("its scope %q can't write everywhere", r.scope)
+	case r.token == nil || r.token.RefreshToken == "":
+		return "it holds no token"
+	}
+	return ""
+}
+
+// offerRcloneImport looks for Drive remotes in the rclone config file and asks on |in| whether to
+// import the first one that can be.  It returns the remote to import, or nil to set up an OAuth
+// client from scratch.
+func offerRcloneImport(in *bufio.Reader) (*rcloneRemote, error) {
+	path, err := rcloneConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	remotes, err := readRcloneRemotes(path)
+	if os.IsNotExist(err) && *rcloneConfig == "" {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Problem reading rclone config: %v", err)
+	}
+	for _, r := range remotes {
+		if why := r.importable(); why != "" {
+			fmt.Printf("Found rclone remote %q in %s, but can't import it: %s\n", r.name, path, why)
+			continue
+		}
+		answer, err := prompt(in, fmt.Sprintf("Found rclone remote %q in %s, import its OAuth client and token? (y/n)", r.name, path), "y")
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(strings.ToLower(answer), "y") {
+			return r, nil
+		}
+	}
+	if len(remotes) > 0 {
+		fmt.Println()
+	}
+	return nil, nil
+}
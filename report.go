@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/hatchling/gdrive-dir-push/push"
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+var reportFile = flag.String("report", "", "Write a JSON summary of the push to this file when it ends, whether it succeeded or not")
+
+// pushReport is the summary of a push that is printed at the end and written to --report.
+type pushReport struct {
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	RootID         string    `json:"root_id"`
+	LocalDir       string    `json:"local_dir"`
+	DryRun         bool      `json:"dry_run,omitempty"`
+	FoldersCreated int       `json:"folders_created"`
+	FilesUploaded  int       `json:"files_uploaded"`
+	FilesReplaced  int       `json:"files_replaced"`
+	FilesCopied    int       `json:"files_copied"`
+	FilesRelocated int       `json:"files_relocated"`
+	FilesUnchanged int       `json:"files_unchanged"`
+	BytesUploaded  int64     `json:"bytes_uploaded"`
+	// ElapsedSeconds is how long the push took and BytesPerSecond its average upload throughput.
+	ElapsedSeconds float64       `json:"elapsed_seconds"`
+	BytesPerSecond float64       `json:"bytes_per_second"`
+	Errors         []reportError `json:"errors,omitempty"`
+	// Result is "ok" for a successful push, otherwise what went wrong.
+	Result string `json:"result"`
+}
+
+// reportError is a problem a push ran into, with the path it concerns if any.  Paths are relative
+// to --local_dir_to_push, with slashes and escaped like status lines.
+type reportError struct {
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error"`
+}
+
+// newReport returns the summary of the push recorded in the history as |run|, which totalled |s|.
+func newReport(run *state.Run, s push.Summary) *pushReport {
+	r := &pushReport{
+		Start:          run.Start,
+		End:            run.End,
+		RootID:         run.RootID,
+		LocalDir:       run.LocalDir,
+		DryRun:         run.DryRun,
+		FoldersCreated: run.FoldersCreated,
+		FilesUploaded:  run.FilesUploaded,
+		FilesReplaced:  run.FilesReplaced,
+		FilesCopied:    run.FilesCopied,
+		FilesRelocated: s.FilesRelocated,
+		FilesUnchanged: s.FilesUnchanged,
+		BytesUploaded:  run.BytesUploaded,
+		ElapsedSeconds: run.End.Sub(run.Start).Seconds(),
+		Result:         run.Result,
+	}
+	if r.ElapsedSeconds > 0 {
+		r.BytesPerSecond = float64(r.BytesUploaded) / r.ElapsedSeconds
+	}
+	for _, f := range s.Failures {
+		r.Errors = append(r.Errors, reportError{Path: f.Path, Error: f.Error})
+	}
+	for _, path := range s.Violations {
+		r.Errors = append(r.Errors, reportError{Path: path, Error: "changed locally while --immutable is set"})
+	}
+	if s.Err != nil {
+		r.Errors = append(r.Errors, reportError{Error: s.Err.Error()})
+	}
+	return r
+}
+
+// save writes |r| to --report, if set.
+func (r *pushReport) save() error {
+	if *reportFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(*reportFile, append(data, '\n'), 0644)
+}
+
+// print reports the totals of |r| in a few lines.
+func (r *pushReport) print() {
+	fmt.Printf("Took %v\n", r.End.Sub(r.Start).Round(time.Millisecond))
+	fmt.Printf("  %d folder(s) created, %d file(s) uploaded (%d replacing older versions), %d copied, %d relocated, %d unchanged\n",
+		r.FoldersCreated, r.FilesUploaded, r.FilesReplaced, r.FilesCopied, r.FilesRelocated, r.FilesUnchanged)
+	fmt.Printf("  %s transferred, %s/s on average\n", humanize.Bytes(uint64(r.BytesUploaded)), humanize.Bytes(uint64(r.BytesPerSecond)))
+	if len(r.Errors) > 0 {
+		fmt.Printf("  %d error(s):\n", len(r.Errors))
+		for _, e := range r.Errors {
+			if e.Path == "" {
+				fmt.Printf("    %s\n", e.Error)
+			} else {
+				fmt.Printf("    /%s: %s\n", e.Path, e.Error)
+			}
+		}
+	}
+}
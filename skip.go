@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hatchling/gdrive-dir-push/push"
+	"github.com/hatchling/gdrive-dir-push/state"
+)
+
+// skipCommand implements "skip list", "skip add PATH [REASON]", "skip remove PATH" and "skip
+// clear", which manage the paths, relative to --local_dir_to_push, that pushes leave out.
+func skipCommand(args []string, statePath string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: skip list|add PATH [REASON]|remove PATH|clear")
+	}
+	st, err := state.Load(statePath, *gDriveRootID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		relNames := make([]string, 0, len(st.Skip))
+		for relName := range st.Skip {
+			relNames = append(relNames, relName)
+		}
+		sort.Strings(relNames)
+		for _, relName := range relNames {
+			e := st.Skip[relName]
+			fmt.Printf("%s  /%s  %s\n", e.Added.Local().Format("2006-01-02 15:04"), push.EscapeName(relName), e.Reason)
+		}
+		return nil
+	case args[0] == "add" && (len(args) == 2 || len(args) == 3):
+		reason := "added by hand"
+		if len(args) == 3 {
+			reason = args[2]
+		}
+		st.Skip[filepath.Clean(args[1])] = &state.SkipEntry{Reason: reason, Added: time.Now()}
+	case args[0] == "remove" && len(args) == 2:
+		relName := filepath.Clean(args[1])
+		if _, ok := st.Skip[relName]; !ok {
+			return fmt.Errorf("%q is not in the skip list", relName)
+		}
+		delete(st.Skip, relName)
+	case args[0] == "clear" && len(args) == 1:
+		st.Skip = make(map[string]*state.SkipEntry)
+	default:
+		return fmt.Errorf("Usage: skip list|add PATH [REASON]|remove PATH|clear")
+	}
+	return st.Save()
+}
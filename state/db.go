@@ -0,0 +1,159 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// UseDB keeps the snapshot and the hash cache, which grow with the pushed tree, in an embedded
+// database next to the state file instead of in it.  Saves then only write the entries that
+// changed, and loads don't parse a large JSON document.
+var UseDB bool
+
+// Buckets of the database.
+var (
+	snapshotBucket = []byte("snapshot")
+	hashesBucket   = []byte("hashes")
+)
+
+// dbPath returns where the database of the state at |path| is kept.
+func dbPath(path string) string {
+	return strings.TrimSuffix(path, ".json") + ".db"
+}
+
+// openDB opens the database at |path|, waiting a while for another run that has it open.
+func openDB(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Problem opening state database %q: %v", path, err)
+	}
+	return db, nil
+}
+
+// loadDB replaces the snapshot and the hash cache with those in the database, if there is one,
+// and remembers them to tell what changed when saving.
+func (s *State) loadDB() error {
+	path := dbPath(s.path)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	db, err := openDB(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	snapshot := make(map[string]*SnapshotEntry)
+	hashes := make(map[string]*HashEntry)
+	if err := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(snapshotBucket); b != nil {
+			if err := b.ForEach(func(k, v []byte) error {
+				e := &SnapshotEntry{}
+				snapshot[string(k)] = e
+				return json.Unmarshal(v, e)
+			}); err != nil {
+				return err
+			}
+		}
+		if b := tx.Bucket(hashesBucket); b != nil {
+			return b.ForEach(func(k, v []byte) error {
+				e := &HashEntry{}
+				hashes[string(k)] = e
+				return json.Unmarshal(v, e)
+			})
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("Corrupt state database %q: %v", path, err)
+	}
+	s.Snapshot, s.Hashes = snapshot, hashes
+	s.remember()
+	return nil
+}
+
+// remember notes the snapshot and hash cache entries as saved.  Entries are replaced rather than
+// modified, so a different pointer means a changed entry.
+func (s *State) remember() {
+	s.savedSnapshot = make(map[string]*SnapshotEntry, len(s.Snapshot))
+	for k, e := range s.Snapshot {
+		s.savedSnapshot[k] = e
+	}
+	s.savedHashes = make(map[string]*HashEntry, len(s.Hashes))
+	for k, e := range s.Hashes {
+		s.savedHashes[k] = e
+	}
+}
+
+// sameSnapshotEntry reports whether |a| and |b| record the same thing, the snapshot of each run is
+// made afresh.
+func sameSnapshotEntry(a, b *SnapshotEntry) bool {
+	return a.Size == b.Size && a.ModTime.Equal(b.ModTime) && a.MD5 == b.MD5 && a.IsDir == b.IsDir &&
+		a.DriveID == b.DriveID
+}
+
+// saveDB writes the entries of the snapshot and the hash cache that changed since they were loaded
+// or last saved to the database.
+func (s *State) saveDB() error {
+	db, err := openDB(dbPath(s.path))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(snapshotBucket)
+		if err != nil {
+			return err
+		}
+		for k, e := range s.Snapshot {
+			if old, ok := s.savedSnapshot[k]; ok && (old == e || sameSnapshotEntry(old, e)) {
+				continue
+			}
+			v, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		for k := range s.savedSnapshot {
+			if _, ok := s.Snapshot[k]; !ok {
+				if err := b.Delete([]byte(k)); err != nil {
+					return err
+				}
+			}
+		}
+
+		if b, err = tx.CreateBucketIfNotExists(hashesBucket); err != nil {
+			return err
+		}
+		for k, e := range s.Hashes {
+			if s.savedHashes[k] == e {
+				continue
+			}
+			v, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		for k := range s.savedHashes {
+			if _, ok := s.Hashes[k]; !ok {
+				if err := b.Delete([]byte(k)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("Problem saving state database: %v", err)
+	}
+	s.remember()
+	return nil
+}
@@ -0,0 +1,84 @@
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// historyFile is the append-only log of runs kept in the state dir, one JSON object per line.
+const historyFile = "history.jsonl"
+
+// Run is one entry in the run history.
+type Run struct {
+	ID string `json:"id"`
+	// Kind is "push" or "verify".
+	Kind           string         `json:"kind"`
+	Start          time.Time      `json:"start"`
+	End            time.Time      `json:"end"`
+	RootID         string         `json:"root_id"`
+	LocalDir       string         `json:"local_dir"`
+	DryRun         bool           `json:"dry_run,omitempty"`
+	FoldersCreated int            `json:"folders_created"`
+	FilesUploaded  int            `json:"files_uploaded"`
+	FilesReplaced  int            `json:"files_replaced"`
+	FilesCopied    int            `json:"files_copied,omitempty"`
+	BytesUploaded  int64          `json:"bytes_uploaded"`
+	StorageAdded   int64          `json:"storage_added,omitempty"`
+	APICalls       map[string]int `json:"api_calls,omitempty"`
+	// Verification runs record how many files were checked, how many didn't match and what share
+	// of the synced files has been verified at least once.
+	FilesVerified    int     `json:"files_verified,omitempty"`
+	VerifyMismatches int     `json:"verify_mismatches,omitempty"`
+	VerifyCoverage   float64 `json:"verify_coverage,omitempty"`
+	// Result is "ok" for a successful run, otherwise what went wrong.
+	Result string `json:"result"`
+	// Report is the --report file written for the run, Journal the --journal it replayed and
+	// ResumeLog the resume log it left behind to pick up from with --resume.
+	Report    string `json:"report,omitempty"`
+	Journal   string `json:"journal,omitempty"`
+	ResumeLog string `json:"resume_log,omitempty"`
+}
+
+// AppendHistory adds |r| to the run history kept in |dir|.
+func AppendHistory(dir string, r *Run) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, historyFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// History returns all runs recorded in |dir|, oldest first.
+func History(dir string) ([]*Run, error) {
+	f, err := os.Open(filepath.Join(dir, historyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var runs []*Run
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		r := &Run{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			// A run killed mid-write leaves a partial line, skip it rather than losing the rest
+			continue
+		}
+		runs = append(runs, r)
+	}
+	return runs, scanner.Err()
+}
@@ -0,0 +1,100 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// hourFormat keys OpsLog buckets by UTC hour.
+const hourFormat = "2006-01-02T15"
+
+// OpsLog counts Drive API requests per hour across all runs that share a state dir, so that a
+// daily per-user quota can be respected by work spread over several runs.
+type OpsLog struct {
+	Hours map[string]int `json:"hours"`
+
+	path string
+}
+
+// LoadOpsLog reads the ops log kept in |dir|.  A missing file yields an empty log.
+func LoadOpsLog(dir string) (*OpsLog, error) {
+	l := &OpsLog{Hours: make(map[string]int), path: filepath.Join(dir, "ops.json")}
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(l); err != nil {
+		return nil, err
+	}
+	if l.Hours == nil {
+		l.Hours = make(map[string]int)
+	}
+	return l, nil
+}
+
+// Add records one request made at |now| and forgets hours that are more than a day old.
+func (l *OpsLog) Add(now time.Time) {
+	l.Hours[now.UTC().Format(hourFormat)]++
+	for hour := range l.Hours {
+		if t, err := time.Parse(hourFormat, hour); err != nil || now.Sub(t) >= 25*time.Hour {
+			delete(l.Hours, hour)
+		}
+	}
+}
+
+// window returns the hours that still count toward the day ending at |now|.
+func (l *OpsLog) window(now time.Time) []time.Time {
+	var hours []time.Time
+	for hour := range l.Hours {
+		if t, err := time.Parse(hourFormat, hour); err == nil && now.Sub(t) < 24*time.Hour {
+			hours = append(hours, t)
+		}
+	}
+	return hours
+}
+
+// LastDay returns how many requests were made in the 24 hours before |now|.
+func (l *OpsLog) LastDay(now time.Time) int {
+	var n int
+	for _, t := range l.window(now) {
+		n += l.Hours[t.Format(hourFormat)]
+	}
+	return n
+}
+
+// FreesAt returns when the oldest hour still counted at |now| drops out of the window.
+func (l *OpsLog) FreesAt(now time.Time) time.Time {
+	oldest := now
+	for _, t := range l.window(now) {
+		if t.Before(oldest) {
+			oldest = t
+		}
+	}
+	return oldest.Add(24 * time.Hour)
+}
+
+// Save atomically writes the log back to the file it was loaded from.
+func (l *OpsLog) Save() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(l); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
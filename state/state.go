@@ -0,0 +1,278 @@
+// Package state persists what gdrive-dir-push learns about a sync relationship between runs: the
+// local hash cache, a snapshot of the last successful sync, and cached GDrive folder listings.
+// They are kept in a JSON file, optionally with the snapshot and hash cache in a database beside
+// it (see UseDB).
+//
+// All local paths are stored relative to the pushed directory so that a state file can be moved to
+// another machine along with the data it describes.
+package state
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+// exportVersion is bumped whenever the exported format changes incompatibly.
+const exportVersion = 1
+
+// HashEntry caches the MD5 of a local file.  The entry is only valid while the file's size and
+// modification time still match.
+type HashEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	MD5     string    `json:"md5"`
+}
+
+// SnapshotEntry records a file or folder as it was when it was last synced successfully.
+type SnapshotEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	MD5     string    `json:"md5,omitempty"`
+	IsDir   bool      `json:"is_dir"`
+	DriveID string    `json:"drive_id"`
+}
+
+// RemoteEntry is a cached GDrive item as returned by a folder listing.
+type RemoteEntry struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+	MD5      string `json:"md5,omitempty"`
+	Origin   string `json:"origin,omitempty"`
+}
+
+// SkipEntry records why a local path is excluded from pushes.
+type SkipEntry struct {
+	Reason string    `json:"reason"`
+	Added  time.Time `json:"added"`
+}
+
+// MissingEntry tracks a GDrive item that --delete_extraneous found with nothing local to match, until
+// it is removed or comes back.
+type MissingEntry struct {
+	// Path is where the item is, relative to the root.
+	Path     string    `json:"path"`
+	ParentID string    `json:"parent_id"`
+	Since    time.Time `json:"since"`
+	// Runs counts the runs that found it missing.
+	Runs int `json:"runs"`
+}
+
+// VerifyPass is a run of the verify command that hasn't finished, kept so that an interrupted run
+// picks up where it stopped instead of starting over.
+type VerifyPass struct {
+	Started time.Time `json:"started"`
+	Seed    int64     `json:"seed"`
+	// Files is how many files the pass set out to verify.
+	Files int `json:"files"`
+	// Failed lists the files of the pass that didn't verify, which unlike the others get no
+	// Verified time.
+	Failed []string `json:"failed,omitempty"`
+}
+
+// State is everything remembered about one (GDrive root, local dir) sync relationship.
+type State struct {
+	RootID string `json:"root_id"`
+	// ResolvedRootID is the real folder ID RootID referred to when last seen online, which differs
+	// for aliases such as "root".
+	ResolvedRootID string `json:"resolved_root_id,omitempty"`
+
+	Hashes   map[string]*HashEntry     `json:"hashes"`
+	Snapshot map[string]*SnapshotEntry `json:"snapshot"`
+	Remote   map[string][]*RemoteEntry `json:"remote"`
+	// Listed records when each listing in Remote was taken.  It is dropped once this tool writes to
+	// the folder, the listing is then only good for --offline plans.
+	Listed map[string]time.Time `json:"listed"`
+	// Verified records when each file was last verified against GDrive.
+	Verified map[string]time.Time `json:"verified"`
+	// Skip lists local paths that are left out of every push, such as files that failed before.
+	Skip map[string]*SkipEntry `json:"skip"`
+	// JournalSynced is the time of the last change the --journal replays have pushed.
+	JournalSynced time.Time `json:"journal_synced"`
+	// Missing holds the GDrive items, by ID, that are missing locally but still within the grace of
+	// --delete_extraneous.
+	Missing map[string]*MissingEntry `json:"missing"`
+	// VerifyPass is the verify run in progress, if any.
+	VerifyPass *VerifyPass `json:"verify_pass,omitempty"`
+	// DriftToken is where GDrive's change feed stood at the end of the last run, changes after it
+	// weren't made by this tool.
+	DriftToken string `json:"drift_token,omitempty"`
+	// ChangesToken is where GDrive's change feed stood when the folder listings in Remote were last
+	// brought up to date from it, for --remote_changes.
+	ChangesToken string `json:"changes_token,omitempty"`
+
+	path string
+	// savedSnapshot and savedHashes hold the entries as in the database, with UseDB.
+	savedSnapshot map[string]*SnapshotEntry
+	savedHashes   map[string]*HashEntry
+}
+
+// DefaultDir returns the directory state is kept in when no other is configured.
+func DefaultDir() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, ".gdrive-dir-push"), nil
+}
+
+// Path returns the file under |dir| that holds the state for pushing |localDir| to |rootID|.
+func Path(dir, rootID, localDir string) string {
+	sum := sha1.Sum([]byte(rootID + "\n" + localDir))
+	return filepath.Join(dir, "state", hex.EncodeToString(sum[:8])+".json")
+}
+
+// New returns an empty State for |rootID| that will be saved to |path|.
+func New(path, rootID string) *State {
+	return &State{
+		RootID:   rootID,
+		Hashes:   make(map[string]*HashEntry),
+		Snapshot: make(map[string]*SnapshotEntry),
+		Remote:   make(map[string][]*RemoteEntry),
+		Listed:   make(map[string]time.Time),
+		Verified: make(map[string]time.Time),
+		Skip:     make(map[string]*SkipEntry),
+		Missing:  make(map[string]*MissingEntry),
+		path:     path,
+	}
+}
+
+// Load reads the state saved at |path|.  A missing file yields an empty State.
+func Load(path, rootID string) (*State, error) {
+	s := New(path, rootID)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(s); err != nil {
+		return nil, fmt.Errorf("Corrupt state file %q: %v", path, err)
+	}
+	s.fill()
+	// The database is read whether or not UseDB is still set, so that turning it off goes back to
+	// the state file without losing anything
+	if err := s.loadDB(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Path returns the file the state is saved to.
+func (s *State) Path() string {
+	return s.path
+}
+
+// fill makes sure none of the maps are nil after decoding.
+func (s *State) fill() {
+	if s.Hashes == nil {
+		s.Hashes = make(map[string]*HashEntry)
+	}
+	if s.Snapshot == nil {
+		s.Snapshot = make(map[string]*SnapshotEntry)
+	}
+	if s.Remote == nil {
+		s.Remote = make(map[string][]*RemoteEntry)
+	}
+	if s.Listed == nil {
+		s.Listed = make(map[string]time.Time)
+	}
+	if s.Verified == nil {
+		s.Verified = make(map[string]time.Time)
+	}
+	if s.Skip == nil {
+		s.Skip = make(map[string]*SkipEntry)
+	}
+	if s.Missing == nil {
+		s.Missing = make(map[string]*MissingEntry)
+	}
+}
+
+// Save atomically writes the state back to the file it was loaded from, with UseDB the snapshot
+// and hash cache go to the database instead.
+func (s *State) Save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	saved := s
+	if UseDB {
+		if err := s.saveDB(); err != nil {
+			return err
+		}
+		rest := *s
+		rest.Snapshot, rest.Hashes = nil, nil
+		saved = &rest
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(saved); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if !UseDB {
+		// Everything is in the state file again, a database left behind would go stale
+		if err := os.Remove(dbPath(s.path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// CachedMD5 returns the cached checksum for |relPath| if the file hasn't changed since it was
+// hashed.
+func (s *State) CachedMD5(relPath string, size int64, modTime time.Time) (string, bool) {
+	e, ok := s.Hashes[relPath]
+	if !ok || e.Size != size || !e.ModTime.Equal(modTime) {
+		return "", false
+	}
+	return e.MD5, true
+}
+
+// exported is the portable envelope written by Export.
+type exported struct {
+	Version int    `json:"version"`
+	State   *State `json:"state"`
+}
+
+// Export writes the state to |w| in a portable format that Import understands.
+func (s *State) Export(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&exported{Version: exportVersion, State: s})
+}
+
+// Import reads a state written by Export from |r|.  The result will be saved to |path|.
+func Import(r io.Reader, path string) (*State, error) {
+	var e exported
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		return nil, err
+	}
+	if e.Version != exportVersion {
+		return nil, fmt.Errorf("Unsupported state export version %d", e.Version)
+	}
+	if e.State == nil {
+		return nil, fmt.Errorf("Export contains no state")
+	}
+	e.State.path = path
+	e.State.fill()
+	return e.State, nil
+}